@@ -1,22 +1,34 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"html/template"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
+	// Embedded zone data, since slim images ship without /usr/share/zoneinfo.
+	_ "time/tzdata"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
 
 	"robertomachorro/smartchat/internal/config"
 	"robertomachorro/smartchat/internal/handler"
+	"robertomachorro/smartchat/internal/markdown"
 	"robertomachorro/smartchat/internal/service/auth"
 	"robertomachorro/smartchat/internal/service/chat"
+	"robertomachorro/smartchat/internal/service/mail"
 	"robertomachorro/smartchat/internal/service/openai"
+	"robertomachorro/smartchat/internal/service/webhook"
 	"robertomachorro/smartchat/internal/store"
+	"robertomachorro/smartchat/internal/tracing"
 )
 
 func main() {
@@ -24,40 +36,206 @@ func main() {
 	if err != nil {
 		log.Fatalf("config error: %v", err)
 	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: cfg.LogLevel})))
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Enabled, cfg.Tracing.ServiceName)
+	if err != nil {
+		log.Fatalf("tracing error: %v", err)
+	}
 	rootDir, err := config.RepoRoot()
 	if err != nil {
 		log.Fatalf("root error: %v", err)
 	}
 
-	redisStore, err := store.NewRedisStore(cfg.RedisURL)
+	store.SetKeyPrefix(cfg.Redis.KeyPrefix)
+	redisStore, err := store.NewRedisStore(cfg.RedisURL, store.Options{
+		PoolSize:           cfg.Redis.PoolSize,
+		MinIdleConns:       cfg.Redis.MinIdleConns,
+		InsecureSkipVerify: cfg.Redis.InsecureSkipVerify,
+		Tracing:            cfg.Tracing.Enabled,
+	})
 	if err != nil {
 		log.Fatalf("redis error: %v", err)
 	}
 
-	aiClient := openai.NewClient(cfg.OpenAI.BaseURL, cfg.OpenAI.APIKey)
+	transport, err := openai.NewTransport(openai.TransportOptions{
+		ProxyURL:            cfg.OpenAI.ProxyURL,
+		CACertFile:          cfg.OpenAI.CACertFile,
+		MaxIdleConns:        cfg.OpenAI.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.OpenAI.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.OpenAI.IdleConnTimeout,
+		DialTimeout:         cfg.OpenAI.DialTimeout,
+		TLSHandshakeTimeout: cfg.OpenAI.TLSHandshakeTimeout,
+	})
+	if err != nil {
+		log.Fatalf("openai transport error: %v", err)
+	}
+	newAIClient := func(baseURL, apiKey string) *openai.Client {
+		client := openai.NewClient(baseURL, apiKey, cfg.OpenAI.Timeout)
+		client.StreamUsage = cfg.OpenAI.StreamUsage
+		if transport != nil {
+			client.HTTP.Transport = transport
+		}
+		return client
+	}
+	aiClient := newAIClient(cfg.OpenAI.BaseURL, cfg.OpenAI.APIKey)
+	aiClient.Organization = cfg.OpenAI.Organization
+	aiClient.Project = cfg.OpenAI.Project
 	chatService := chat.NewService(redisStore.Client, aiClient)
+	chatService.MaxContextMessages = cfg.Chat.MaxContextMessages
+	chatService.MaxContextTokens = cfg.Chat.MaxContextTokens
+	chatService.MaxChatsPerUser = cfg.Chat.MaxChatsPerUser
+	chatService.MaxMessagesPerChat = cfg.Chat.MaxMessagesPerChat
+	chatService.TrimOldMessages = cfg.Chat.TrimOldMessages
+	chatService.MessagesPerMinute = cfg.Chat.MessagesPerMinute
+	chatService.MaxMessageChars = cfg.Chat.MaxMessageChars
+	chatService.MonthlyTokenQuota = cfg.Chat.MonthlyTokenQuota
+	chatService.MonthlyCostQuotaMicros = cfg.Chat.MonthlyCostQuotaMicros
+	chatService.DefaultSystemPrompt = cfg.Chat.DefaultSystemPrompt
+	chatService.SafetyPrompt = cfg.Chat.SafetyPrompt
+	chatService.WelcomeMessage = cfg.Chat.WelcomeMessage
+	chatService.WelcomeInContext = cfg.Chat.WelcomeInContext
+	for _, redaction := range cfg.Chat.ReplyRedactions {
+		chatService.Redactions = append(chatService.Redactions, chat.Redaction{Pattern: redaction.Pattern, Replace: redaction.Replace})
+	}
+	chatService.KeepRawReplies = cfg.Chat.KeepRawReplies
+	chatService.TitleMaxRunes = cfg.Chat.TitleMaxChars
+	chatService.TitleModel = cfg.Chat.TitleModel
+	chatService.CompletionTimeout = cfg.OpenAI.Timeout
+	chatService.ChatTTL = cfg.Chat.ChatTTL
+	chatService.Models = cfg.OpenAI.Models
+	chatService.DiscoverModels = cfg.OpenAI.DiscoverModels
+	chatService.ModelCooldown = cfg.OpenAI.ModelCooldown
+	chatService.JSONModeModels = cfg.OpenAI.JSONModeModels
+	chatService.VisionModels = cfg.OpenAI.VisionModels
+	chatService.LegacyModels = cfg.OpenAI.LegacyModels
+	chatService.ModelAliases = cfg.OpenAI.ModelAliases
+	chatService.BlockedModels = cfg.OpenAI.BlockedModels
+	chatService.Pricing = make(map[string]chat.ModelPrice, len(cfg.OpenAI.Pricing))
+	for model, price := range cfg.OpenAI.Pricing {
+		chatService.Pricing[model] = chat.ModelPrice{InputPer1K: price.Input, OutputPer1K: price.Output}
+	}
+	for _, provider := range cfg.OpenAI.Providers {
+		providerClient := newAIClient(provider.BaseURL, provider.APIKey)
+		providerClient.Organization = provider.Organization
+		providerClient.Project = provider.Project
+		for _, model := range provider.Models {
+			chatService.RouteModel(model, providerClient)
+		}
+	}
+	if cfg.OpenAI.EnableTools {
+		chatService.RegisterBuiltinTools()
+	}
+	var notifier *webhook.Notifier
+	if cfg.Webhook.URL != "" {
+		notifier = webhook.New(cfg.Webhook.URL, cfg.Webhook.Secret)
+		chatService.Events = notifier
+	}
 	authService := auth.NewService(cfg)
+	authService.Tokens, err = auth.NewTokenStore(redisStore.Client, cfg.SessionKey)
+	if err != nil {
+		log.Fatalf("token store error: %v", err)
+	}
+	if cfg.LocalAuth {
+		authService.Local = auth.NewLocalAccounts(redisStore.Client)
+		if cfg.LocalAdminPassword != "" {
+			for _, email := range cfg.AdminEmails {
+				err := authService.Local.Create(context.Background(), email, "", cfg.LocalAdminPassword)
+				if err != nil && !errors.Is(err, auth.ErrAccountExists) {
+					log.Fatalf("create local admin %s: %v", email, err)
+				}
+			}
+		}
+	}
+	if cfg.MagicLink.Configured() {
+		authService.MagicLinks = auth.NewMagicLinks(redisStore.Client, mail.New(cfg.MagicLink.SMTP), cfg.SessionKey, cfg.MagicLink, cfg.InstanceName)
+	}
 
-	sessionStore := sessions.NewCookieStore([]byte(cfg.SessionKey))
-	sessionStore.Options = &sessions.Options{
+	sessionOptions := &sessions.Options{
 		Path:     "/",
-		MaxAge:   86400 * 7,
 		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteLaxMode,
+		Secure:   cfg.Cookie.Secure,
+		SameSite: cfg.Cookie.SameSite,
+	}
+	// MaxAge also bounds how old a signed cookie the store will accept.
+	var sessionStore sessions.Store
+	if cfg.Cookie.Backend == "redis" {
+		redisSessions := store.NewSessionStore(redisStore.Client, []byte(cfg.SessionKey))
+		redisSessions.Options = sessionOptions
+		redisSessions.MaxAge(int(cfg.Cookie.MaxAge.Seconds()))
+		sessionStore = redisSessions
+	} else {
+		cookieSessions := sessions.NewCookieStore([]byte(cfg.SessionKey))
+		cookieSessions.Options = sessionOptions
+		cookieSessions.MaxAge(int(cfg.Cookie.MaxAge.Seconds()))
+		sessionStore = cookieSessions
 	}
 
+	h := handler.NewHandler(cfg, sessionStore, authService, chatService, redisStore)
+
 	router := gin.New()
+	// ClientIP, which the login limits key on, only believes X-Forwarded-For
+	// from these.
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("trusted proxies error: %v", err)
+	}
+	router.Use(h.Trace)
+	router.Use(h.RequestLogger)
+	router.Use(h.APIErrors)
 	router.Use(gin.Recovery())
-	router.Use(gin.Logger())
+	router.Use(h.CORS)
+	router.Use(h.LimitRequestBody)
 	router.SetHTMLTemplate(loadTemplates(rootDir))
 	router.Static("/static", filepath.Join(rootDir, "web", "static"))
-
-	h := handler.NewHandler(cfg, sessionStore, authService, chatService)
 	h.RegisterRoutes(router)
 
-	if err := router.Run("0.0.0.0:" + cfg.Port); err != nil {
-		log.Fatalf("server error: %v", err)
+	server := &http.Server{
+		Addr:    "0.0.0.0:" + cfg.Port,
+		Handler: router,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.Chat.GCInterval > 0 {
+		go chatService.RunOrphanGC(ctx, cfg.Chat.GCInterval)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+	case <-ctx.Done():
+		stop()
+		slog.Info("shutting down, draining requests", "timeout", cfg.ShutdownTimeout.String())
+		start := time.Now()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutdown error", "error", err)
+		}
+		slog.Info("drained", "seconds", time.Since(start).Seconds())
+	}
+
+	if notifier != nil {
+		webhookCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := notifier.Close(webhookCtx); err != nil {
+			slog.Warn("webhook events not delivered before exit", "error", err)
+		}
+		cancel()
+	}
+	if err := redisStore.Close(); err != nil {
+		slog.Error("redis close error", "error", err)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("tracing flush error", "error", err)
 	}
 }
 
@@ -66,9 +244,17 @@ func loadTemplates(rootDir string) *template.Template {
 		"formatUTC": func(value time.Time) string {
 			return value.UTC().Format(time.RFC3339)
 		},
+		"formatLocal": func(value time.Time, location *time.Location) string {
+			if location == nil {
+				location = time.UTC
+			}
+			return value.In(location).Format("Jan 2, 2006 3:04 PM MST")
+		},
 		"trimContent": func(value string) string {
 			return strings.TrimSpace(value)
 		},
+		"renderMarkdown": markdown.Render,
+		"csrfField":      handler.CSRFField,
 	})
 	template.Must(tmpl.ParseGlob(filepath.Join(rootDir, "web", "templates", "*.html")))
 	template.Must(tmpl.ParseGlob(filepath.Join(rootDir, "web", "templates", "partials", "*.html")))
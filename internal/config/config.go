@@ -2,11 +2,22 @@ package config
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type OAuthConfig struct {
@@ -15,21 +26,246 @@ type OAuthConfig struct {
 	RedirectURL  string
 }
 
-type OpenAIConfig struct {
+func (c OAuthConfig) Configured() bool {
+	return c.ClientID != "" && c.ClientSecret != "" && c.RedirectURL != ""
+}
+
+func (c OAuthConfig) partial() bool {
+	return c.ClientID != "" || c.ClientSecret != "" || c.RedirectURL != ""
+}
+
+// GitLabConfig points at gitlab.com unless BaseURL names a self-hosted
+// instance.
+type GitLabConfig struct {
+	OAuthConfig
 	BaseURL string
-	APIKey  string
-	Models  []string
+}
+
+// MicrosoftConfig signs in through Azure AD. Tenant is a tenant id or
+// domain, or "common" to accept any work, school or personal account.
+type MicrosoftConfig struct {
+	OAuthConfig
+	Tenant string
+	// AllowMultiTenant must be set to use "common" or "organizations",
+	// since any directory's admin can then vouch for its users.
+	AllowMultiTenant bool
+}
+
+// MultiTenant reports whether Tenant admits accounts from any directory.
+func (c MicrosoftConfig) MultiTenant() bool {
+	tenant := strings.ToLower(c.Tenant)
+	return tenant == "common" || tenant == "organizations"
+}
+
+type OIDCConfig struct {
+	OAuthConfig
+	Issuer string
+}
+
+func (c OIDCConfig) Configured() bool {
+	return c.Issuer != "" && c.OAuthConfig.Configured()
+}
+
+type ModelProvider struct {
+	BaseURL      string   `json:"baseUrl"`
+	APIKey       string   `json:"apiKey"`
+	Organization string   `json:"organization"`
+	Project      string   `json:"project"`
+	Models       []string `json:"models"`
+}
+
+// ModelPrice is a model's price in dollars per 1K tokens.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// ReplyRedaction is one REPLY_REDACTIONS rule: every match of Pattern in an
+// assistant reply becomes Replace.
+type ReplyRedaction struct {
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+type OpenAIConfig struct {
+	BaseURL        string
+	APIKey         string
+	Organization   string
+	Project        string
+	Models         []string
+	Providers      []ModelProvider
+	Timeout        time.Duration
+	DiscoverModels bool
+	// StreamUsage sends stream_options.include_usage so streamed replies
+	// end with the backend's token counts.
+	StreamUsage bool
+	// ModelCooldown is how long a model the backend rejected as unknown is
+	// shown as unavailable; zero only reports the error.
+	ModelCooldown  time.Duration
+	JSONModeModels []string
+	VisionModels   []string
+	LegacyModels   []string
+	Pricing        map[string]ModelPrice
+	// ModelAliases maps display names to backend model ids. BlockedModels
+	// are hidden from everyone but admins.
+	ModelAliases  map[string]string
+	BlockedModels []string
+	EnableTools   bool
+	// TemperatureMin and TemperatureMax bound every temperature a user can
+	// pick, in the preferences and on each message.
+	TemperatureMin float64
+	TemperatureMax float64
+	// ReadyCheck adds a model listing to /readyz. Unless ReadyCheckStrict
+	// is set, a listing that times out reports "unknown" instead of failing
+	// readiness.
+	ReadyCheck       bool
+	ReadyCheckStrict bool
+	// ProxyURL and CACertFile route backend calls through a corporate
+	// proxy; unset, the standard HTTPS_PROXY/NO_PROXY variables apply.
+	ProxyURL   string
+	CACertFile string
+	// The pool settings keep connections to the backends open for reuse;
+	// DialTimeout and TLSHandshakeTimeout bound connecting on its own, within
+	// Timeout. Zero keeps Go's default for each.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+}
+
+type RedisConfig struct {
+	PoolSize           int
+	MinIdleConns       int
+	InsecureSkipVerify bool
+	// KeyPrefix namespaces every key so several apps can share one Redis.
+	KeyPrefix string
+}
+
+// maxSystemPromptRunes mirrors chat.MaxSystemPromptRunes so an oversized
+// DEFAULT_SYSTEM_PROMPT is rejected at startup rather than on first use;
+// maxTitleRunes mirrors chat.MaxTitleRunes the same way. maxTemperature is
+// the highest temperature the OpenAI API accepts.
+const (
+	maxSystemPromptRunes = 4000
+	maxTitleRunes        = 120
+	maxTemperature       = 2.0
+)
+
+type ChatConfig struct {
+	DefaultSystemPrompt string
+	SafetyPrompt        string
+	MaxContextMessages  int
+	MaxContextTokens    int
+	MaxChatsPerUser     int
+	MessagesPerMinute   int
+	MaxMessageChars     int
+	MonthlyTokenQuota   int
+	// MaxMessagesPerChat caps each chat's history; with TrimOldMessages the
+	// oldest messages make room instead of new ones being refused.
+	MaxMessagesPerChat int
+	TrimOldMessages    bool
+	// MonthlyCostQuotaMicros is MONTHLY_COST_QUOTA in micro-dollars.
+	MonthlyCostQuotaMicros int64
+	ChatTTL                time.Duration
+	// GCInterval schedules orphaned-key collection; zero turns it off.
+	GCInterval    time.Duration
+	TitleMaxChars int
+	// TitleModel, when set, writes each chat's title from its first
+	// exchange instead of cutting down the first message.
+	TitleModel string
+	// WelcomeMessage opens every new chat as an assistant message, sent to
+	// the model only with WelcomeInContext.
+	WelcomeMessage   string
+	WelcomeInContext bool
+	// ReplyRedactions clean assistant replies before they are stored, in
+	// order; KeepRawReplies keeps the original of any reply they changed.
+	ReplyRedactions []ReplyRedaction
+	KeepRawReplies  bool
+}
+
+type CookieConfig struct {
+	Secure   bool
+	MaxAge   time.Duration
+	SameSite http.SameSite
+	// Sliding re-issues the session cookie as the user stays active, so
+	// MaxAge counts from the last visit instead of from sign-in.
+	Sliding bool
+	// Backend is "cookie" to keep session values in the signed cookie, or
+	// "redis" to keep them in Redis behind a session id.
+	Backend string
+}
+
+// WebhookConfig posts an event to URL after every completion, signed with
+// Secret; an empty URL turns it off.
+type WebhookConfig struct {
+	URL    string
+	Secret string
+}
+
+// MagicLinkConfig emails single-use sign-in links. CallbackURL is the
+// absolute /login/magic/callback address put in the email; it is configured
+// rather than taken from the request so a forged Host header cannot point
+// the link elsewhere.
+type MagicLinkConfig struct {
+	CallbackURL string
+	TTL         time.Duration
+	SMTP        SMTPConfig
+}
+
+func (c MagicLinkConfig) Configured() bool {
+	return c.CallbackURL != ""
+}
+
+// SMTPConfig is the mail server magic links go out through. Port 465 uses
+// implicit TLS; other ports upgrade with STARTTLS when the server offers it.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// TracingConfig turns on OTLP export when an endpoint is set; the exporter
+// reads its remaining OTEL_EXPORTER_OTLP_* settings straight from the env.
+type TracingConfig struct {
+	Enabled     bool
+	ServiceName string
 }
 
 type Config struct {
-	Port         string
-	RedisURL     string
-	SessionKey   string
-	InstanceName string
-	AllowedUsers []string
-	OAuthGoogle  OAuthConfig
-	OAuthGitHub  OAuthConfig
-	OpenAI       OpenAIConfig
+	Port            string
+	ShutdownTimeout time.Duration
+	LogLevel        slog.Level
+	RedisURL        string
+	SessionKey      string
+	Cookie          CookieConfig
+	InstanceName    string
+	AllowedUsers    []string
+	AllowedDomains  []string
+	AdminEmails     []string
+	// CORSAllowedOrigins lists the other origins (scheme://host[:port]) that
+	// may call /api with the session cookie.
+	CORSAllowedOrigins []string
+	// TrustedProxies lists the addresses and CIDR ranges whose
+	// X-Forwarded-For header is believed; none are trusted by default.
+	TrustedProxies []string
+	LocalAuth      bool
+	// LocalAdminPassword creates local accounts for AdminEmails at startup
+	// so a deployment without OAuth has someone who can add users.
+	LocalAdminPassword string
+	OAuthGoogle        OAuthConfig
+	OAuthGitHub        OAuthConfig
+	OAuthGitLab        GitLabConfig
+	OAuthMicrosoft     MicrosoftConfig
+	OAuthOIDC          OIDCConfig
+	OpenAI             OpenAIConfig
+	Chat               ChatConfig
+	Redis              RedisConfig
+	Tracing            TracingConfig
+	Webhook            WebhookConfig
+	MagicLink          MagicLinkConfig
 }
 
 func Load() (Config, error) {
@@ -40,26 +276,337 @@ func Load() (Config, error) {
 	if err := loadEnvFile(filepath.Join(rootDir, ".env")); err != nil {
 		return Config{}, err
 	}
+	maxContextMessages, err := getEnvInt("MAX_CONTEXT_MESSAGES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxContextTokens, err := getEnvInt("MAX_CONTEXT_TOKENS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxChatsPerUser, err := getEnvInt("MAX_CHATS_PER_USER", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxMessageChars, err := getEnvInt("MAX_MESSAGE_CHARS", 32000)
+	if err != nil {
+		return Config{}, err
+	}
+	maxMessagesPerChat, err := getEnvInt("MAX_MESSAGES_PER_CHAT", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	var trimOldMessages bool
+	switch strings.ToLower(getEnv("MESSAGES_OVER_LIMIT", "reject")) {
+	case "reject":
+	case "trim":
+		trimOldMessages = true
+	default:
+		return Config{}, fmt.Errorf("invalid MESSAGES_OVER_LIMIT: must be reject or trim")
+	}
+	monthlyTokenQuota, err := getEnvInt("MONTHLY_TOKEN_QUOTA", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	monthlyCostQuota, err := getEnvMicros("MONTHLY_COST_QUOTA")
+	if err != nil {
+		return Config{}, err
+	}
+	chatTTLDays, err := getEnvInt("CHAT_TTL_DAYS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	gcMinutes, err := getEnvInt("CHAT_GC_INTERVAL_MINUTES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	titleMaxChars, err := getEnvInt("CHAT_TITLE_MAX_CHARS", 32)
+	if err != nil {
+		return Config{}, err
+	}
+	messagesPerMinute, err := getEnvInt("MESSAGES_PER_MINUTE", 30)
+	if err != nil {
+		return Config{}, err
+	}
+	enableTools, err := getEnvBool("OPENAI_ENABLE_TOOLS", false)
+	if err != nil {
+		return Config{}, err
+	}
+	discoverModels, err := getEnvBool("OPENAI_DISCOVER_MODELS", false)
+	if err != nil {
+		return Config{}, err
+	}
+	readyCheck, err := getEnvBool("OPENAI_READY_CHECK", false)
+	if err != nil {
+		return Config{}, err
+	}
+	readyCheckStrict, err := getEnvBool("OPENAI_READY_CHECK_STRICT", false)
+	if err != nil {
+		return Config{}, err
+	}
+	redisPoolSize, err := getEnvInt("REDIS_POOL_SIZE", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	redisMinIdle, err := getEnvInt("REDIS_MIN_IDLE_CONNS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	redisSkipVerify, err := getEnvBool("REDIS_TLS_INSECURE_SKIP_VERIFY", false)
+	if err != nil {
+		return Config{}, err
+	}
+	openAITimeout, err := getEnvInt("OPENAI_TIMEOUT_SECONDS", 120)
+	if err != nil {
+		return Config{}, err
+	}
+	streamUsage, err := getEnvBool("OPENAI_STREAM_INCLUDE_USAGE", true)
+	if err != nil {
+		return Config{}, err
+	}
+	temperatureMin, err := getEnvFloat("TEMPERATURE_MIN", 0.1)
+	if err != nil {
+		return Config{}, err
+	}
+	temperatureMax, err := getEnvFloat("TEMPERATURE_MAX", 1.0)
+	if err != nil {
+		return Config{}, err
+	}
+	modelCooldown, err := getEnvInt("MODEL_FAILURE_COOLDOWN_SECONDS", 300)
+	if err != nil {
+		return Config{}, err
+	}
+	openAIMaxIdle, err := getEnvInt("OPENAI_MAX_IDLE_CONNS", 100)
+	if err != nil {
+		return Config{}, err
+	}
+	openAIMaxIdlePerHost, err := getEnvInt("OPENAI_MAX_IDLE_CONNS_PER_HOST", 32)
+	if err != nil {
+		return Config{}, err
+	}
+	openAIIdleTimeout, err := getEnvInt("OPENAI_IDLE_CONN_TIMEOUT_SECONDS", 90)
+	if err != nil {
+		return Config{}, err
+	}
+	openAIDialTimeout, err := getEnvInt("OPENAI_DIAL_TIMEOUT_SECONDS", 10)
+	if err != nil {
+		return Config{}, err
+	}
+	openAITLSTimeout, err := getEnvInt("OPENAI_TLS_HANDSHAKE_TIMEOUT_SECONDS", 10)
+	if err != nil {
+		return Config{}, err
+	}
+	secrets, err := loadSecrets()
+	if err != nil {
+		return Config{}, err
+	}
+	providers, err := parseModelProviders(secrets["MODEL_PROVIDERS"])
+	if err != nil {
+		return Config{}, err
+	}
+	pricing, err := parseModelPricing(os.Getenv("MODEL_PRICING"))
+	if err != nil {
+		return Config{}, err
+	}
+	aliases, err := parseModelAliases(os.Getenv("MODEL_ALIASES"))
+	if err != nil {
+		return Config{}, err
+	}
+	shutdownSeconds, err := getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 30)
+	if err != nil {
+		return Config{}, err
+	}
+	cookieSecure, err := getEnvBool("COOKIE_SECURE", true)
+	if err != nil {
+		return Config{}, err
+	}
+	sessionDays, err := getEnvInt("SESSION_MAX_AGE_DAYS", 7)
+	if err != nil {
+		return Config{}, err
+	}
+	localAuth, err := getEnvBool("LOCAL_AUTH_ENABLED", false)
+	if err != nil {
+		return Config{}, err
+	}
+	magicLinkTTL, err := getEnvInt("MAGIC_LINK_TTL_SECONDS", 900)
+	if err != nil {
+		return Config{}, err
+	}
+	smtpPort, err := getEnvInt("SMTP_PORT", 587)
+	if err != nil {
+		return Config{}, err
+	}
+	welcomeInContext, err := getEnvBool("WELCOME_MESSAGE_IN_CONTEXT", false)
+	if err != nil {
+		return Config{}, err
+	}
+	replyRedactions, err := parseReplyRedactions(os.Getenv("REPLY_REDACTIONS"))
+	if err != nil {
+		return Config{}, err
+	}
+	keepRawReplies, err := getEnvBool("KEEP_RAW_REPLIES", false)
+	if err != nil {
+		return Config{}, err
+	}
+	slidingSession, err := getEnvBool("SESSION_SLIDING_EXPIRY", false)
+	if err != nil {
+		return Config{}, err
+	}
+	microsoftMultiTenant, err := getEnvBool("OAUTH_MICROSOFT_ALLOW_MULTI_TENANT", false)
+	if err != nil {
+		return Config{}, err
+	}
+	sameSite, err := parseSameSite(getEnv("COOKIE_SAMESITE", "lax"))
+	if err != nil {
+		return Config{}, err
+	}
+	corsOrigins, err := parseOrigins(splitCSV(os.Getenv("CORS_ALLOWED_ORIGINS")))
+	if err != nil {
+		return Config{}, err
+	}
+	trustedProxies, err := parseProxies(splitCSV(os.Getenv("TRUSTED_PROXIES")))
+	if err != nil {
+		return Config{}, err
+	}
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		return Config{}, fmt.Errorf("invalid LOG_LEVEL: must be debug, info, warn or error")
+	}
+	sessionBackend := strings.ToLower(getEnv("SESSION_BACKEND", "cookie"))
+	if sessionBackend != "cookie" && sessionBackend != "redis" {
+		return Config{}, fmt.Errorf("invalid SESSION_BACKEND: must be cookie or redis")
+	}
 	cfg := Config{
-		Port:         getEnv("PORT", "8080"),
-		RedisURL:     os.Getenv("REDIS_URL"),
-		SessionKey:   os.Getenv("SESSION_KEY"),
-		InstanceName: getEnv("INSTANCE_NAME", ""),
-		AllowedUsers: splitPipeList(os.Getenv("ALLOWED_USERS")),
+		Port:            getEnv("PORT", "8080"),
+		ShutdownTimeout: time.Duration(shutdownSeconds) * time.Second,
+		LogLevel:        logLevel,
+		RedisURL:        secrets["REDIS_URL"],
+		SessionKey:      secrets["SESSION_KEY"],
+		Cookie: CookieConfig{
+			Secure:   cookieSecure,
+			MaxAge:   time.Duration(sessionDays) * 24 * time.Hour,
+			SameSite: sameSite,
+			Sliding:  slidingSession,
+			Backend:  sessionBackend,
+		},
+		InstanceName:       strings.TrimSpace(os.Getenv("INSTANCE_NAME")),
+		AllowedUsers:       splitPipeList(os.Getenv("ALLOWED_USERS")),
+		AllowedDomains:     normalizeDomains(splitCSV(os.Getenv("ALLOWED_EMAIL_DOMAINS"))),
+		AdminEmails:        splitPipeList(os.Getenv("ADMIN_EMAILS")),
+		CORSAllowedOrigins: corsOrigins,
+		TrustedProxies:     trustedProxies,
+		LocalAuth:          localAuth,
+		LocalAdminPassword: secrets["LOCAL_ADMIN_PASSWORD"],
 		OAuthGoogle: OAuthConfig{
 			ClientID:     os.Getenv("OAUTH_GOOGLE_CLIENT_ID"),
-			ClientSecret: os.Getenv("OAUTH_GOOGLE_CLIENT_SECRET"),
+			ClientSecret: secrets["OAUTH_GOOGLE_CLIENT_SECRET"],
 			RedirectURL:  os.Getenv("OAUTH_GOOGLE_REDIRECT_URL"),
 		},
 		OAuthGitHub: OAuthConfig{
 			ClientID:     os.Getenv("OAUTH_GITHUB_CLIENT_ID"),
-			ClientSecret: os.Getenv("OAUTH_GITHUB_CLIENT_SECRET"),
+			ClientSecret: secrets["OAUTH_GITHUB_CLIENT_SECRET"],
 			RedirectURL:  os.Getenv("OAUTH_GITHUB_REDIRECT_URL"),
 		},
+		OAuthGitLab: GitLabConfig{
+			OAuthConfig: OAuthConfig{
+				ClientID:     os.Getenv("OAUTH_GITLAB_CLIENT_ID"),
+				ClientSecret: secrets["OAUTH_GITLAB_CLIENT_SECRET"],
+				RedirectURL:  os.Getenv("OAUTH_GITLAB_REDIRECT_URL"),
+			},
+			BaseURL: strings.TrimRight(getEnv("OAUTH_GITLAB_BASE_URL", "https://gitlab.com"), "/"),
+		},
+		OAuthMicrosoft: MicrosoftConfig{
+			OAuthConfig: OAuthConfig{
+				ClientID:     os.Getenv("OAUTH_MICROSOFT_CLIENT_ID"),
+				ClientSecret: secrets["OAUTH_MICROSOFT_CLIENT_SECRET"],
+				RedirectURL:  os.Getenv("OAUTH_MICROSOFT_REDIRECT_URL"),
+			},
+			Tenant:           strings.TrimSpace(os.Getenv("OAUTH_MICROSOFT_TENANT")),
+			AllowMultiTenant: microsoftMultiTenant,
+		},
+		OAuthOIDC: OIDCConfig{
+			OAuthConfig: OAuthConfig{
+				ClientID:     os.Getenv("OAUTH_OIDC_CLIENT_ID"),
+				ClientSecret: secrets["OAUTH_OIDC_CLIENT_SECRET"],
+				RedirectURL:  os.Getenv("OAUTH_OIDC_REDIRECT_URL"),
+			},
+			Issuer: strings.TrimRight(os.Getenv("OAUTH_OIDC_ISSUER"), "/"),
+		},
 		OpenAI: OpenAIConfig{
-			BaseURL: os.Getenv("OPENAI_API_BASE_URL"),
-			APIKey:  os.Getenv("OPENAI_API_KEY"),
-			Models:  splitCSV(os.Getenv("OPENAI_API_MODELS")),
+			BaseURL:             os.Getenv("OPENAI_API_BASE_URL"),
+			APIKey:              secrets["OPENAI_API_KEY"],
+			Organization:        os.Getenv("OPENAI_ORGANIZATION"),
+			Project:             os.Getenv("OPENAI_PROJECT"),
+			Models:              mergeModels(splitCSV(os.Getenv("OPENAI_API_MODELS")), providers),
+			Providers:           providers,
+			Timeout:             time.Duration(openAITimeout) * time.Second,
+			DiscoverModels:      discoverModels,
+			StreamUsage:         streamUsage,
+			TemperatureMin:      temperatureMin,
+			TemperatureMax:      temperatureMax,
+			ModelCooldown:       time.Duration(modelCooldown) * time.Second,
+			JSONModeModels:      splitCSV(os.Getenv("OPENAI_JSON_MODE_MODELS")),
+			VisionModels:        splitCSV(os.Getenv("OPENAI_VISION_MODELS")),
+			LegacyModels:        splitCSV(os.Getenv("OPENAI_LEGACY_COMPLETION_MODELS")),
+			Pricing:             pricing,
+			ModelAliases:        aliases,
+			BlockedModels:       splitCSV(os.Getenv("BLOCKED_MODELS")),
+			EnableTools:         enableTools,
+			ReadyCheck:          readyCheck,
+			ReadyCheckStrict:    readyCheckStrict,
+			ProxyURL:            secrets["OPENAI_PROXY_URL"],
+			CACertFile:          os.Getenv("OPENAI_CA_CERT_FILE"),
+			MaxIdleConns:        openAIMaxIdle,
+			MaxIdleConnsPerHost: openAIMaxIdlePerHost,
+			IdleConnTimeout:     time.Duration(openAIIdleTimeout) * time.Second,
+			DialTimeout:         time.Duration(openAIDialTimeout) * time.Second,
+			TLSHandshakeTimeout: time.Duration(openAITLSTimeout) * time.Second,
+		},
+		Chat: ChatConfig{
+			DefaultSystemPrompt:    strings.TrimSpace(os.Getenv("DEFAULT_SYSTEM_PROMPT")),
+			SafetyPrompt:           strings.TrimSpace(os.Getenv("SAFETY_PROMPT")),
+			MaxContextMessages:     maxContextMessages,
+			MaxContextTokens:       maxContextTokens,
+			MaxChatsPerUser:        maxChatsPerUser,
+			MaxMessageChars:        maxMessageChars,
+			MaxMessagesPerChat:     maxMessagesPerChat,
+			TrimOldMessages:        trimOldMessages,
+			MonthlyTokenQuota:      monthlyTokenQuota,
+			MonthlyCostQuotaMicros: monthlyCostQuota,
+			MessagesPerMinute:      messagesPerMinute,
+			ChatTTL:                time.Duration(chatTTLDays) * 24 * time.Hour,
+			GCInterval:             time.Duration(gcMinutes) * time.Minute,
+			TitleMaxChars:          titleMaxChars,
+			TitleModel:             strings.TrimSpace(os.Getenv("CHAT_TITLE_MODEL")),
+			WelcomeMessage:         strings.TrimSpace(os.Getenv("WELCOME_MESSAGE")),
+			WelcomeInContext:       welcomeInContext,
+			ReplyRedactions:        replyRedactions,
+			KeepRawReplies:         keepRawReplies,
+		},
+		Tracing: TracingConfig{
+			Enabled:     os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "",
+			ServiceName: getEnv("OTEL_SERVICE_NAME", "smartchat"),
+		},
+		Redis: RedisConfig{
+			PoolSize:           redisPoolSize,
+			MinIdleConns:       redisMinIdle,
+			InsecureSkipVerify: redisSkipVerify,
+			KeyPrefix:          os.Getenv("REDIS_KEY_PREFIX"),
+		},
+		Webhook: WebhookConfig{
+			URL:    strings.TrimSpace(os.Getenv("EVENT_WEBHOOK_URL")),
+			Secret: secrets["EVENT_WEBHOOK_SECRET"],
+		},
+		MagicLink: MagicLinkConfig{
+			CallbackURL: strings.TrimSpace(os.Getenv("MAGIC_LINK_CALLBACK_URL")),
+			TTL:         time.Duration(magicLinkTTL) * time.Second,
+			SMTP: SMTPConfig{
+				Host:     strings.TrimSpace(os.Getenv("SMTP_HOST")),
+				Port:     smtpPort,
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: secrets["SMTP_PASSWORD"],
+				From:     strings.TrimSpace(os.Getenv("SMTP_FROM")),
+			},
 		},
 	}
 	return cfg, cfg.Validate()
@@ -76,27 +623,140 @@ func (c Config) Validate() error {
 	if c.InstanceName == "" {
 		missing = append(missing, "INSTANCE_NAME")
 	}
-	if c.OAuthGoogle.ClientID == "" || c.OAuthGoogle.ClientSecret == "" || c.OAuthGoogle.RedirectURL == "" {
+	// Each login provider is optional, but one that is half configured is
+	// almost certainly a typo, and at least one must be usable.
+	if c.OAuthGoogle.partial() && !c.OAuthGoogle.Configured() {
 		missing = append(missing, "OAUTH_GOOGLE_CLIENT_ID", "OAUTH_GOOGLE_CLIENT_SECRET", "OAUTH_GOOGLE_REDIRECT_URL")
 	}
-	if c.OAuthGitHub.ClientID == "" || c.OAuthGitHub.ClientSecret == "" || c.OAuthGitHub.RedirectURL == "" {
+	if c.OAuthGitHub.partial() && !c.OAuthGitHub.Configured() {
 		missing = append(missing, "OAUTH_GITHUB_CLIENT_ID", "OAUTH_GITHUB_CLIENT_SECRET", "OAUTH_GITHUB_REDIRECT_URL")
 	}
+	if c.OAuthGitLab.partial() && !c.OAuthGitLab.Configured() {
+		missing = append(missing, "OAUTH_GITLAB_CLIENT_ID", "OAUTH_GITLAB_CLIENT_SECRET", "OAUTH_GITLAB_REDIRECT_URL")
+	}
+	if c.OAuthMicrosoft.partial() && !c.OAuthMicrosoft.Configured() {
+		missing = append(missing, "OAUTH_MICROSOFT_CLIENT_ID", "OAUTH_MICROSOFT_CLIENT_SECRET", "OAUTH_MICROSOFT_REDIRECT_URL")
+	}
+	if c.OAuthMicrosoft.Configured() && c.OAuthMicrosoft.Tenant == "" {
+		missing = append(missing, "OAUTH_MICROSOFT_TENANT")
+	}
+	if (c.OAuthOIDC.Issuer != "" || c.OAuthOIDC.partial()) && !c.OAuthOIDC.Configured() {
+		missing = append(missing, "OAUTH_OIDC_ISSUER", "OAUTH_OIDC_CLIENT_ID", "OAUTH_OIDC_CLIENT_SECRET", "OAUTH_OIDC_REDIRECT_URL")
+	}
+	if c.MagicLink.Configured() && (c.MagicLink.SMTP.Host == "" || c.MagicLink.SMTP.From == "") {
+		missing = append(missing, "SMTP_HOST", "SMTP_FROM")
+	}
+	if !c.OAuthGoogle.Configured() && !c.OAuthGitHub.Configured() && !c.OAuthGitLab.Configured() &&
+		!c.OAuthMicrosoft.Configured() && !c.OAuthOIDC.Configured() && !c.LocalAuth && !c.MagicLink.Configured() {
+		missing = append(missing, "one of OAUTH_GOOGLE_*, OAUTH_GITHUB_*, OAUTH_GITLAB_*, OAUTH_MICROSOFT_*, OAUTH_OIDC_*, MAGIC_LINK_CALLBACK_URL or LOCAL_AUTH_ENABLED=true")
+	}
 	if c.OpenAI.BaseURL == "" {
 		missing = append(missing, "OPENAI_API_BASE_URL")
 	}
 	if c.OpenAI.APIKey == "" {
 		missing = append(missing, "OPENAI_API_KEY")
 	}
-	if len(c.OpenAI.Models) == 0 {
+	if len(c.OpenAI.Models) == 0 && !c.OpenAI.DiscoverModels {
 		missing = append(missing, "OPENAI_API_MODELS")
 	}
 	if len(missing) > 0 {
 		return fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
 	}
+	if c.OpenAI.ProxyURL != "" {
+		if parsed, err := url.Parse(c.OpenAI.ProxyURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "socks5") || parsed.Host == "" {
+			return fmt.Errorf("invalid OPENAI_PROXY_URL: must be an http, https or socks5 URL")
+		}
+	}
+	if c.OAuthGitLab.Configured() {
+		if parsed, err := url.Parse(c.OAuthGitLab.BaseURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid OAUTH_GITLAB_BASE_URL: must be an http(s) URL")
+		}
+	}
+	if c.OAuthMicrosoft.Configured() && !validTenant(c.OAuthMicrosoft.Tenant) {
+		return fmt.Errorf("invalid OAUTH_MICROSOFT_TENANT: must be common, organizations, consumers, a tenant id or a domain")
+	}
+	if c.OAuthMicrosoft.Configured() && c.OAuthMicrosoft.MultiTenant() && !c.OAuthMicrosoft.AllowMultiTenant {
+		return fmt.Errorf("OAUTH_MICROSOFT_TENANT=%s admits every Azure directory; pin a tenant or set OAUTH_MICROSOFT_ALLOW_MULTI_TENANT=true", c.OAuthMicrosoft.Tenant)
+	}
+	if c.MagicLink.Configured() {
+		if parsed, err := url.Parse(c.MagicLink.CallbackURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid MAGIC_LINK_CALLBACK_URL: must be an http(s) URL")
+		}
+		if c.MagicLink.TTL <= 0 {
+			return fmt.Errorf("invalid MAGIC_LINK_TTL_SECONDS: must be positive")
+		}
+		if c.MagicLink.SMTP.Port <= 0 || c.MagicLink.SMTP.Port > 65535 {
+			return fmt.Errorf("invalid SMTP_PORT: must be between 1 and 65535")
+		}
+		if _, err := mail.ParseAddress(c.MagicLink.SMTP.From); err != nil {
+			return fmt.Errorf("invalid SMTP_FROM: must be an email address")
+		}
+	}
+	if c.Webhook.URL != "" {
+		if parsed, err := url.Parse(c.Webhook.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid EVENT_WEBHOOK_URL: must be an http(s) URL")
+		}
+		if c.Webhook.Secret == "" {
+			return fmt.Errorf("EVENT_WEBHOOK_URL requires EVENT_WEBHOOK_SECRET")
+		}
+	}
+	if strings.ContainsAny(c.Redis.KeyPrefix, "*?[]\\ \t\r\n") {
+		return fmt.Errorf("invalid REDIS_KEY_PREFIX: must not contain spaces or the glob characters * ? [ ] \\")
+	}
+	if sessionSlug(c.InstanceName) == "" {
+		return fmt.Errorf("invalid INSTANCE_NAME: must contain at least one ASCII letter or digit")
+	}
+	if c.OpenAI.TemperatureMax > maxTemperature {
+		return fmt.Errorf("invalid TEMPERATURE_MAX: must be at most %g", maxTemperature)
+	}
+	if c.OpenAI.TemperatureMin >= c.OpenAI.TemperatureMax {
+		return fmt.Errorf("invalid TEMPERATURE_MIN: must be below TEMPERATURE_MAX")
+	}
+	if c.Chat.MaxMessagesPerChat == 1 {
+		return fmt.Errorf("invalid MAX_MESSAGES_PER_CHAT: must be 0 or at least 2")
+	}
+	if c.Cookie.SameSite == http.SameSiteNoneMode && !c.Cookie.Secure {
+		return fmt.Errorf("COOKIE_SAMESITE=none requires COOKIE_SECURE=true")
+	}
+	if c.Chat.TitleMaxChars < 1 || c.Chat.TitleMaxChars > maxTitleRunes {
+		return fmt.Errorf("invalid CHAT_TITLE_MAX_CHARS: must be between 1 and %d", maxTitleRunes)
+	}
+	if utf8.RuneCountInString(c.Chat.DefaultSystemPrompt) > maxSystemPromptRunes {
+		return fmt.Errorf("DEFAULT_SYSTEM_PROMPT exceeds %d characters", maxSystemPromptRunes)
+	}
 	return nil
 }
 
+// SessionName is the session cookie name derived from the instance name, so
+// instances sharing a domain keep separate sessions.
+func (c Config) SessionName() string {
+	slug := sessionSlug(c.InstanceName)
+	if slug == "" {
+		return "session"
+	}
+	return slug + "-session"
+}
+
+// sessionSlug lowercases the instance name and keeps only [a-z0-9-]: every
+// run of other characters becomes a single hyphen, and hyphens are trimmed
+// from both ends.
+func sessionSlug(instance string) string {
+	var b strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(instance) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if pendingHyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingHyphen = false
+			b.WriteRune(r)
+			continue
+		}
+		pendingHyphen = true
+	}
+	return b.String()
+}
+
 func RepoRoot() (string, error) {
 	return findRepoRoot()
 }
@@ -131,6 +791,170 @@ func splitPipeList(value string) []string {
 	return cleaned
 }
 
+func parseModelProviders(value string) ([]ModelProvider, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var providers []ModelProvider
+	if err := json.Unmarshal([]byte(value), &providers); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_PROVIDERS: %w", err)
+	}
+	for i, provider := range providers {
+		provider.BaseURL = strings.TrimSpace(provider.BaseURL)
+		provider.Models = splitCSV(strings.Join(provider.Models, ","))
+		if provider.BaseURL == "" || len(provider.Models) == 0 {
+			return nil, fmt.Errorf("invalid MODEL_PROVIDERS: entry %d needs a baseUrl and at least one model", i)
+		}
+		providers[i] = provider
+	}
+	return providers, nil
+}
+
+func parseModelPricing(value string) (map[string]ModelPrice, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var pricing map[string]ModelPrice
+	if err := json.Unmarshal([]byte(value), &pricing); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_PRICING: %w", err)
+	}
+	for model, price := range pricing {
+		if price.Input < 0 || price.Output < 0 {
+			return nil, fmt.Errorf("invalid MODEL_PRICING: %s has a negative price", model)
+		}
+	}
+	return pricing, nil
+}
+
+// parseModelAliases reads a JSON object of display name to model id. Each
+// model gets at most one alias so the selector can show it under one name.
+func parseModelAliases(value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("invalid MODEL_ALIASES: %w", err)
+	}
+	aliases := make(map[string]string, len(raw))
+	targets := make(map[string]string, len(raw))
+	for alias, model := range raw {
+		alias, model = strings.TrimSpace(alias), strings.TrimSpace(model)
+		if alias == "" || model == "" {
+			return nil, fmt.Errorf("invalid MODEL_ALIASES: names and model ids must not be empty")
+		}
+		if other, ok := targets[model]; ok {
+			return nil, fmt.Errorf("invalid MODEL_ALIASES: %s has two aliases, %q and %q", model, other, alias)
+		}
+		targets[model] = alias
+		aliases[alias] = model
+	}
+	for alias := range aliases {
+		if _, ok := targets[alias]; ok {
+			return nil, fmt.Errorf("invalid MODEL_ALIASES: %q is both an alias and a model id", alias)
+		}
+	}
+	return aliases, nil
+}
+
+// parseReplyRedactions reads a JSON list of {"pattern", "replace"} rules,
+// compiling each pattern so a bad one stops startup rather than a reply.
+func parseReplyRedactions(value string) ([]ReplyRedaction, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var raw []struct {
+		Pattern string `json:"pattern"`
+		Replace string `json:"replace"`
+	}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("invalid REPLY_REDACTIONS: %w", err)
+	}
+	redactions := make([]ReplyRedaction, 0, len(raw))
+	for i, rule := range raw {
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("invalid REPLY_REDACTIONS: entry %d needs a pattern", i)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REPLY_REDACTIONS: entry %d: %w", i, err)
+		}
+		redactions = append(redactions, ReplyRedaction{Pattern: pattern, Replace: rule.Replace})
+	}
+	return redactions, nil
+}
+
+func mergeModels(models []string, providers []ModelProvider) []string {
+	seen := make(map[string]bool, len(models))
+	for _, model := range models {
+		seen[model] = true
+	}
+	for _, provider := range providers {
+		for _, model := range provider.Models {
+			if !seen[model] {
+				seen[model] = true
+				models = append(models, model)
+			}
+		}
+	}
+	return models
+}
+
+func normalizeDomains(domains []string) []string {
+	var cleaned []string
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain != "" {
+			cleaned = append(cleaned, domain)
+		}
+	}
+	return cleaned
+}
+
+// secretKeys may instead be given as <KEY>_FILE naming a file that holds
+// the value, as Docker and Kubernetes secrets are mounted.
+var secretKeys = []string{
+	"SESSION_KEY",
+	"REDIS_URL",
+	"OPENAI_API_KEY",
+	"MODEL_PROVIDERS",
+	"OPENAI_PROXY_URL",
+	"OAUTH_GOOGLE_CLIENT_SECRET",
+	"OAUTH_GITHUB_CLIENT_SECRET",
+	"OAUTH_GITLAB_CLIENT_SECRET",
+	"OAUTH_MICROSOFT_CLIENT_SECRET",
+	"OAUTH_OIDC_CLIENT_SECRET",
+	"LOCAL_ADMIN_PASSWORD",
+	"EVENT_WEBHOOK_SECRET",
+	"SMTP_PASSWORD",
+}
+
+func loadSecrets() (map[string]string, error) {
+	secrets := make(map[string]string, len(secretKeys))
+	for _, key := range secretKeys {
+		value, err := getSecret(key)
+		if err != nil {
+			return nil, err
+		}
+		secrets[key] = value
+	}
+	return secrets, nil
+}
+
+// getSecret prefers <key>_FILE over the plain variable. The file's content
+// is trimmed, since secret files usually end with a newline.
+func getSecret(key string) (string, error) {
+	path := strings.TrimSpace(os.Getenv(key + "_FILE"))
+	if path == "" {
+		return os.Getenv(key), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s_FILE: %w", key, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 func getEnv(key, fallback string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -138,6 +962,106 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvInt(key string, fallback int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid %s: must be a non-negative integer", key)
+	}
+	return parsed, nil
+}
+
+// getEnvMicros reads a non-negative dollar amount as micro-dollars.
+func getEnvMicros(key string) (int64, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseFloat(strings.TrimPrefix(value, "$"), 64)
+	if err != nil || parsed < 0 || math.IsInf(parsed, 0) {
+		return 0, fmt.Errorf("invalid %s: must be a non-negative dollar amount", key)
+	}
+	return int64(math.Round(parsed * 1e6)), nil
+}
+
+// getEnvFloat reads a non-negative decimal number.
+func getEnvFloat(key string, fallback float64) (float64, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 || math.IsInf(parsed, 0) || math.IsNaN(parsed) {
+		return 0, fmt.Errorf("invalid %s: must be a non-negative number", key)
+	}
+	return parsed, nil
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid COOKIE_SAMESITE: must be lax, strict or none")
+	}
+}
+
+func validTenant(tenant string) bool {
+	if tenant == "" {
+		return false
+	}
+	for _, r := range tenant {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseProxies(values []string) ([]string, error) {
+	for _, value := range values {
+		if _, err := netip.ParsePrefix(value); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(value); err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %q is not an IP address or CIDR range", value)
+		}
+	}
+	return values, nil
+}
+
+func parseOrigins(values []string) ([]string, error) {
+	origins := make([]string, 0, len(values))
+	for _, value := range values {
+		parsed, err := url.Parse(strings.TrimSuffix(value, "/"))
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+			parsed.Path != "" || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+			return nil, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS: %q is not a scheme://host[:port] origin", value)
+		}
+		origins = append(origins, strings.ToLower(parsed.Scheme+"://"+parsed.Host))
+	}
+	return origins, nil
+}
+
+func getEnvBool(key string, fallback bool) (bool, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: must be true or false", key)
+	}
+	return parsed, nil
+}
+
 func loadEnvFile(path string) error {
 	file, err := os.Open(path)
 	if errors.Is(err, os.ErrNotExist) {
@@ -0,0 +1,32 @@
+package config
+
+import "testing"
+
+func TestSessionName(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance string
+		want     string
+	}{
+		{"simple", "SmartChat", "smartchat-session"},
+		{"spaces", "Team Chat", "team-chat-session"},
+		{"digits", "Chat 2", "chat-2-session"},
+		{"punctuation run", "Acme!!!  --  Chat???", "acme-chat-session"},
+		{"leading and trailing", "  ***Acme Chat***  ", "acme-chat-session"},
+		{"existing hyphens", "acme--chat", "acme-chat-session"},
+		{"non-ASCII letters", "Café Ünïcode", "caf-n-code-session"},
+		{"non-ASCII only", "日本語チャット", "session"},
+		{"mixed scripts", "Chat 日本 2", "chat-2-session"},
+		{"emoji", "🚀 Launch 🚀", "launch-session"},
+		{"empty after sanitizing", "!!! ???", "session"},
+		{"empty", "", "session"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Config{InstanceName: tt.instance}.SessionName()
+			if got != tt.want {
+				t.Errorf("SessionName() for %q = %q, want %q", tt.instance, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+// DeleteChatsConfirmation issues the token DeleteAllChats asks for, so a
+// stray request cannot wipe an account on its own.
+func (h *Handler) DeleteChatsConfirmation(c *gin.Context) {
+	confirmation, err := h.Chat.IssueDeleteConfirmation(c.Request.Context(), h.userEmail(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue confirmation"})
+		return
+	}
+	c.JSON(http.StatusOK, confirmation)
+}
+
+func (h *Handler) DeleteAllChats(c *gin.Context) {
+	var payload struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		if !h.bodyTooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		}
+		return
+	}
+	userEmail := h.userEmail(c)
+	if err := h.Chat.ConsumeDeleteConfirmation(c.Request.Context(), userEmail, payload.Token); err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrInvalidConfirmation) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	deleted, err := h.Chat.DeleteAllChats(c.Request.Context(), userEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	_ = h.setSessionChatID(c, "")
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/config"
+	"robertomachorro/smartchat/internal/service/auth"
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+const defaultAdminPageLimit = 50
+
+// checkState stands in for the per-login state in the sample AuthURLs.
+const checkState = "auth-check"
+
+// providerCheck describes one login provider's settings. The client secret
+// is only reported as present or not.
+type providerCheck struct {
+	Provider        auth.Provider `json:"provider"`
+	Enabled         bool          `json:"enabled"`
+	ClientIDSet     bool          `json:"clientIdSet"`
+	ClientSecretSet bool          `json:"clientSecretSet"`
+	RedirectURL     string        `json:"redirectUrl,omitempty"`
+	AuthURL         string        `json:"authUrl,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// RequireAdmin runs after RequireAuth and only lets ADMIN_EMAILS through.
+func (h *Handler) RequireAdmin(c *gin.Context) {
+	if !h.isAdmin(h.userEmail(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "admin only"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func (h *Handler) isAdmin(email string) bool {
+	candidate := strings.ToLower(strings.TrimSpace(email))
+	if candidate == "" {
+		return false
+	}
+	for _, admin := range h.Config.AdminEmails {
+		if candidate == strings.ToLower(strings.TrimSpace(admin)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CollectOrphans runs an orphaned-key collection pass on demand.
+func (h *Handler) CollectOrphans(c *gin.Context) {
+	result, err := h.Chat.CollectOrphans(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "orphan gc failed", "request_id", RequestID(c.Request.Context()), "scanned", result.Scanned, "reclaimed", result.Reclaimed, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "gc failed", "scanned": result.Scanned, "reclaimed": result.Reclaimed})
+		return
+	}
+	slog.InfoContext(c.Request.Context(), "orphan gc pass", "request_id", RequestID(c.Request.Context()), "user", h.userEmail(c), "scanned", result.Scanned, "reclaimed", result.Reclaimed)
+	c.JSON(http.StatusOK, result)
+}
+
+func (h *Handler) ListUsers(c *gin.Context) {
+	cursor, err := strconv.ParseUint(c.DefaultQuery("cursor", "0"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid cursor")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAdminPageLimit)))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid limit")
+		return
+	}
+	page, err := h.Chat.ListUsers(c.Request.Context(), cursor, limit)
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrInvalidPage) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("limit must be between %d and %d", chat.MinPageLimit, chat.MaxPageLimit))
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to list users")
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// CheckAuth reports each OAuth provider's settings and the AuthURL a login
+// would start from, so operators can compare the redirect URL with the one
+// registered in the provider's console. OIDC discovery runs if it has not
+// yet.
+func (h *Handler) CheckAuth(c *gin.Context) {
+	ctx := c.Request.Context()
+	settings := []struct {
+		provider auth.Provider
+		oauth    config.OAuthConfig
+	}{
+		{auth.ProviderGoogle, h.Config.OAuthGoogle},
+		{auth.ProviderGitHub, h.Config.OAuthGitHub},
+		{auth.ProviderGitLab, h.Config.OAuthGitLab.OAuthConfig},
+		{auth.ProviderMicrosoft, h.Config.OAuthMicrosoft.OAuthConfig},
+		{auth.ProviderOIDC, h.Config.OAuthOIDC.OAuthConfig},
+	}
+	checks := make([]providerCheck, 0, len(settings)+2)
+	for _, entry := range settings {
+		check := providerCheck{
+			Provider:        entry.provider,
+			Enabled:         h.Auth.Enabled(entry.provider),
+			ClientIDSet:     entry.oauth.ClientID != "",
+			ClientSecretSet: entry.oauth.ClientSecret != "",
+			RedirectURL:     entry.oauth.RedirectURL,
+		}
+		if check.Enabled {
+			authURL, err := h.Auth.AuthURL(ctx, entry.provider, checkState)
+			if err != nil {
+				check.Error = err.Error()
+			} else {
+				check.AuthURL = authURL
+			}
+		}
+		checks = append(checks, check)
+	}
+	checks = append(checks, providerCheck{Provider: auth.ProviderLocal, Enabled: h.Auth.Enabled(auth.ProviderLocal)})
+	checks = append(checks, providerCheck{
+		Provider:    auth.ProviderMagicLink,
+		Enabled:     h.Auth.Enabled(auth.ProviderMagicLink),
+		RedirectURL: h.Config.MagicLink.CallbackURL,
+	})
+	c.JSON(http.StatusOK, gin.H{"providers": checks})
+}
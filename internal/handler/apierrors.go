@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+// errorCodes names the service errors an /api client may want to tell apart.
+// Handlers record them with c.Error; anything else is coded by its status.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{chat.ErrChatNotFound, "chat_not_found"},
+	{chat.ErrNotAuthorized, "not_authorized"},
+	{chat.ErrEmptyTitle, "empty_title"},
+	{chat.ErrEmptyContent, "empty_content"},
+	{chat.ErrMessageTooLong, "message_too_long"},
+	{chat.ErrSystemPromptTooLong, "system_prompt_too_long"},
+	{chat.ErrInvalidStop, "invalid_stop"},
+	{chat.ErrInvalidRole, "invalid_role"},
+	{chat.ErrInvalidIndex, "invalid_index"},
+	{chat.ErrInvalidPage, "invalid_page"},
+	{chat.ErrInvalidQuery, "invalid_query"},
+	{chat.ErrInvalidPreference, "invalid_preference"},
+	{chat.ErrInvalidConfirmation, "invalid_confirmation"},
+	{chat.ErrInvalidCandidates, "invalid_candidates"},
+	{chat.ErrInvalidShareTTL, "invalid_share_ttl"},
+	{chat.ErrInvalidImage, "invalid_image"},
+	{chat.ErrUnsupportedFormat, "unsupported_format"},
+	{chat.ErrNotUserMessage, "not_user_message"},
+	{chat.ErrNothingToRegenerate, "nothing_to_regenerate"},
+	{chat.ErrNoCandidate, "no_candidate"},
+	{chat.ErrNoStream, "no_stream"},
+	{chat.ErrShareNotFound, "share_not_found"},
+	{chat.ErrImageNotFound, "image_not_found"},
+	{chat.ErrChatFull, "chat_full"},
+	{chat.ErrCompletionInProgress, "completion_in_progress"},
+	{chat.ErrQuotaExceeded, "quota_exceeded"},
+	{chat.ErrJSONModeUnsupported, "json_mode_unsupported"},
+	{chat.ErrVisionUnsupported, "vision_unsupported"},
+	{chat.ErrModelUnavailable, "model_unavailable"},
+	{chat.ErrStoreUnavailable, "store_unavailable"},
+}
+
+// APIErrors gives every /api error response the same JSON shape,
+// {"error": {"code", "message"}}, whether the handler answered with text,
+// JSON or a bare status. Other fields of a JSON answer are kept alongside.
+// Successful responses, and every route outside /api, pass through as is.
+func (h *Handler) APIErrors(c *gin.Context) {
+	if !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		c.Next()
+		return
+	}
+	writer := &apiErrorWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+	c.Writer = writer.ResponseWriter
+	if !writer.held() {
+		return
+	}
+	status := c.Writer.Status()
+	body := gin.H{}
+	message := strings.TrimSpace(writer.body.String())
+	if strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "application/json") {
+		message = ""
+		_ = json.Unmarshal(writer.body.Bytes(), &body)
+		if text, ok := body["error"].(string); ok {
+			message = text
+		}
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	body["error"] = gin.H{"code": errorCode(c, status), "message": message}
+	c.Writer.Header().Del("Content-Type")
+	c.Writer.Header().Del("Content-Length")
+	c.JSON(status, body)
+}
+
+// errorCode names the last typed error the handler recorded, or the status.
+func errorCode(c *gin.Context, status int) string {
+	for i := len(c.Errors) - 1; i >= 0; i-- {
+		for _, known := range errorCodes {
+			if errors.Is(c.Errors[i].Err, known.err) {
+				return known.code
+			}
+		}
+	}
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// apiErrorWriter holds back the body of an error response so APIErrors can
+// rewrite it.
+type apiErrorWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+	// pending is set once the handler has answered with an error.
+	pending bool
+}
+
+func (w *apiErrorWriter) held() bool {
+	return w.ResponseWriter.Status() >= http.StatusBadRequest && !w.ResponseWriter.Written()
+}
+
+func (w *apiErrorWriter) WriteHeaderNow() {
+	if w.held() {
+		w.pending = true
+		return
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *apiErrorWriter) Write(data []byte) (int, error) {
+	if w.held() {
+		w.pending = true
+		return w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *apiErrorWriter) WriteString(s string) (int, error) {
+	if w.held() {
+		w.pending = true
+		return w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *apiErrorWriter) Flush() {
+	if w.held() {
+		return
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *apiErrorWriter) Written() bool {
+	return w.pending || w.ResponseWriter.Written()
+}
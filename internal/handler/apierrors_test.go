@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+func newAPIErrorsRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := &Handler{}
+	router := gin.New()
+	router.Use(h.APIErrors)
+	router.Use(gin.RecoveryWithWriter(io.Discard))
+	router.GET("/api/text", func(c *gin.Context) {
+		_ = c.Error(chat.ErrChatNotFound)
+		c.String(http.StatusNotFound, "chat not found")
+	})
+	router.GET("/api/json", func(c *gin.Context) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "slow down", "retryAfter": 30})
+	})
+	router.GET("/api/bare", func(c *gin.Context) {
+		c.AbortWithStatus(http.StatusForbidden)
+	})
+	router.GET("/api/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+	router.GET("/api/ok", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"id": "abc"})
+	})
+	router.GET("/api/stream", func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		c.Status(http.StatusOK)
+		_, _ = c.Writer.WriteString("data: one\n\n")
+		c.Writer.Flush()
+		_, _ = c.Writer.WriteString("data: two\n\n")
+		c.Writer.Flush()
+	})
+	router.GET("/page", func(c *gin.Context) {
+		c.String(http.StatusNotFound, "no such page")
+	})
+	return router
+}
+
+type errorEnvelope struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	RetryAfter int `json:"retryAfter"`
+}
+
+func TestAPIErrorsEnvelope(t *testing.T) {
+	router := newAPIErrorsRouter()
+	tests := []struct {
+		path       string
+		status     int
+		code       string
+		message    string
+		retryAfter int
+	}{
+		{"/api/text", http.StatusNotFound, "chat_not_found", "chat not found", 0},
+		{"/api/json", http.StatusTooManyRequests, "too_many_requests", "slow down", 30},
+		{"/api/bare", http.StatusForbidden, "forbidden", "Forbidden", 0},
+		{"/api/panic", http.StatusInternalServerError, "internal_server_error", "Internal Server Error", 0},
+		{"/api/missing", http.StatusNotFound, "not_found", "Not Found", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Fatalf("Content-Type = %q, want JSON", ct)
+			}
+			var body errorEnvelope
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not one JSON object: %v", w.Body.String(), err)
+			}
+			if body.Error.Code != tt.code || body.Error.Message != tt.message || body.RetryAfter != tt.retryAfter {
+				t.Errorf("body = %+v, want code %q, message %q, retryAfter %d", body, tt.code, tt.message, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestAPIErrorsPassThrough(t *testing.T) {
+	router := newAPIErrorsRouter()
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/api/ok", http.StatusOK, `{"id":"abc"}`},
+		{"/api/stream", http.StatusOK, "data: one\n\ndata: two\n\n"},
+		{"/page", http.StatusNotFound, "no such page"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.status || w.Body.String() != tt.body {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.status, tt.body)
+			}
+		})
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/stream", nil))
+	if !w.Flushed {
+		t.Error("stream was not flushed through")
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const corsMaxAge = "600"
+
+// CORS lets the origins in CORS_ALLOWED_ORIGINS call /api with the session
+// cookie. It does nothing when the list is empty or the request is
+// same-origin, and rejects any other cross-origin /api request.
+func (h *Handler) CORS(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if len(h.Config.CORSAllowedOrigins) == 0 || origin == "" || !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		c.Next()
+		return
+	}
+	c.Writer.Header().Add("Vary", "Origin")
+	if sameOrigin(origin, c.Request.Host) {
+		c.Next()
+		return
+	}
+	if !h.corsAllowed(origin) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+		return
+	}
+	c.Header("Access-Control-Allow-Origin", origin)
+	c.Header("Access-Control-Allow-Credentials", "true")
+	if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+		c.Header("Access-Control-Allow-Methods", "GET, POST, DELETE")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, If-None-Match, "+csrfHeader+", "+requestIDHeader)
+		c.Header("Access-Control-Max-Age", corsMaxAge)
+		c.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	c.Header("Access-Control-Expose-Headers", "ETag, "+requestIDHeader)
+	c.Next()
+}
+
+func (h *Handler) corsAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range h.Config.CORSAllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func sameOrigin(origin, host string) bool {
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, host)
+}
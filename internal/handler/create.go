@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+// CreateChat starts a chat in one call for API clients: it creates the chat,
+// sends the first message with the user's saved preferences and answers with
+// the reply. If any step fails the new chat is deleted again; old chats are
+// only evicted to make room for it once the reply is in.
+func (h *Handler) CreateChat(c *gin.Context) {
+	var payload struct {
+		Title        string  `json:"title"`
+		SystemPrompt *string `json:"systemPrompt"`
+		Content      string  `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		if !h.bodyTooLarge(c, err) {
+			c.String(http.StatusBadRequest, "invalid request")
+		}
+		return
+	}
+	input := messageInput{Content: trimMessage(payload.Content), Preferences: h.sessionPreferences(c)}
+	if input.Content == "" {
+		_ = c.Error(chat.ErrEmptyContent)
+		c.String(http.StatusBadRequest, "empty message")
+		return
+	}
+	if payload.SystemPrompt != nil && utf8.RuneCountInString(strings.TrimSpace(*payload.SystemPrompt)) > chat.MaxSystemPromptRunes {
+		_ = c.Error(chat.ErrSystemPromptTooLong)
+		c.String(http.StatusBadRequest, fmt.Sprintf("system prompt exceeds %d characters", chat.MaxSystemPromptRunes))
+		return
+	}
+	ctx := c.Request.Context()
+	userEmail := h.userEmail(c)
+	summary, err := h.Chat.NewPendingChat(ctx, userEmail, "New chat")
+	if err != nil {
+		_ = c.Error(err)
+		if !h.storeUnavailable(c, err) {
+			c.String(http.StatusInternalServerError, "failed to create chat")
+		}
+		return
+	}
+	chatID := summary.ID
+	created := false
+	defer func() {
+		if created {
+			return
+		}
+		if err := h.Chat.DeleteChat(context.WithoutCancel(ctx), userEmail, chatID); err != nil {
+			slog.ErrorContext(ctx, "failed to roll back new chat", "request_id", RequestID(ctx), "user", userEmail, "chat", chatID, "error", err)
+		}
+	}()
+	if title := strings.TrimSpace(payload.Title); title != "" {
+		_, err = h.Chat.RenameChat(ctx, userEmail, chatID, title)
+	}
+	if err == nil && payload.SystemPrompt != nil {
+		_, err = h.Chat.SetSystemPrompt(ctx, userEmail, chatID, *payload.SystemPrompt)
+	}
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		if errors.Is(err, chat.ErrEmptyTitle) {
+			c.String(http.StatusBadRequest, "empty title")
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to create chat")
+		return
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	userMessage, ok := h.appendUserMessage(c, userEmail, chatID, input)
+	if !ok {
+		return
+	}
+	assistantMessage, usage, err := h.runCompletion(ctx, userEmail, chatID, input)
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		if status, ok := chatErrorStatus(err); ok {
+			c.String(status, err.Error())
+			return
+		}
+		c.String(http.StatusBadRequest, completionErrorMessage(err))
+		return
+	}
+	created = true
+	evicted, err := h.Chat.EvictOldChats(ctx, userEmail)
+	if err != nil {
+		// The chat is kept regardless; the next new chat evicts again.
+		slog.ErrorContext(ctx, "failed to evict old chats", "request_id", RequestID(ctx), "user", userEmail, "error", err)
+	}
+	if len(evicted) > 0 {
+		slog.InfoContext(ctx, "evicted old chats", "request_id", RequestID(ctx), "user", userEmail, "count", len(evicted), "chats", strings.Join(evicted, ","))
+	}
+	_ = h.setSessionChatID(c, chatID)
+	c.JSON(http.StatusCreated, gin.H{
+		"id":        chatID,
+		"user":      userMessage,
+		"assistant": assistantMessage,
+		"usage":     usage,
+	})
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCSRFToken = "csrf_token"
+	csrfFormField    = "csrf_token"
+	csrfHeader       = "X-CSRF-Token"
+)
+
+// CSRFField renders the hidden form input carrying the session CSRF token.
+func CSRFField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
+
+func (h *Handler) RequireCSRF(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	expected := h.sessionCSRFToken(c)
+	provided := c.GetHeader(csrfHeader)
+	if provided == "" {
+		provided = c.PostForm(csrfFormField)
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(provided)) != 1 {
+		if h.wantsJSON(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "invalid csrf token"})
+		} else {
+			c.String(http.StatusForbidden, "invalid csrf token")
+		}
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// CSRFToken gives API clients that have no page to read the token from,
+// such as a frontend on a CORS_ALLOWED_ORIGINS origin, the value to send in
+// the X-CSRF-Token header.
+func (h *Handler) CSRFToken(c *gin.Context) {
+	token := h.csrfToken(c)
+	if token == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "session unavailable"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+func (h *Handler) sessionCSRFToken(c *gin.Context) string {
+	session := h.session(c)
+	if session == nil {
+		return ""
+	}
+	token, _ := session.Values[sessionCSRFToken].(string)
+	return token
+}
+
+func (h *Handler) csrfToken(c *gin.Context) string {
+	if token := h.sessionCSRFToken(c); token != "" {
+		return token
+	}
+	session := h.session(c)
+	if session == nil {
+		return ""
+	}
+	token := randomState()
+	session.Values[sessionCSRFToken] = token
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		return ""
+	}
+	return token
+}
@@ -1,59 +1,172 @@
 package handler
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 
 	"robertomachorro/smartchat/internal/config"
+	"robertomachorro/smartchat/internal/markdown"
 	"robertomachorro/smartchat/internal/service/auth"
 	"robertomachorro/smartchat/internal/service/chat"
+	"robertomachorro/smartchat/internal/service/openai"
+	"robertomachorro/smartchat/internal/store"
 )
 
 const (
 	sessionUserEmail     = "user_email"
+	sessionUserName      = "user_name"
+	sessionUserAvatar    = "user_avatar"
+	sessionVersion       = "session_version"
 	sessionChatID        = "chat_id"
 	sessionOAuthState    = "oauth_state"
 	sessionOAuthProvider = "oauth_provider"
 	sessionModel         = "model"
 	sessionTemperature   = "temperature"
+	sessionMaxTokens     = "max_tokens"
+	sessionTopP          = "top_p"
+	sessionPresence      = "presence_penalty"
+	sessionFrequency     = "frequency_penalty"
+	sessionSeed          = "seed"
+	sessionTimezone      = "timezone"
+	sessionExtendedAt    = "extended_at"
+
+	defaultTemperature    = 0.5
+	initialMessageCount   = 50
+	sessionExtendInterval = time.Hour
 )
 
 type Handler struct {
 	Config   config.Config
-	Sessions *sessions.CookieStore
+	Sessions sessions.Store
 	Auth     *auth.Service
 	Chat     *chat.Service
+	Store    *store.RedisStore
 	Now      func() time.Time
 }
 
-func NewHandler(cfg config.Config, store *sessions.CookieStore, authSvc *auth.Service, chatSvc *chat.Service) *Handler {
-	return &Handler{Config: cfg, Sessions: store, Auth: authSvc, Chat: chatSvc, Now: time.Now}
+func NewHandler(cfg config.Config, sessionStore sessions.Store, authSvc *auth.Service, chatSvc *chat.Service, redisStore *store.RedisStore) *Handler {
+	// A Redis session store indexes sessions by user so "log out
+	// everywhere" can delete them.
+	if redisSessions, ok := sessionStore.(*store.SessionStore); ok {
+		redisSessions.UserKey = sessionUserEmail
+	}
+	return &Handler{Config: cfg, Sessions: sessionStore, Auth: authSvc, Chat: chatSvc, Store: redisStore, Now: time.Now}
 }
 
 func (h *Handler) RegisterRoutes(router *gin.Engine) {
+	router.GET("/healthz", h.Healthz)
+	router.GET("/readyz", h.Readyz)
 	router.GET("/login", h.ShowLogin)
-	router.GET("/auth/google", h.StartOAuth(auth.ProviderGoogle))
-	router.GET("/auth/google/callback", h.HandleOAuthCallback(auth.ProviderGoogle))
-	router.GET("/auth/github", h.StartOAuth(auth.ProviderGitHub))
-	router.GET("/auth/github/callback", h.HandleOAuthCallback(auth.ProviderGitHub))
+	if h.Auth.Enabled(auth.ProviderGoogle) {
+		router.GET("/auth/google", h.StartOAuth(auth.ProviderGoogle))
+		router.GET("/auth/google/callback", h.HandleOAuthCallback(auth.ProviderGoogle))
+	}
+	if h.Auth.Enabled(auth.ProviderGitHub) {
+		router.GET("/auth/github", h.StartOAuth(auth.ProviderGitHub))
+		router.GET("/auth/github/callback", h.HandleOAuthCallback(auth.ProviderGitHub))
+	}
+	if h.Auth.Enabled(auth.ProviderGitLab) {
+		router.GET("/auth/gitlab", h.StartOAuth(auth.ProviderGitLab))
+		router.GET("/auth/gitlab/callback", h.HandleOAuthCallback(auth.ProviderGitLab))
+	}
+	if h.Auth.Enabled(auth.ProviderMicrosoft) {
+		router.GET("/auth/microsoft", h.StartOAuth(auth.ProviderMicrosoft))
+		router.GET("/auth/microsoft/callback", h.HandleOAuthCallback(auth.ProviderMicrosoft))
+	}
+	if h.Auth.Enabled(auth.ProviderOIDC) {
+		router.GET("/auth/oidc", h.StartOAuth(auth.ProviderOIDC))
+		router.GET("/auth/oidc/callback", h.HandleOAuthCallback(auth.ProviderOIDC))
+	}
+	if h.Auth.Enabled(auth.ProviderLocal) {
+		router.POST("/login/local", h.RequireCSRF, h.LocalLogin)
+	}
+	if h.Auth.Enabled(auth.ProviderMagicLink) {
+		router.POST("/login/magic", h.RequireCSRF, h.RequestMagicLink)
+		router.GET("/login/magic/callback", h.ShowMagicLink)
+		router.POST("/login/magic/callback", h.RequireCSRF, h.MagicLinkCallback)
+	}
 	router.GET("/logout", h.Logout)
+	router.GET("/share/:token", h.ShowShared)
+	router.GET("/share/:token/images/:imageId", h.SharedImage)
 
 	authed := router.Group("/")
-	authed.Use(h.RequireAuth)
+	authed.Use(h.RequireAuth, h.RequireCSRF)
 	authed.GET("/", h.ShowChat)
 	authed.GET("/chat/:id", h.ShowChat)
+	authed.POST("/logout/all", h.LogoutAll)
+	authed.POST("/api/logout/all", h.LogoutAll)
 	authed.POST("/chat/new", h.NewChat)
+	authed.POST("/api/chat/new", h.NewChat)
 	authed.POST("/chat/:id/delete", h.DeleteChat)
-	authed.POST("/chat/:id/message", h.PostMessage)
-	authed.POST("/api/chat/:id/message", h.PostMessage)
+	authed.DELETE("/chat/:id", h.DeleteChat)
+	authed.GET("/api/chat/:id", h.GetChatSummary)
+	authed.DELETE("/api/chat/:id", h.DeleteChat)
+	authed.GET("/api/chats", h.ListChats)
+	authed.POST("/api/chats", h.RateLimit, h.EnforceQuota, h.CreateChat)
+	authed.GET("/api/chat/search", h.SearchChats)
+	authed.POST("/api/chat/:id/pin", h.PinChat)
+	authed.POST("/api/chat/:id/archive", h.ArchiveChat)
+	authed.POST("/chat/:id/fork", h.ForkChat)
+	authed.POST("/chat/:id/clear", h.ClearChat)
+	authed.POST("/api/chat/:id/clear", h.ClearChat)
+	authed.POST("/api/chat/:id/fork", h.ForkChat)
+	authed.POST("/api/chat/:id/rename", h.RenameChat)
+	authed.GET("/api/chat/:id/messages", h.ListMessages)
+	authed.GET("/api/chat/:id/usage", h.GetUsage)
+	authed.POST("/api/chat/:id/estimate", h.EstimateTokens)
+	authed.GET("/api/chat/:id/export", h.ExportChat)
+	authed.GET("/api/chat/:id/images/:imageId", h.GetImage)
+	authed.POST("/api/chat/:id/share", h.CreateShareLink)
+	authed.DELETE("/api/share/:token", h.RevokeShareLink)
+	authed.POST("/chat/:id/system", h.SetSystemPrompt)
+	authed.POST("/api/chat/:id/system", h.SetSystemPrompt)
+	authed.GET("/api/models", h.ListModels)
+	authed.GET("/api/stats", h.GetStats)
+	authed.GET("/api/account/delete-chats", h.DeleteChatsConfirmation)
+	authed.POST("/api/account/delete-chats", h.DeleteAllChats)
+	authed.GET("/api/csrf", h.CSRFToken)
+	authed.GET("/api/preferences", h.GetPreferences)
+	authed.POST("/api/preferences", h.UpdatePreferences)
+	authed.POST("/chat/:id/message", h.RateLimit, h.EnforceQuota, h.PostMessage)
+	authed.POST("/api/chat/:id/message", h.RateLimit, h.EnforceQuota, h.PostMessage)
+	authed.POST("/api/chat/:id/stream", h.RateLimit, h.EnforceQuota, h.StreamMessage)
+	authed.GET("/api/chat/:id/stream/resume", h.ResumeStream)
+	authed.GET("/api/chat/:id/status", h.GetStatus)
+	authed.GET("/ws/chat/:id", h.ChatSocket)
+	authed.POST("/api/chat/:id/regenerate", h.RateLimit, h.EnforceQuota, h.Regenerate)
+	authed.POST("/api/chat/:id/candidates/:index", h.ChooseCandidate)
+	authed.POST("/api/chat/:id/message/:index/edit", h.RateLimit, h.EditMessage)
+	authed.GET("/api/chat/:id/message/:index", h.GetMessage)
+	authed.DELETE("/api/chat/:id/message/:index", h.DeleteMessage)
+	authed.POST("/api/chat/:id/append", h.AppendMessage)
+
+	admin := router.Group("/admin")
+	admin.Use(h.RequireAuth, h.RequireCSRF, h.RequireAdmin)
+	admin.GET("/users", h.ListUsers)
+	admin.POST("/gc", h.CollectOrphans)
+	admin.GET("/auth/check", h.CheckAuth)
+	if h.Auth.Enabled(auth.ProviderLocal) {
+		admin.POST("/users", h.CreateLocalUser)
+		admin.POST("/users/:email/password", h.SetLocalPassword)
+		admin.DELETE("/users/:email", h.DeleteLocalUser)
+	}
 }
 
 func (h *Handler) RequireAuth(c *gin.Context) {
@@ -68,7 +181,25 @@ func (h *Handler) RequireAuth(c *gin.Context) {
 		c.Abort()
 		return
 	}
-	if !h.isAllowedUser(h.userEmail(c)) {
+	stored, err := h.Store.SessionVersion(c.Request.Context(), h.userEmail(c))
+	if err != nil {
+		c.Header("Retry-After", strconv.Itoa(storeRetryAfter))
+		c.String(http.StatusServiceUnavailable, "session check failed")
+		c.Abort()
+		return
+	}
+	if version, _ := session.Values[sessionVersion].(int64); version != stored {
+		session.Options.MaxAge = -1
+		_ = session.Save(c.Request, c.Writer)
+		if h.wantsJSON(c) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "session revoked"})
+		} else {
+			c.Redirect(http.StatusFound, "/login")
+		}
+		c.Abort()
+		return
+	}
+	if !h.isAllowedUser(h.userEmail(c)) || !h.isAllowedDomain(h.userEmail(c)) {
 		c.HTML(http.StatusForbidden, "denied.html", gin.H{
 			"InstanceName": h.Config.InstanceName,
 			"UserEmail":    h.userEmail(c),
@@ -76,13 +207,57 @@ func (h *Handler) RequireAuth(c *gin.Context) {
 		c.Abort()
 		return
 	}
+	h.extendSession(c, session)
 	c.Next()
 }
 
+// extendSession re-saves an active session so its cookie expiry restarts.
+// It runs only after the session version check, so a revoked session is
+// never revived, and at most once per sessionExtendInterval to avoid
+// rewriting the cookie on every request.
+func (h *Handler) extendSession(c *gin.Context, session *sessions.Session) {
+	if !h.Config.Cookie.Sliding {
+		return
+	}
+	now := h.Now()
+	if extended, _ := session.Values[sessionExtendedAt].(int64); now.Sub(time.Unix(extended, 0)) < sessionExtendInterval {
+		return
+	}
+	session.Values[sessionExtendedAt] = now.Unix()
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		slog.WarnContext(c.Request.Context(), "extend session", "error", err)
+	}
+}
+
 func (h *Handler) ShowLogin(c *gin.Context) {
-	c.HTML(http.StatusOK, "login.html", gin.H{
-		"InstanceName": h.Config.InstanceName,
-	})
+	data := h.loginData(c, "", "")
+	if c.Query("sent") == "1" && h.Auth.Enabled(auth.ProviderMagicLink) {
+		data["Notice"] = "If that address can sign in, a link is on its way. Check your email."
+	}
+	c.HTML(http.StatusOK, "login.html", data)
+}
+
+func (h *Handler) renderLogin(c *gin.Context, status int, email, loginError string) {
+	c.HTML(status, "login.html", h.loginData(c, email, loginError))
+}
+
+func (h *Handler) loginData(c *gin.Context, email, loginError string) gin.H {
+	data := gin.H{
+		"InstanceName":     h.Config.InstanceName,
+		"GoogleEnabled":    h.Auth.Enabled(auth.ProviderGoogle),
+		"GitHubEnabled":    h.Auth.Enabled(auth.ProviderGitHub),
+		"GitLabEnabled":    h.Auth.Enabled(auth.ProviderGitLab),
+		"MicrosoftEnabled": h.Auth.Enabled(auth.ProviderMicrosoft),
+		"OIDCEnabled":      h.Auth.Enabled(auth.ProviderOIDC),
+		"LocalEnabled":     h.Auth.Enabled(auth.ProviderLocal),
+		"MagicLinkEnabled": h.Auth.Enabled(auth.ProviderMagicLink),
+		"Email":            email,
+		"Error":            loginError,
+	}
+	if h.Auth.Enabled(auth.ProviderLocal) || h.Auth.Enabled(auth.ProviderMagicLink) {
+		data["CSRFToken"] = h.csrfToken(c)
+	}
+	return data
 }
 
 func (h *Handler) StartOAuth(provider auth.Provider) gin.HandlerFunc {
@@ -99,7 +274,7 @@ func (h *Handler) StartOAuth(provider auth.Provider) gin.HandlerFunc {
 			c.String(http.StatusInternalServerError, "session save failed")
 			return
 		}
-		url, err := h.Auth.AuthURL(provider, state)
+		url, err := h.Auth.AuthURL(c.Request.Context(), provider, state)
 		if err != nil {
 			c.String(http.StatusInternalServerError, "oauth config failed")
 			return
@@ -132,11 +307,21 @@ func (h *Handler) HandleOAuthCallback(provider auth.Provider) gin.HandlerFunc {
 			c.String(http.StatusBadRequest, "oauth exchange failed")
 			return
 		}
-		email, err := h.Auth.FetchEmail(c.Request.Context(), provider, token)
+		profile, err := h.Auth.FetchProfile(c.Request.Context(), provider, token)
 		if err != nil {
 			c.String(http.StatusBadRequest, "failed to fetch email")
 			return
 		}
+		email := profile.Email
+		if !h.isAllowedDomain(email) {
+			slog.WarnContext(c.Request.Context(), "login rejected: email domain not allowed", "request_id", RequestID(c.Request.Context()), "provider", provider, "user", email)
+			c.HTML(http.StatusForbidden, "denied.html", gin.H{
+				"InstanceName": h.Config.InstanceName,
+				"UserEmail":    email,
+				"Reason":       "Sign-in is limited to accounts from approved email domains.",
+			})
+			return
+		}
 		if !h.isAllowedUser(email) {
 			session.Values[sessionUserEmail] = ""
 			session.Values[sessionOAuthState] = ""
@@ -148,23 +333,43 @@ func (h *Handler) HandleOAuthCallback(provider auth.Provider) gin.HandlerFunc {
 			})
 			return
 		}
-		session.Values[sessionUserEmail] = email
-		session.Values[sessionOAuthState] = ""
-		session.Values[sessionOAuthProvider] = ""
-		if session.Values[sessionTemperature] == nil {
-			session.Values[sessionTemperature] = 0.5
+		if err := h.Auth.SaveToken(c.Request.Context(), email, provider, token); err != nil {
+			slog.ErrorContext(c.Request.Context(), "failed to store oauth token", "request_id", RequestID(c.Request.Context()), "provider", provider, "user", email, "error", err)
 		}
-		if session.Values[sessionModel] == nil && len(h.Config.OpenAI.Models) > 0 {
-			session.Values[sessionModel] = h.Config.OpenAI.Models[0]
-		}
-		if err := session.Save(c.Request, c.Writer); err != nil {
-			c.String(http.StatusInternalServerError, "session save failed")
+		if !h.startSession(c, session, profile) {
 			return
 		}
 		c.Redirect(http.StatusFound, "/")
 	}
 }
 
+// startSession signs the user into session once a provider has vouched for
+// them, writing the error response itself when that fails.
+func (h *Handler) startSession(c *gin.Context, session *sessions.Session, profile auth.Profile) bool {
+	version, err := h.Store.SessionVersion(c.Request.Context(), profile.Email)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "session setup failed")
+		return false
+	}
+	// A fresh id keeps a server-side session id planted before sign-in
+	// from carrying over; cookie sessions have no id and ignore it.
+	session.ID = ""
+	session.Values[sessionVersion] = version
+	session.Values[sessionExtendedAt] = h.Now().Unix()
+	session.Values[sessionUserEmail] = profile.Email
+	session.Values[sessionUserName] = profile.Name
+	session.Values[sessionUserAvatar] = profile.AvatarURL
+	session.Values[sessionOAuthState] = ""
+	session.Values[sessionOAuthProvider] = ""
+	session.Values[sessionCSRFToken] = randomState()
+	h.seedPreferences(c, session, profile.Email)
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		c.String(http.StatusInternalServerError, "session save failed")
+		return false
+	}
+	return true
+}
+
 func (h *Handler) Logout(c *gin.Context) {
 	session := h.session(c)
 	if session != nil {
@@ -174,6 +379,39 @@ func (h *Handler) Logout(c *gin.Context) {
 	c.Redirect(http.StatusFound, "/login")
 }
 
+// LogoutAll revokes every session the user holds, including this one, by
+// bumping the stored session version; server-side sessions are deleted too.
+func (h *Handler) LogoutAll(c *gin.Context) {
+	if err := h.revokeUserSessions(c.Request.Context(), h.userEmail(c)); err != nil {
+		c.String(http.StatusInternalServerError, "failed to sign out sessions")
+		return
+	}
+	if session := h.session(c); session != nil {
+		session.Options.MaxAge = -1
+		_ = session.Save(c.Request, c.Writer)
+	}
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	c.Redirect(http.StatusFound, "/login")
+}
+
+// sessionRevoker is a session store that can delete a user's sessions.
+type sessionRevoker interface {
+	RevokeUser(ctx context.Context, email string) error
+}
+
+func (h *Handler) revokeUserSessions(ctx context.Context, email string) error {
+	if _, err := h.Store.BumpSessionVersion(ctx, email); err != nil {
+		return err
+	}
+	if revoker, ok := h.Sessions.(sessionRevoker); ok {
+		return revoker.RevokeUser(ctx, email)
+	}
+	return nil
+}
+
 func (h *Handler) ShowChat(c *gin.Context) {
 	userEmail := h.userEmail(c)
 	chatID := c.Param("id")
@@ -184,6 +422,10 @@ func (h *Handler) ShowChat(c *gin.Context) {
 	if chatID == "" {
 		summary, err := h.Chat.EnsureChat(c.Request.Context(), userEmail)
 		if err != nil {
+			_ = c.Error(err)
+			if h.storeUnavailable(c, err) {
+				return
+			}
 			c.String(http.StatusInternalServerError, "chat setup failed")
 			return
 		}
@@ -193,39 +435,147 @@ func (h *Handler) ShowChat(c *gin.Context) {
 	if c.Param("id") != "" {
 		_ = h.setSessionChatID(c, chatID)
 	}
-	view, err := h.Chat.GetChat(c.Request.Context(), userEmail, chatID)
+	latest := initialMessageCount
+	if c.Query("history") == "all" {
+		latest = 0
+	}
+	view, err := h.Chat.GetChat(c.Request.Context(), userEmail, chatID, latest)
 	if err != nil {
-		c.String(http.StatusBadRequest, "chat not found")
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		if status, ok := chatErrorStatus(err); ok {
+			c.String(status, err.Error())
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to load chat")
 		return
 	}
-	chats, err := h.Chat.ListChats(c.Request.Context(), userEmail)
+	showArchived := c.Query("archived") == "1"
+	chats, err := h.Chat.ListChats(c.Request.Context(), userEmail, showArchived, 0, chat.DefaultChatPageLimit)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "failed to load chats")
 		return
 	}
-	model, temperature := h.sessionPreferences(c)
+	usage, err := h.Chat.GetUsage(c.Request.Context(), userEmail, chatID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to load usage")
+		return
+	}
+	prefs := h.sessionPreferences(c)
 	c.HTML(http.StatusOK, "chat.html", gin.H{
-		"InstanceName": h.Config.InstanceName,
-		"UserEmail":    userEmail,
-		"Chat":         view,
-		"Chats":        chats,
-		"Models":       h.Config.OpenAI.Models,
-		"Model":        model,
-		"Temperature":  temperature,
+		"Location":       userLocation(prefs.Timezone),
+		"InstanceName":   h.Config.InstanceName,
+		"UserEmail":      userEmail,
+		"UserName":       h.sessionString(c, sessionUserName),
+		"UserAvatar":     h.sessionString(c, sessionUserAvatar),
+		"Chat":           view,
+		"Chats":          chats,
+		"ShowArchived":   showArchived,
+		"VisionEnabled":  len(h.Chat.VisionModels) > 0,
+		"Models":         h.modelChoices(c.Request.Context(), userEmail),
+		"Unavailable":    h.Chat.UnavailableModels(),
+		"Model":          prefs.Model,
+		"Temperature":    prefs.Temperature,
+		"TemperatureMin": h.Config.OpenAI.TemperatureMin,
+		"TemperatureMax": h.Config.OpenAI.TemperatureMax,
+		"Usage":          usage,
+		"CSRFToken":      h.csrfToken(c),
 	})
 }
 
 func (h *Handler) NewChat(c *gin.Context) {
 	userEmail := h.userEmail(c)
-	summary, err := h.Chat.NewChat(c.Request.Context(), userEmail, "New chat")
+	summary, evicted, err := h.Chat.NewChat(c.Request.Context(), userEmail, "New chat")
 	if err != nil {
 		c.String(http.StatusInternalServerError, "failed to create chat")
 		return
 	}
+	if len(evicted) > 0 {
+		slog.InfoContext(c.Request.Context(), "evicted old chats", "request_id", RequestID(c.Request.Context()), "user", userEmail, "count", len(evicted), "chats", strings.Join(evicted, ","))
+	}
+	_ = h.setSessionChatID(c, summary.ID)
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusCreated, summary)
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/chat/%s", summary.ID))
+}
+
+func (h *Handler) ForkChat(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	upto := -1
+	if value := c.DefaultQuery("upto", c.PostForm("upto")); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			c.String(http.StatusBadRequest, "invalid upto")
+			return
+		}
+		upto = parsed
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	summary, evicted, err := h.Chat.ForkChat(c.Request.Context(), userEmail, chatID, upto)
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		case errors.Is(err, chat.ErrInvalidIndex):
+			c.String(http.StatusBadRequest, "message index out of range")
+		default:
+			c.String(http.StatusInternalServerError, "failed to fork chat")
+		}
+		return
+	}
+	if len(evicted) > 0 {
+		slog.InfoContext(c.Request.Context(), "evicted old chats", "request_id", RequestID(c.Request.Context()), "user", userEmail, "count", len(evicted), "chats", strings.Join(evicted, ","))
+	}
 	_ = h.setSessionChatID(c, summary.ID)
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusCreated, summary)
+		return
+	}
 	c.Redirect(http.StatusFound, fmt.Sprintf("/chat/%s", summary.ID))
 }
 
+func (h *Handler) ClearChat(c *gin.Context) {
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	summary, err := h.Chat.ClearMessages(c.Request.Context(), h.userEmail(c), chatID)
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			c.String(http.StatusNotFound, "chat not found")
+			return
+		}
+		c.String(http.StatusInternalServerError, "clear failed")
+		return
+	}
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusOK, summary)
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/chat/%s", chatID))
+}
+
 func (h *Handler) DeleteChat(c *gin.Context) {
 	userEmail := h.userEmail(c)
 	chatID := c.Param("id")
@@ -234,202 +584,1166 @@ func (h *Handler) DeleteChat(c *gin.Context) {
 		return
 	}
 	if err := h.Chat.DeleteChat(c.Request.Context(), userEmail, chatID); err != nil {
-		c.String(http.StatusBadRequest, "delete failed")
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			c.String(http.StatusNotFound, "chat not found")
+			return
+		}
+		c.String(http.StatusInternalServerError, "delete failed")
 		return
 	}
 	if currentChatID, ok := h.getSessionChatID(c); ok && currentChatID == chatID {
 		_ = h.setSessionChatID(c, "")
 	}
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{"deleted": true})
+		return
+	}
+	if c.Request.Method == http.MethodDelete {
+		c.Status(http.StatusNoContent)
+		return
+	}
 	c.Redirect(http.StatusFound, "/")
 }
 
-func (h *Handler) PostMessage(c *gin.Context) {
+func (h *Handler) RenameChat(c *gin.Context) {
 	userEmail := h.userEmail(c)
 	chatID := c.Param("id")
 	if chatID == "" {
 		c.String(http.StatusBadRequest, "missing chat")
 		return
 	}
-	content := strings.TrimSpace(c.PostForm("content"))
-	model := strings.TrimSpace(c.PostForm("model"))
-	tempValue := strings.TrimSpace(c.PostForm("temperature"))
-	if content == "" {
-		var payload struct {
-			Content     string `json:"content"`
-			Model       string `json:"model"`
-			Temperature string `json:"temperature"`
-		}
-		if err := c.ShouldBindJSON(&payload); err != nil {
-			c.String(http.StatusBadRequest, "missing message")
-			return
-		}
-		content = strings.TrimSpace(payload.Content)
-		model = strings.TrimSpace(payload.Model)
-		tempValue = strings.TrimSpace(payload.Temperature)
+	var payload struct {
+		Title string `json:"title"`
 	}
-	if content == "" {
-		c.String(http.StatusBadRequest, "empty message")
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.String(http.StatusBadRequest, "missing title")
 		return
 	}
-	temperature := parseTemperature(tempValue)
-	if err := h.updateSessionPreferences(c, model, temperature); err != nil {
-		c.String(http.StatusInternalServerError, "session unavailable")
+	summary, err := h.Chat.RenameChat(c.Request.Context(), userEmail, chatID, payload.Title)
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrEmptyTitle):
+			c.String(http.StatusBadRequest, "empty title")
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		default:
+			c.String(http.StatusInternalServerError, "rename failed")
+		}
 		return
 	}
-	userMessage, err := h.Chat.AppendMessage(c.Request.Context(), userEmail, chatID, "user", content)
+	c.JSON(http.StatusOK, summary)
+}
+
+func (h *Handler) ListChats(c *gin.Context) {
+	includeArchived, _ := strconv.ParseBool(c.DefaultQuery("includeArchived", "false"))
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, "failed to save message")
+		c.String(http.StatusBadRequest, "invalid offset")
 		return
 	}
-	model, temperature = h.sessionPreferences(c)
-	assistantMessage, usage, err := h.Chat.RunCompletion(c.Request.Context(), userEmail, chatID, model, temperature)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(chat.DefaultChatPageLimit)))
 	if err != nil {
-		c.String(http.StatusBadRequest, "openai error")
+		c.String(http.StatusBadRequest, "invalid limit")
 		return
 	}
-	if acceptsJSON(c.Request.Header) || strings.HasPrefix(c.FullPath(), "/api/") {
-		c.JSON(http.StatusOK, gin.H{
-			"user":      userMessage,
-			"assistant": assistantMessage,
-			"usage":     usage,
-		})
+	page, err := h.Chat.ListChats(c.Request.Context(), h.userEmail(c), includeArchived, offset, limit)
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		if errors.Is(err, chat.ErrInvalidPage) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("offset must be >= 0 and limit between %d and %d", chat.MinPageLimit, chat.MaxPageLimit))
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to load chats")
 		return
 	}
-	c.Redirect(http.StatusFound, fmt.Sprintf("/chat/%s", chatID))
+	c.JSON(http.StatusOK, page)
 }
 
-func (h *Handler) session(c *gin.Context) *sessions.Session {
-	name := sessionName(h.Config.InstanceName)
-	session, err := h.Sessions.Get(c.Request, name)
-	if err != nil {
-		return nil
+func (h *Handler) PinChat(c *gin.Context) {
+	var payload struct {
+		Pinned *bool `json:"pinned"`
 	}
-	return session
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Pinned == nil {
+		c.String(http.StatusBadRequest, "missing pinned")
+		return
+	}
+	summary, err := h.Chat.SetPinned(c.Request.Context(), h.userEmail(c), c.Param("id"), *payload.Pinned)
+	h.respondListing(c, summary, err)
 }
 
-func (h *Handler) userEmail(c *gin.Context) string {
-	session := h.session(c)
-	if session == nil {
-		return ""
+func (h *Handler) ArchiveChat(c *gin.Context) {
+	var payload struct {
+		Archived *bool `json:"archived"`
 	}
-	if value, ok := session.Values[sessionUserEmail].(string); ok {
-		return value
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Archived == nil {
+		c.String(http.StatusBadRequest, "missing archived")
+		return
 	}
-	return ""
+	summary, err := h.Chat.SetArchived(c.Request.Context(), h.userEmail(c), c.Param("id"), *payload.Archived)
+	h.respondListing(c, summary, err)
 }
 
-func (h *Handler) getSessionChatID(c *gin.Context) (string, bool) {
-	session := h.session(c)
-	if session == nil {
-		return "", false
+func (h *Handler) respondListing(c *gin.Context, summary chat.ChatSummary, err error) {
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			c.String(http.StatusNotFound, "chat not found")
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to update chat")
+		return
 	}
-	value, ok := session.Values[sessionChatID].(string)
-	return value, ok
+	c.JSON(http.StatusOK, summary)
 }
 
-func (h *Handler) setSessionChatID(c *gin.Context, chatID string) error {
-	session := h.session(c)
-	if session == nil {
-		return fmt.Errorf("session unavailable")
+func (h *Handler) SearchChats(c *gin.Context) {
+	results, err := h.Chat.SearchChats(c.Request.Context(), h.userEmail(c), c.Query("q"))
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrInvalidQuery) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("q must be between 1 and %d characters", chat.MaxSearchQueryRunes))
+			return
+		}
+		c.String(http.StatusInternalServerError, "search failed")
+		return
 	}
-	session.Values[sessionChatID] = chatID
-	return session.Save(c.Request, c.Writer)
+	c.JSON(http.StatusOK, gin.H{"query": strings.TrimSpace(c.Query("q")), "results": results})
 }
 
-func (h *Handler) sessionPreferences(c *gin.Context) (string, float64) {
-	model := ""
-	temperature := 0.5
-	session := h.session(c)
-	if session == nil {
-		return model, temperature
+func (h *Handler) ListMessages(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid offset")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(initialMessageCount)))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid limit")
+		return
 	}
-	if value, ok := session.Values[sessionModel].(string); ok {
-		model = value
+	version, err := h.Chat.MessagesVersion(c.Request.Context(), userEmail, chatID)
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		if errors.Is(err, chat.ErrChatNotFound) {
+			c.String(http.StatusNotFound, "chat not found")
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to load messages")
+		return
+	}
+	etag := fmt.Sprintf(`"%s-%d-%d"`, version, offset, limit)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Header("ETag", etag)
+		c.Status(http.StatusNotModified)
+		return
 	}
-	if value, ok := session.Values[sessionTemperature].(float64); ok {
-		temperature = value
-	} else if value, ok := session.Values[sessionTemperature].(string); ok {
-		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
-			temperature = parsed
+	page, err := h.Chat.GetMessagesPage(c.Request.Context(), userEmail, chatID, offset, limit)
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
 		}
+		switch {
+		case errors.Is(err, chat.ErrInvalidPage):
+			c.String(http.StatusBadRequest, fmt.Sprintf("offset must be >= 0 and limit between %d and %d", chat.MinPageLimit, chat.MaxPageLimit))
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		default:
+			c.String(http.StatusInternalServerError, "failed to load messages")
+		}
+		return
 	}
-	return h.ensureModel(model), clampTemperature(temperature)
-}
-
-func acceptsJSON(header http.Header) bool {
-	accept := header.Get("Accept")
-	return strings.Contains(accept, "application/json")
+	rendered := make([]renderedMessage, 0, len(page.Messages))
+	for _, message := range page.Messages {
+		rendered = append(rendered, renderMessage(message))
+	}
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	c.JSON(http.StatusOK, struct {
+		chat.MessagePage
+		Messages []renderedMessage `json:"messages"`
+	}{page, rendered})
 }
 
-func clampTemperature(value float64) float64 {
-	if value < 0.1 {
-		return 0.1
-	}
-	if value > 1.0 {
-		return 1.0
+// etagMatches applies the weak comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
 	}
-	return value
+	return false
 }
 
-func parseTemperature(value string) float64 {
-	if value == "" {
-		return 0.5
-	}
-	temperature, err := strconv.ParseFloat(value, 64)
+func (h *Handler) GetChatSummary(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	summary, err := h.Chat.GetSummary(c.Request.Context(), userEmail, chatID)
 	if err != nil {
-		return 0.5
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		if errors.Is(err, chat.ErrChatNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "chat not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load chat"})
+		return
 	}
-	return clampTemperature(temperature)
-}
-
-func sessionName(instance string) string {
-	clean := strings.TrimSpace(strings.ToLower(instance))
-	if clean == "" {
-		return "session"
+	report, err := h.Chat.GetUsage(c.Request.Context(), userEmail, chatID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load usage"})
+		return
 	}
-	clean = strings.ReplaceAll(clean, " ", "-")
-	return fmt.Sprintf("%s-session", clean)
+	c.JSON(http.StatusOK, struct {
+		chat.ChatSummary
+		Usage chat.UsageTotals `json:"usage"`
+	}{summary, report.Chat})
 }
 
-func randomState() string {
-	nonce := make([]byte, 32)
-	if _, err := rand.Read(nonce); err != nil {
-		return fmt.Sprintf("%d", time.Now().UTC().UnixNano())
+func (h *Handler) GetStats(c *gin.Context) {
+	report, err := h.Chat.UserStats(c.Request.Context(), h.userEmail(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load stats"})
+		return
 	}
-	return base64.RawURLEncoding.EncodeToString(nonce)
+	c.JSON(http.StatusOK, report)
 }
 
-func (h *Handler) ensureModel(model string) string {
-	if model == "" {
-		if len(h.Config.OpenAI.Models) > 0 {
-			return h.Config.OpenAI.Models[0]
-		}
-		return ""
+func (h *Handler) GetUsage(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
 	}
-	for _, allowed := range h.Config.OpenAI.Models {
-		if model == allowed {
-			return model
+	report, err := h.Chat.GetUsage(c.Request.Context(), userEmail, chatID)
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			c.String(http.StatusNotFound, "chat not found")
+			return
 		}
+		c.String(http.StatusInternalServerError, "failed to load usage")
+		return
 	}
-	if len(h.Config.OpenAI.Models) > 0 {
-		return h.Config.OpenAI.Models[0]
+	if h.isAdmin(userEmail) {
+		report.Quota = nil
 	}
-	return model
+	c.JSON(http.StatusOK, report)
 }
 
-func (h *Handler) updateSessionPreferences(c *gin.Context, model string, temperature float64) error {
-	session := h.session(c)
-	if session == nil {
-		return fmt.Errorf("session unavailable")
+func (h *Handler) EstimateTokens(c *gin.Context) {
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
 	}
-	model = h.ensureModel(model)
+	var payload struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		if !h.bodyTooLarge(c, err) {
+			c.String(http.StatusBadRequest, "invalid request")
+		}
+		return
+	}
+	estimate, err := h.Chat.EstimateTokens(c.Request.Context(), h.userEmail(c), chatID, trimMessage(payload.Content), h.sessionPreferences(c))
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		status, known := chatErrorStatus(err)
+		switch {
+		case known:
+			c.String(status, err.Error())
+		case errors.Is(err, chat.ErrMessageTooLong):
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+		case errors.Is(err, chat.ErrJSONModeUnsupported):
+			c.String(http.StatusBadRequest, completionErrorMessage(err))
+		default:
+			c.String(http.StatusInternalServerError, "estimate failed")
+		}
+		return
+	}
+	c.JSON(http.StatusOK, estimate)
+}
+
+func (h *Handler) ExportChat(c *gin.Context) {
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	export, err := h.Chat.ExportChat(c.Request.Context(), h.userEmail(c), chatID, c.DefaultQuery("format", chat.ExportJSON))
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrUnsupportedFormat):
+			c.String(http.StatusBadRequest, "format must be json or md")
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		default:
+			c.String(http.StatusInternalServerError, "export failed")
+		}
+		return
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": export.Filename}))
+	c.Data(http.StatusOK, export.ContentType, export.Data)
+}
+
+func (h *Handler) SetSystemPrompt(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	var prompt *string
+	var stop *[]string
+	var jsonMode *bool
+	if value, hasForm := c.GetPostForm("systemPrompt"); hasForm {
+		prompt = &value
+		enabled := c.PostForm("jsonMode") == "on"
+		jsonMode = &enabled
+	} else {
+		var payload struct {
+			SystemPrompt *string   `json:"systemPrompt"`
+			Stop         *[]string `json:"stop"`
+			JSONMode     *bool     `json:"jsonMode"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil || (payload.SystemPrompt == nil && payload.Stop == nil && payload.JSONMode == nil) {
+			c.String(http.StatusBadRequest, "missing system prompt")
+			return
+		}
+		prompt, stop, jsonMode = payload.SystemPrompt, payload.Stop, payload.JSONMode
+	}
+	var summary chat.ChatSummary
+	var err error
+	if jsonMode != nil {
+		summary, err = h.Chat.SetJSONMode(c.Request.Context(), userEmail, chatID, *jsonMode)
+	}
+	if err == nil && stop != nil {
+		summary, err = h.Chat.SetStopSequences(c.Request.Context(), userEmail, chatID, *stop)
+	}
+	if err == nil && prompt != nil {
+		summary, err = h.Chat.SetSystemPrompt(c.Request.Context(), userEmail, chatID, *prompt)
+	}
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrSystemPromptTooLong):
+			c.String(http.StatusBadRequest, fmt.Sprintf("system prompt exceeds %d characters", chat.MaxSystemPromptRunes))
+		case errors.Is(err, chat.ErrInvalidStop):
+			c.String(http.StatusBadRequest, err.Error())
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		default:
+			c.String(http.StatusInternalServerError, "failed to save system prompt")
+		}
+		return
+	}
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusOK, summary)
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/chat/%s", chatID))
+}
+
+type messageInput struct {
+	Content     string
+	Images      []chat.ImageInput
+	Preferences chat.Preferences
+	// Candidates above one asks for alternative replies to pick from
+	// instead of a stored reply.
+	Candidates int
+}
+
+func (h *Handler) RateLimit(c *gin.Context) {
+	allowed, retryAfter := h.Chat.AllowMessage(c.Request.Context(), h.userEmail(c))
+	if allowed {
+		c.Next()
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many messages, slow down"})
+	} else {
+		c.String(http.StatusTooManyRequests, "too many messages, slow down")
+	}
+	c.Abort()
+}
+
+func (h *Handler) GetStatus(c *gin.Context) {
+	status, err := h.Chat.GetStatus(c.Request.Context(), h.userEmail(c), c.Param("id"))
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "chat not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load status"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// lockChat holds the chat's completion lock for the rest of the request,
+// answering 409 itself when another reply is still being generated.
+func (h *Handler) lockChat(c *gin.Context, chatID string) (func(), bool) {
+	release, err := h.Chat.LockChat(c.Request.Context(), chatID)
+	if errors.Is(err, chat.ErrCompletionInProgress) {
+		_ = c.Error(err)
+		if h.wantsJSON(c) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		} else {
+			c.String(http.StatusConflict, err.Error())
+		}
+		return nil, false
+	}
+	return release, true
+}
+
+// EnforceQuota refuses new completions once a user has spent a monthly
+// quota. Admins are exempt.
+func (h *Handler) EnforceQuota(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	if h.isAdmin(userEmail) {
+		c.Next()
+		return
+	}
+	if err := h.Chat.CheckQuota(c.Request.Context(), userEmail); err != nil {
+		_ = c.Error(err)
+		if h.wantsJSON(c) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		} else {
+			c.String(http.StatusTooManyRequests, err.Error())
+		}
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func (h *Handler) PostMessage(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	input, ok := h.bindMessage(c)
+	if !ok {
+		return
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	userMessage, ok := h.appendUserMessage(c, userEmail, chatID, input)
+	if !ok {
+		return
+	}
+	if input.Candidates > 1 {
+		h.sendCandidates(c, userEmail, chatID, userMessage, input)
+		return
+	}
+	assistantMessage, usage, err := h.runCompletion(c.Request.Context(), userEmail, chatID, input)
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		if status, ok := chatErrorStatus(err); ok {
+			c.String(status, err.Error())
+			return
+		}
+		c.String(http.StatusBadRequest, completionErrorMessage(err))
+		return
+	}
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{
+			"user":        userMessage,
+			"assistant":   assistantMessage,
+			"usage":       usage,
+			"temperature": input.Preferences.Temperature,
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/chat/%s", chatID))
+}
+
+// sendCandidates answers a message sent with n above one. The replies are
+// always JSON since the client has to pick one with ChooseCandidate.
+func (h *Handler) sendCandidates(c *gin.Context, userEmail, chatID string, userMessage chat.Message, input messageInput) {
+	candidates, usage, err := h.Chat.RunCandidates(c.Request.Context(), userEmail, chatID, input.Preferences, input.Candidates)
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		if status, ok := chatErrorStatus(err); ok {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": completionErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"user":        userMessage,
+		"candidates":  candidates,
+		"usage":       usage,
+		"temperature": input.Preferences.Temperature,
+	})
+}
+
+func (h *Handler) ChooseCandidate(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid candidate"})
+		return
+	}
+	chatID := c.Param("id")
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	assistantMessage, err := h.Chat.ChooseCandidate(c.Request.Context(), h.userEmail(c), chatID, index)
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		status, known := chatErrorStatus(err)
+		switch {
+		case known:
+			c.JSON(status, gin.H{"error": err.Error()})
+		case errors.Is(err, chat.ErrNoCandidate):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save candidate"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"assistant": assistantMessage})
+}
+
+func (h *Handler) Regenerate(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	prefs := h.sessionPreferences(c)
+	ctx := c.Request.Context()
+	first := true
+	assistantMessage, usage, err := h.completeWithTools(ctx, userEmail, chatID, func() (chat.Message, openai.Usage, error) {
+		if first {
+			first = false
+			return h.Chat.RegenerateLast(ctx, userEmail, chatID, prefs)
+		}
+		return h.Chat.RunCompletion(ctx, userEmail, chatID, prefs)
+	})
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		status, known := chatErrorStatus(err)
+		switch {
+		case known:
+			c.String(status, err.Error())
+		case errors.Is(err, chat.ErrNothingToRegenerate):
+			c.String(http.StatusBadRequest, "nothing to regenerate")
+		default:
+			c.String(http.StatusBadRequest, completionErrorMessage(err))
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"assistant": assistantMessage,
+		"usage":     usage,
+	})
+}
+
+func (h *Handler) EditMessage(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid message index")
+		return
+	}
+	var payload struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		if !h.bodyTooLarge(c, err) {
+			c.String(http.StatusBadRequest, "missing content")
+		}
+		return
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	message, err := h.Chat.EditMessage(c.Request.Context(), userEmail, chatID, index, payload.Content)
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		case errors.Is(err, chat.ErrInvalidIndex):
+			c.String(http.StatusBadRequest, "message index out of range")
+		case errors.Is(err, chat.ErrNotUserMessage):
+			c.String(http.StatusBadRequest, "only user messages can be edited")
+		case errors.Is(err, chat.ErrEmptyContent):
+			c.String(http.StatusBadRequest, "empty message")
+		case errors.Is(err, chat.ErrMessageTooLong):
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+		default:
+			c.String(http.StatusInternalServerError, "edit failed")
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"index": index, "message": message})
+}
+
+// GetMessage returns one message's raw content, as JSON by default or as
+// plain text when the client asks for text/plain.
+func (h *Handler) GetMessage(c *gin.Context) {
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid message index")
+		return
+	}
+	message, err := h.Chat.GetMessage(c.Request.Context(), h.userEmail(c), chatID, index)
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		case errors.Is(err, chat.ErrInvalidIndex):
+			c.String(http.StatusNotFound, "message not found")
+		default:
+			c.String(http.StatusInternalServerError, "failed to load message")
+		}
+		return
+	}
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEPlain) == gin.MIMEPlain {
+		c.String(http.StatusOK, message.Content)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"index": index, "role": message.Role, "content": message.Content})
+}
+
+func (h *Handler) DeleteMessage(c *gin.Context) {
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid message index")
+		return
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	removed, err := h.Chat.DeleteMessage(c.Request.Context(), h.userEmail(c), chatID, index)
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		case errors.Is(err, chat.ErrInvalidIndex):
+			c.String(http.StatusBadRequest, "message index out of range")
+		default:
+			c.String(http.StatusInternalServerError, "delete failed")
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"index": index, "removed": removed})
+}
+
+// AppendMessage stores a user, assistant or system message as given, without
+// asking the model for a reply, so API clients can orchestrate chats
+// themselves.
+func (h *Handler) AppendMessage(c *gin.Context) {
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing chat"})
+		return
+	}
+	var payload struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		if !h.bodyTooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		}
+		return
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	message, err := h.Chat.AppendMessage(c.Request.Context(), h.userEmail(c), chatID, payload.Role, trimMessage(payload.Content))
+	if err != nil {
+		_ = c.Error(err)
+		if h.storeUnavailable(c, err) {
+			return
+		}
+		status, known := chatErrorStatus(err)
+		switch {
+		case known:
+			c.JSON(status, gin.H{"error": err.Error()})
+		case errors.Is(err, chat.ErrInvalidRole):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, chat.ErrMessageTooLong):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "append failed"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+func (h *Handler) StreamMessage(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	input, ok := h.bindMessage(c)
+	if !ok {
+		return
+	}
+	release, ok := h.lockChat(c, chatID)
+	if !ok {
+		return
+	}
+	defer release()
+	userMessage, ok := h.appendUserMessage(c, userEmail, chatID, input)
+	if !ok {
+		return
+	}
+	startEventStream(c)
+	c.SSEvent("user", userMessage)
+	c.Writer.Flush()
+	// A client that disconnects can pick the reply up again through
+	// ResumeStream, so generation outlives the request for a while.
+	ctx, cancel := chat.DetachStream(c.Request.Context())
+	defer cancel()
+	assistantMessage, usage, err := h.streamCompletion(ctx, userEmail, chatID, input, func(delta string) error {
+		if c.Request.Context().Err() == nil {
+			c.SSEvent("delta", gin.H{"content": delta})
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if c.Request.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		c.SSEvent("error", gin.H{"message": completionErrorMessage(err)})
+		c.Writer.Flush()
+		return
+	}
+	c.SSEvent("done", gin.H{
+		"assistant": renderMessage(assistantMessage),
+		"usage":     usage,
+	})
+	c.Writer.Flush()
+}
+
+// ResumeStream replays a reply that is still streaming, or already finished,
+// to a client whose stream was cut off. It sends the same events as
+// StreamMessage, minus "user" and the usage totals.
+func (h *Handler) ResumeStream(c *gin.Context) {
+	chatID := c.Param("id")
+	if chatID == "" {
+		c.String(http.StatusBadRequest, "missing chat")
+		return
+	}
+	ctx := c.Request.Context()
+	started := false
+	message, err := h.Chat.ResumeStream(ctx, h.userEmail(c), chatID, func(delta string) error {
+		if !started {
+			startEventStream(c)
+			started = true
+		}
+		c.SSEvent("delta", gin.H{"content": delta})
+		c.Writer.Flush()
+		return ctx.Err()
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case started:
+			c.SSEvent("error", gin.H{"message": "resume failed"})
+			c.Writer.Flush()
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.String(http.StatusNotFound, "chat not found")
+		case errors.Is(err, chat.ErrNoStream):
+			c.String(http.StatusNotFound, err.Error())
+		default:
+			c.String(http.StatusInternalServerError, "resume failed")
+		}
+		return
+	}
+	if !started {
+		startEventStream(c)
+	}
+	c.SSEvent("done", gin.H{"assistant": renderMessage(message)})
+	c.Writer.Flush()
+}
+
+func startEventStream(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+}
+
+type renderedMessage struct {
+	chat.Message
+	HTML   template.HTML `json:"html,omitempty"`
+	Hidden bool          `json:"hidden,omitempty"`
+}
+
+func renderMessage(message chat.Message) renderedMessage {
+	rendered := renderedMessage{Message: message, Hidden: !message.Displayable()}
+	if message.Role == "assistant" && message.Format != chat.FormatJSON {
+		rendered.HTML = markdown.Render(message.Content)
+	}
+	return rendered
+}
+
+type completionStep func() (chat.Message, openai.Usage, error)
+
+func (h *Handler) runCompletion(ctx context.Context, userEmail, chatID string, input messageInput) (chat.Message, openai.Usage, error) {
+	return h.completeWithTools(ctx, userEmail, chatID, func() (chat.Message, openai.Usage, error) {
+		return h.Chat.RunCompletion(ctx, userEmail, chatID, input.Preferences)
+	})
+}
+
+func (h *Handler) streamCompletion(ctx context.Context, userEmail, chatID string, input messageInput, onDelta func(string) error) (chat.Message, openai.Usage, error) {
+	return h.completeWithTools(ctx, userEmail, chatID, func() (chat.Message, openai.Usage, error) {
+		return h.Chat.StreamCompletion(ctx, userEmail, chatID, input.Preferences, onDelta)
+	})
+}
+
+// completeWithTools runs step and, while the assistant keeps requesting tool
+// calls, executes them and runs step again so the model sees the results.
+func (h *Handler) completeWithTools(ctx context.Context, userEmail, chatID string, step completionStep) (chat.Message, openai.Usage, error) {
+	message, usage, err := step()
+	for round := 0; err == nil && len(message.ToolCalls) > 0 && round < chat.MaxToolSteps; round++ {
+		if err := h.Chat.RunToolCalls(ctx, userEmail, chatID, message.ToolCalls); err != nil {
+			return chat.Message{}, usage, err
+		}
+		var next openai.Usage
+		message, next, err = step()
+		usage = usage.Add(next)
+	}
+	return message, usage, err
+}
+
+func (h *Handler) bindMessage(c *gin.Context) (messageInput, bool) {
+	images, err := formImages(c)
+	if err != nil {
+		if !h.bodyTooLarge(c, err) {
+			c.String(http.StatusBadRequest, err.Error())
+		}
+		return messageInput{}, false
+	}
+	content := trimMessage(c.PostForm("content"))
+	model := strings.TrimSpace(c.PostForm("model"))
+	tempValue := strings.TrimSpace(c.PostForm("temperature"))
+	candidates := 1
+	if value := strings.TrimSpace(c.PostForm("n")); value != "" {
+		if candidates, err = strconv.Atoi(value); err != nil {
+			candidates = -1
+		}
+	}
+	if content == "" && len(images) == 0 {
+		var payload struct {
+			Content     string      `json:"content"`
+			Model       string      `json:"model"`
+			Temperature json.Number `json:"temperature"`
+			ImageURLs   []string    `json:"imageUrls"`
+			N           *int        `json:"n"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			if !h.bodyTooLarge(c, err) {
+				c.String(http.StatusBadRequest, "missing message")
+			}
+			return messageInput{}, false
+		}
+		content = trimMessage(payload.Content)
+		model = strings.TrimSpace(payload.Model)
+		tempValue = strings.TrimSpace(payload.Temperature.String())
+		for _, imageURL := range payload.ImageURLs {
+			images = append(images, chat.ImageInput{URL: strings.TrimSpace(imageURL)})
+		}
+		if payload.N != nil {
+			candidates = *payload.N
+		}
+	}
+	if content == "" && len(images) == 0 {
+		c.String(http.StatusBadRequest, "empty message")
+		return messageInput{}, false
+	}
+	if candidates < 1 || candidates > chat.MaxCandidates {
+		c.String(http.StatusBadRequest, chat.ErrInvalidCandidates.Error())
+		return messageInput{}, false
+	}
+	if model != "" && !h.modelAllowed(c.Request.Context(), h.userEmail(c), model) {
+		c.String(http.StatusBadRequest, "model not allowed")
+		return messageInput{}, false
+	}
+	// The model and temperature only apply to this completion; the saved
+	// preferences change through /api/preferences.
+	prefs := h.sessionPreferences(c)
 	if model != "" {
-		session.Values[sessionModel] = model
+		prefs.Model = model
+	}
+	if tempValue != "" {
+		temperature, err := parseTemperature(tempValue)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return messageInput{}, false
+		}
+		prefs.Temperature = h.clampTemperature(temperature)
+	}
+	return messageInput{Content: content, Images: images, Preferences: prefs, Candidates: candidates}, true
+}
+
+func (h *Handler) session(c *gin.Context) *sessions.Session {
+	session, err := h.Sessions.Get(c.Request, h.Config.SessionName())
+	// A cookie that no longer decodes, say after SESSION_KEY or
+	// SESSION_BACKEND changed, leaves a fresh session to sign in with.
+	var cookieErr securecookie.Error
+	if err != nil && !(errors.As(err, &cookieErr) && cookieErr.IsDecode()) {
+		return nil
 	}
-	session.Values[sessionTemperature] = clampTemperature(temperature)
+	return session
+}
+
+func (h *Handler) userEmail(c *gin.Context) string {
+	session := h.session(c)
+	if session == nil {
+		return ""
+	}
+	if value, ok := session.Values[sessionUserEmail].(string); ok {
+		return value
+	}
+	return ""
+}
+
+func (h *Handler) sessionString(c *gin.Context, key string) string {
+	session := h.session(c)
+	if session == nil {
+		return ""
+	}
+	value, _ := session.Values[key].(string)
+	return value
+}
+
+func (h *Handler) getSessionChatID(c *gin.Context) (string, bool) {
+	session := h.session(c)
+	if session == nil {
+		return "", false
+	}
+	value, ok := session.Values[sessionChatID].(string)
+	return value, ok
+}
+
+func (h *Handler) setSessionChatID(c *gin.Context, chatID string) error {
+	session := h.session(c)
+	if session == nil {
+		return fmt.Errorf("session unavailable")
+	}
+	session.Values[sessionChatID] = chatID
 	return session.Save(c.Request, c.Writer)
 }
 
+func (h *Handler) wantsJSON(c *gin.Context) bool {
+	return acceptsJSON(c.Request.Header) || strings.HasPrefix(c.FullPath(), "/api/")
+}
+
+// chatErrorStatus maps the chat service's errors about the caller's request,
+// rather than about the backend, to an HTTP status.
+func chatErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, chat.ErrNotAuthorized):
+		return http.StatusForbidden, true
+	case errors.Is(err, chat.ErrChatNotFound):
+		return http.StatusNotFound, true
+	case errors.Is(err, chat.ErrEmptyContent):
+		return http.StatusBadRequest, true
+	case errors.Is(err, chat.ErrChatFull):
+		return http.StatusConflict, true
+	case errors.Is(err, chat.ErrStoreUnavailable):
+		return http.StatusServiceUnavailable, true
+	}
+	return 0, false
+}
+
+func completionErrorMessage(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "openai error: completion timed out"
+	}
+	if errors.Is(err, chat.ErrJSONModeUnsupported) {
+		return err.Error() + "; pick another model or turn JSON mode off"
+	}
+	if errors.Is(err, chat.ErrModelUnavailable) {
+		return err.Error() + "; pick another model"
+	}
+	if errors.Is(err, chat.ErrStoreUnavailable) {
+		return err.Error() + "; try again shortly"
+	}
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) && apiErr.Message != "" {
+		return "openai error: " + apiErr.Message
+	}
+	return "openai error"
+}
+
+// trimMessage drops trailing whitespace and leading blank lines while
+// keeping the message's own line breaks and indentation.
+func trimMessage(content string) string {
+	content = strings.TrimRightFunc(content, unicode.IsSpace)
+	for strings.HasPrefix(content, "\n") || strings.HasPrefix(content, "\r\n") {
+		_, content, _ = strings.Cut(content, "\n")
+	}
+	return content
+}
+
+func acceptsJSON(header http.Header) bool {
+	accept := header.Get("Accept")
+	return strings.Contains(accept, "application/json")
+}
+
+// clampTemperature keeps value within TEMPERATURE_MIN and TEMPERATURE_MAX.
+func (h *Handler) clampTemperature(value float64) float64 {
+	return min(max(value, h.Config.OpenAI.TemperatureMin), h.Config.OpenAI.TemperatureMax)
+}
+
+// parseTemperature reads a temperature, rejecting anything that is not a
+// number. The result still has to go through clampTemperature.
+func parseTemperature(value string) (float64, error) {
+	temperature, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(temperature) {
+		return 0, errors.New("invalid temperature")
+	}
+	return temperature, nil
+}
+
+func randomState() string {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Sprintf("%d", time.Now().UTC().UnixNano())
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce)
+}
+
+// modelChoices is the model selector for a user: blocked models are left
+// out for everyone but admins.
+func (h *Handler) modelChoices(ctx context.Context, userEmail string) []string {
+	return h.Chat.ModelChoices(ctx, h.isAdmin(userEmail))
+}
+
+func (h *Handler) modelAllowed(ctx context.Context, userEmail, model string) bool {
+	for _, allowed := range h.modelChoices(ctx, userEmail) {
+		if model == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) ensureModel(ctx context.Context, userEmail, model string) string {
+	models := h.modelChoices(ctx, userEmail)
+	model = h.Chat.DisplayModel(model)
+	if model == "" {
+		if len(models) > 0 {
+			return models[0]
+		}
+		return ""
+	}
+	for _, allowed := range models {
+		if model == allowed {
+			return model
+		}
+	}
+	if len(models) > 0 {
+		return models[0]
+	}
+	return model
+}
+
+func (h *Handler) isAllowedDomain(email string) bool {
+	if len(h.Config.AllowedDomains) == 0 {
+		return true
+	}
+	_, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	if !ok {
+		return false
+	}
+	for _, allowed := range h.Config.AllowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handler) isAllowedUser(email string) bool {
 	if len(h.Config.AllowedUsers) == 0 {
 		return true
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// storeRetryAfter is the Retry-After hint, in seconds, sent while Redis is
+// unreachable.
+const storeRetryAfter = 5
+
+func (h *Handler) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (h *Handler) Readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+	latency, err := h.Store.Ping(ctx)
+	redisStatus := gin.H{"latencyMs": float64(latency.Microseconds()) / 1000, "breaker": "closed"}
+	if degraded, since := h.Chat.StoreDegraded(); degraded {
+		redisStatus["breaker"] = "open"
+		redisStatus["failingSince"] = since
+	}
+	if err != nil {
+		redisStatus["status"] = "unavailable"
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "redis": redisStatus})
+		return
+	}
+	redisStatus["status"] = "ok"
+	body := gin.H{"status": "ok", "redis": redisStatus}
+	if !h.Config.OpenAI.ReadyCheck {
+		c.JSON(http.StatusOK, body)
+		return
+	}
+	status, ready := h.checkBackend(c.Request.Context())
+	body["openai"] = gin.H{"status": status}
+	if !ready {
+		body["status"] = "unavailable"
+		c.JSON(http.StatusServiceUnavailable, body)
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// checkBackend reports the model backend's status and whether readiness
+// should still pass. Only a timeout is forgiven, and only when the check is
+// not strict.
+func (h *Handler) checkBackend(ctx context.Context) (string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	err := h.Chat.CheckBackend(ctx)
+	switch {
+	case err == nil:
+		return "ok", true
+	case errors.Is(err, context.DeadlineExceeded) && !h.Config.OpenAI.ReadyCheckStrict:
+		return "unknown", true
+	default:
+		return "unavailable", false
+	}
+}
+
+// storeUnavailable answers 503 with a retry hint when err means Redis could
+// not be reached, so clients back off rather than give up.
+func (h *Handler) storeUnavailable(c *gin.Context, err error) bool {
+	if !errors.Is(err, chat.ErrStoreUnavailable) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(storeRetryAfter))
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return true
+	}
+	c.String(http.StatusServiceUnavailable, err.Error())
+	return true
+}
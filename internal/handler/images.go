@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+// formImages collects "image" uploads and "imageUrl" values from a multipart
+// form. Requests that are not multipart simply have no images.
+func formImages(c *gin.Context) ([]chat.ImageInput, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	var images []chat.ImageInput
+	for _, header := range form.File["image"] {
+		if header.Size > chat.MaxImageBytes {
+			return nil, fmt.Errorf("image exceeds %d MB", chat.MaxImageBytes>>20)
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("unreadable image")
+		}
+		data, err := io.ReadAll(io.LimitReader(file, chat.MaxImageBytes+1))
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unreadable image")
+		}
+		images = append(images, chat.ImageInput{Data: data})
+	}
+	for _, imageURL := range form.Value["imageUrl"] {
+		if imageURL = strings.TrimSpace(imageURL); imageURL != "" {
+			images = append(images, chat.ImageInput{URL: imageURL})
+		}
+	}
+	return images, nil
+}
+
+// appendUserMessage stores the user's turn, writing the error response
+// itself when that fails.
+func (h *Handler) appendUserMessage(c *gin.Context, userEmail, chatID string, input messageInput) (chat.Message, bool) {
+	message, err := h.Chat.AppendUserMessage(c.Request.Context(), userEmail, chatID, input.Content, input.Preferences.Model, input.Images)
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrVisionUnsupported):
+			c.String(http.StatusBadRequest, err.Error()+"; pick a vision model to attach images")
+		case errors.Is(err, chat.ErrInvalidImage):
+			c.String(http.StatusBadRequest, err.Error())
+		case errors.Is(err, chat.ErrMessageTooLong):
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+		default:
+			if h.storeUnavailable(c, err) {
+				return chat.Message{}, false
+			}
+			if status, ok := chatErrorStatus(err); ok {
+				c.String(status, err.Error())
+				return chat.Message{}, false
+			}
+			c.String(http.StatusInternalServerError, "failed to save message")
+		}
+		return chat.Message{}, false
+	}
+	return message, true
+}
+
+func (h *Handler) GetImage(c *gin.Context) {
+	data, contentType, err := h.Chat.GetImage(c.Request.Context(), h.userEmail(c), c.Param("id"), c.Param("imageId"))
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrChatNotFound) || errors.Is(err, chat.ErrImageNotFound) {
+			c.String(http.StatusNotFound, "image not found")
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to load image")
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, contentType, data)
+}
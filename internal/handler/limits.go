@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+const minBodyBytes = 1 << 20
+
+// LimitRequestBody caps request bodies before any handler reads them:
+// JSON and form posts get room for one maximum-length message, multipart
+// uploads additionally for a message's worth of images.
+func (h *Handler) LimitRequestBody(c *gin.Context) {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		c.Next()
+		return
+	}
+	limit := h.bodyLimit(c.ContentType())
+	if c.Request.ContentLength > limit {
+		h.rejectTooLarge(c, limit)
+		c.Abort()
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	c.Next()
+}
+
+func (h *Handler) bodyLimit(contentType string) int64 {
+	limit := int64(minBodyBytes)
+	// Four bytes per character covers any UTF-8 text plus JSON escaping of
+	// the common cases.
+	if messageBytes := int64(h.Chat.MaxMessageChars)*4 + 64<<10; messageBytes > limit {
+		limit = messageBytes
+	}
+	if strings.HasPrefix(contentType, "multipart/") {
+		limit += chat.MaxImagesPerMessage * chat.MaxImageBytes
+	}
+	return limit
+}
+
+func (h *Handler) rejectTooLarge(c *gin.Context, limit int64) {
+	message := fmt.Sprintf("request body exceeds %d bytes", limit)
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": message})
+		return
+	}
+	c.String(http.StatusRequestEntityTooLarge, message)
+}
+
+// bodyTooLarge reports whether a bind failed because LimitRequestBody cut
+// the body short, answering 413 if so.
+func (h *Handler) bodyTooLarge(c *gin.Context, err error) bool {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return false
+	}
+	h.rejectTooLarge(c, maxErr.Limit)
+	return true
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/auth"
+)
+
+// LocalLogin signs in with an admin-created email/password account. Attempts
+// are limited per client address, and wrong passwords per address and email,
+// so guessing is slow but nobody elsewhere can lock the owner out.
+func (h *Handler) LocalLogin(c *gin.Context) {
+	session := h.session(c)
+	if session == nil {
+		c.String(http.StatusInternalServerError, "session unavailable")
+		return
+	}
+	ctx := c.Request.Context()
+	email := strings.TrimSpace(c.PostForm("email"))
+	password := c.PostForm("password")
+	if email == "" || password == "" {
+		h.renderLogin(c, http.StatusBadRequest, email, "Enter your email and password.")
+		return
+	}
+	failureKey := c.ClientIP() + "|" + email
+	allowed, retryAfter := h.Auth.Local.AllowLogin(ctx, "ip:"+c.ClientIP())
+	if allowed {
+		var locked bool
+		locked, retryAfter = h.Auth.Local.LoginLocked(ctx, failureKey)
+		allowed = !locked
+	}
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		h.renderLogin(c, http.StatusTooManyRequests, email, "Too many sign-in attempts. Try again later.")
+		return
+	}
+	profile, err := h.Auth.Local.Verify(ctx, email, password)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			if err := h.Auth.Local.RecordLoginFailure(ctx, failureKey); err != nil {
+				slog.ErrorContext(ctx, "failed to record login failure", "request_id", RequestID(ctx), "user", email, "error", err)
+			}
+			slog.WarnContext(ctx, "local login failed", "request_id", RequestID(ctx), "user", email)
+			h.renderLogin(c, http.StatusUnauthorized, email, "Incorrect email or password.")
+			return
+		}
+		c.String(http.StatusInternalServerError, "login failed")
+		return
+	}
+	if !h.isAllowedUser(profile.Email) || !h.isAllowedDomain(profile.Email) {
+		c.HTML(http.StatusForbidden, "denied.html", gin.H{
+			"InstanceName": h.Config.InstanceName,
+			"UserEmail":    profile.Email,
+		})
+		return
+	}
+	if !h.startSession(c, session, profile) {
+		return
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+func (h *Handler) CreateLocalUser(c *gin.Context) {
+	var payload struct {
+		Email    string `json:"email"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	err := h.Auth.Local.Create(c.Request.Context(), payload.Email, payload.Name, payload.Password)
+	if err != nil {
+		h.localAccountError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"email": strings.ToLower(strings.TrimSpace(payload.Email))})
+}
+
+// SetLocalPassword and DeleteLocalUser also revoke the account's sessions,
+// as logout-all does.
+func (h *Handler) SetLocalPassword(c *gin.Context) {
+	var payload struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	email := c.Param("email")
+	if err := h.Auth.Local.SetPassword(c.Request.Context(), email, payload.Password); err != nil {
+		h.localAccountError(c, err)
+		return
+	}
+	h.revokeSessions(c, email)
+}
+
+func (h *Handler) DeleteLocalUser(c *gin.Context) {
+	email := c.Param("email")
+	if err := h.Auth.Local.Delete(c.Request.Context(), email); err != nil {
+		h.localAccountError(c, err)
+		return
+	}
+	h.revokeSessions(c, email)
+}
+
+func (h *Handler) revokeSessions(c *gin.Context, email string) {
+	if err := h.revokeUserSessions(c.Request.Context(), strings.ToLower(strings.TrimSpace(email))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) localAccountError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidEmail), errors.Is(err, auth.ErrInvalidPassword):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrAccountExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, auth.ErrAccountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "account update failed"})
+	}
+}
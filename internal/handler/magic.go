@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/auth"
+)
+
+// magicLinkSendTimeout bounds a mail sent after RequestMagicLink has
+// already answered.
+const magicLinkSendTimeout = time.Minute
+
+// RequestMagicLink emails a sign-in link. The answer is the same whether or
+// not the address may sign in, so the form does not reveal who can: the mail
+// goes out in the background, after the reply, and failures are only logged.
+// Requests are limited per client address. There is no limit per email,
+// since anyone could use it up to keep the owner from getting a link.
+func (h *Handler) RequestMagicLink(c *gin.Context) {
+	ctx := c.Request.Context()
+	email := strings.TrimSpace(c.PostForm("email"))
+	if email == "" {
+		h.renderLogin(c, http.StatusBadRequest, email, "Enter your email.")
+		return
+	}
+	if allowed, retryAfter := h.Auth.MagicLinks.AllowRequest(ctx, "ip:"+c.ClientIP()); !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		h.renderLogin(c, http.StatusTooManyRequests, email, "Too many sign-in links requested. Try again later.")
+		return
+	}
+	normalized, err := auth.MagicLinkEmail(email)
+	if err != nil {
+		h.renderLogin(c, http.StatusBadRequest, email, "Enter a valid email.")
+		return
+	}
+	email = normalized
+	if h.isAllowedUser(email) && h.isAllowedDomain(email) {
+		sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), magicLinkSendTimeout)
+		go func() {
+			defer cancel()
+			if err := h.Auth.MagicLinks.Send(sendCtx, email); err != nil {
+				slog.ErrorContext(sendCtx, "magic link not sent", "request_id", RequestID(sendCtx), "user", email, "error", err)
+			}
+		}()
+	} else {
+		slog.WarnContext(ctx, "magic link refused: user not allowed", "request_id", RequestID(ctx), "user", email)
+	}
+	c.Redirect(http.StatusFound, "/login?sent=1")
+}
+
+// ShowMagicLink asks the user to confirm a link from RequestMagicLink. The
+// token is only spent by the form's POST, so mail scanners that fetch links
+// ahead of the user do not use it up.
+func (h *Handler) ShowMagicLink(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.HTML(http.StatusOK, "magic.html", gin.H{
+		"InstanceName": h.Config.InstanceName,
+		"Token":        c.Query("token"),
+		"CSRFToken":    h.csrfToken(c),
+	})
+}
+
+// MagicLinkCallback signs in with a link confirmed on ShowMagicLink. The
+// allow lists are checked again, since they may have changed since it was
+// sent.
+func (h *Handler) MagicLinkCallback(c *gin.Context) {
+	session := h.session(c)
+	if session == nil {
+		c.String(http.StatusInternalServerError, "session unavailable")
+		return
+	}
+	ctx := c.Request.Context()
+	profile, err := h.Auth.MagicLinks.Consume(ctx, c.PostForm("token"))
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidMagicLink) {
+			h.renderLogin(c, http.StatusBadRequest, "", "This sign-in link is invalid or has expired.")
+			return
+		}
+		c.String(http.StatusInternalServerError, "login failed")
+		return
+	}
+	if !h.isAllowedUser(profile.Email) || !h.isAllowedDomain(profile.Email) {
+		c.HTML(http.StatusForbidden, "denied.html", gin.H{
+			"InstanceName": h.Config.InstanceName,
+			"UserEmail":    profile.Email,
+		})
+		return
+	}
+	if !h.startSession(c, session, profile) {
+		return
+	}
+	c.Redirect(http.StatusFound, "/")
+}
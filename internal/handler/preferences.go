@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+// optional distinguishes an absent JSON field from an explicit null, which
+// clears the stored preference.
+type optional[T any] struct {
+	Set   bool
+	Value *T
+}
+
+func (o *optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Value = nil
+		return nil
+	}
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	o.Value = &value
+	return nil
+}
+
+type preferencesInput struct {
+	Model            string            `json:"model"`
+	Temperature      optional[float64] `json:"temperature"`
+	MaxTokens        optional[int]     `json:"maxTokens"`
+	TopP             optional[float64] `json:"topP"`
+	PresencePenalty  optional[float64] `json:"presencePenalty"`
+	FrequencyPenalty optional[float64] `json:"frequencyPenalty"`
+	Seed             optional[int]     `json:"seed"`
+	Timezone         optional[string]  `json:"timezone"`
+}
+
+func (h *Handler) ListModels(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"models":      h.modelChoices(c.Request.Context(), h.userEmail(c)),
+		"unavailable": h.Chat.UnavailableModels(),
+	})
+}
+
+func (h *Handler) GetPreferences(c *gin.Context) {
+	c.JSON(http.StatusOK, h.sessionPreferences(c))
+}
+
+func (h *Handler) UpdatePreferences(c *gin.Context) {
+	input, err := bindPreferences(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	prefs := h.sessionPreferences(c)
+	if model := strings.TrimSpace(input.Model); model != "" {
+		prefs.Model = model
+	}
+	if input.Temperature.Set && input.Temperature.Value != nil {
+		prefs.Temperature = h.clampTemperature(*input.Temperature.Value)
+	}
+	if input.MaxTokens.Set {
+		prefs.MaxTokens = input.MaxTokens.Value
+	}
+	if input.TopP.Set {
+		prefs.TopP = input.TopP.Value
+	}
+	if input.PresencePenalty.Set {
+		prefs.PresencePenalty = input.PresencePenalty.Value
+	}
+	if input.FrequencyPenalty.Set {
+		prefs.FrequencyPenalty = input.FrequencyPenalty.Value
+	}
+	if input.Seed.Set {
+		prefs.Seed = input.Seed.Value
+	}
+	if input.Timezone.Set {
+		prefs.Timezone = ""
+		if input.Timezone.Value != nil {
+			prefs.Timezone = strings.TrimSpace(*input.Timezone.Value)
+		}
+	}
+	if err := prefs.Validate(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	prefs, err = h.updateSessionPreferences(c, prefs)
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrInvalidPreference) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to save preferences")
+		return
+	}
+	if h.wantsJSON(c) {
+		c.JSON(http.StatusOK, prefs)
+		return
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+func bindPreferences(c *gin.Context) (preferencesInput, error) {
+	var input preferencesInput
+	if strings.HasPrefix(c.ContentType(), "application/json") {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			return preferencesInput{}, fmt.Errorf("invalid preferences")
+		}
+		return input, nil
+	}
+	input.Model = c.PostForm("model")
+	if value, ok := c.GetPostForm("temperature"); ok && strings.TrimSpace(value) != "" {
+		temperature, err := parseTemperature(strings.TrimSpace(value))
+		if err != nil {
+			return preferencesInput{}, err
+		}
+		input.Temperature = optional[float64]{Set: true, Value: &temperature}
+	}
+	if value, ok := c.GetPostForm("maxTokens"); ok {
+		input.MaxTokens.Set = true
+		if value = strings.TrimSpace(value); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return preferencesInput{}, fmt.Errorf("invalid max_tokens")
+			}
+			input.MaxTokens.Value = &parsed
+		}
+	}
+	if value, ok := c.GetPostForm("timezone"); ok {
+		input.Timezone = optional[string]{Set: true, Value: &value}
+	}
+	if value, ok := c.GetPostForm("seed"); ok {
+		input.Seed.Set = true
+		if value = strings.TrimSpace(value); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return preferencesInput{}, fmt.Errorf("invalid seed")
+			}
+			input.Seed.Value = &parsed
+		}
+	}
+	for _, field := range []struct {
+		form, name string
+		target     *optional[float64]
+	}{
+		{"topP", "top_p", &input.TopP},
+		{"presencePenalty", "presence_penalty", &input.PresencePenalty},
+		{"frequencyPenalty", "frequency_penalty", &input.FrequencyPenalty},
+	} {
+		value, ok := c.GetPostForm(field.form)
+		if !ok {
+			continue
+		}
+		field.target.Set = true
+		if value = strings.TrimSpace(value); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return preferencesInput{}, fmt.Errorf("invalid %s", field.name)
+			}
+			field.target.Value = &parsed
+		}
+	}
+	return input, nil
+}
+
+func (h *Handler) sessionPreferences(c *gin.Context) chat.Preferences {
+	session := h.session(c)
+	if session == nil {
+		return h.normalizePreferences(c.Request.Context(), "", chat.Preferences{Temperature: defaultTemperature})
+	}
+	if session.Values[sessionModel] == nil || session.Values[sessionTemperature] == nil {
+		h.loadStoredPreferences(c, session)
+	}
+	userEmail, _ := session.Values[sessionUserEmail].(string)
+	return h.normalizePreferences(c.Request.Context(), userEmail, preferencesFromSession(session))
+}
+
+func (h *Handler) loadStoredPreferences(c *gin.Context, session *sessions.Session) {
+	userEmail, _ := session.Values[sessionUserEmail].(string)
+	if userEmail == "" {
+		return
+	}
+	prefs, found, err := h.Chat.GetPreferences(c.Request.Context(), userEmail)
+	if err != nil || !found {
+		return
+	}
+	writePreferencesToSession(session, h.normalizePreferences(c.Request.Context(), userEmail, prefs))
+	_ = session.Save(c.Request, c.Writer)
+}
+
+func (h *Handler) updateSessionPreferences(c *gin.Context, prefs chat.Preferences) (chat.Preferences, error) {
+	session := h.session(c)
+	if session == nil {
+		return chat.Preferences{}, fmt.Errorf("session unavailable")
+	}
+	userEmail, _ := session.Values[sessionUserEmail].(string)
+	prefs = h.normalizePreferences(c.Request.Context(), userEmail, prefs)
+	writePreferencesToSession(session, prefs)
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		return chat.Preferences{}, err
+	}
+	if userEmail == "" {
+		return prefs, nil
+	}
+	return prefs, h.Chat.SavePreferences(c.Request.Context(), userEmail, prefs)
+}
+
+func (h *Handler) seedPreferences(c *gin.Context, session *sessions.Session, userEmail string) {
+	prefs, found, err := h.Chat.GetPreferences(c.Request.Context(), userEmail)
+	if err != nil {
+		prefs, found = chat.Preferences{}, false
+	}
+	if !found {
+		prefs = h.normalizePreferences(c.Request.Context(), userEmail, chat.Preferences{Temperature: defaultTemperature})
+		_ = h.Chat.SavePreferences(c.Request.Context(), userEmail, prefs)
+	}
+	writePreferencesToSession(session, h.normalizePreferences(c.Request.Context(), userEmail, prefs))
+}
+
+func (h *Handler) normalizePreferences(ctx context.Context, userEmail string, prefs chat.Preferences) chat.Preferences {
+	prefs.Model = h.ensureModel(ctx, userEmail, prefs.Model)
+	prefs.Temperature = h.clampTemperature(prefs.Temperature)
+	return prefs
+}
+
+func preferencesFromSession(session *sessions.Session) chat.Preferences {
+	prefs := chat.Preferences{Temperature: defaultTemperature}
+	if value, ok := session.Values[sessionModel].(string); ok {
+		prefs.Model = value
+	}
+	if value, ok := session.Values[sessionTemperature].(float64); ok {
+		prefs.Temperature = value
+	} else if value, ok := session.Values[sessionTemperature].(string); ok {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			prefs.Temperature = parsed
+		}
+	}
+	if value, ok := session.Values[sessionMaxTokens].(int); ok {
+		prefs.MaxTokens = &value
+	}
+	if value, ok := session.Values[sessionTopP].(float64); ok {
+		prefs.TopP = &value
+	}
+	if value, ok := session.Values[sessionSeed].(int); ok {
+		prefs.Seed = &value
+	}
+	if value, ok := session.Values[sessionPresence].(float64); ok {
+		prefs.PresencePenalty = &value
+	}
+	if value, ok := session.Values[sessionFrequency].(float64); ok {
+		prefs.FrequencyPenalty = &value
+	}
+	if value, ok := session.Values[sessionTimezone].(string); ok {
+		prefs.Timezone = value
+	}
+	return prefs
+}
+
+func writePreferencesToSession(session *sessions.Session, prefs chat.Preferences) {
+	if prefs.Model != "" {
+		session.Values[sessionModel] = prefs.Model
+	}
+	session.Values[sessionTemperature] = prefs.Temperature
+	if prefs.MaxTokens != nil {
+		session.Values[sessionMaxTokens] = *prefs.MaxTokens
+	} else {
+		delete(session.Values, sessionMaxTokens)
+	}
+	if prefs.Seed != nil {
+		session.Values[sessionSeed] = *prefs.Seed
+	} else {
+		delete(session.Values, sessionSeed)
+	}
+	if prefs.Timezone != "" {
+		session.Values[sessionTimezone] = prefs.Timezone
+	} else {
+		delete(session.Values, sessionTimezone)
+	}
+	writeOptionalFloat(session, sessionTopP, prefs.TopP)
+	writeOptionalFloat(session, sessionPresence, prefs.PresencePenalty)
+	writeOptionalFloat(session, sessionFrequency, prefs.FrequencyPenalty)
+}
+
+func writeOptionalFloat(session *sessions.Session, key string, value *float64) {
+	if value != nil {
+		session.Values[key] = *value
+	} else {
+		delete(session.Values, key)
+	}
+}
+
+// userLocation resolves a timezone preference for display, falling back to
+// UTC when it is empty or no longer known.
+func userLocation(zone string) *time.Location {
+	if zone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
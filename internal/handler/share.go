@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+func (h *Handler) CreateShareLink(c *gin.Context) {
+	var payload struct {
+		ExpiresInHours int `json:"expiresInHours"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			if !h.bodyTooLarge(c, err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			}
+			return
+		}
+	}
+	ttl := time.Duration(payload.ExpiresInHours) * time.Hour
+	link, err := h.Chat.CreateShareLink(c.Request.Context(), h.userEmail(c), c.Param("id"), ttl)
+	if err != nil {
+		_ = c.Error(err)
+		switch {
+		case errors.Is(err, chat.ErrInvalidShareTTL):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, chat.ErrChatNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "chat not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create share link"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":     link.Token,
+		"url":       "/share/" + link.Token,
+		"expiresAt": link.ExpiresAt,
+	})
+}
+
+func (h *Handler) RevokeShareLink(c *gin.Context) {
+	if err := h.Chat.RevokeShareLink(c.Request.Context(), h.userEmail(c), c.Param("token")); err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrShareNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke share link"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ShowShared renders a shared chat for anyone holding the link. It runs
+// outside RequireAuth, so the page has no session, CSRF token or forms.
+func (h *Handler) ShowShared(c *gin.Context) {
+	sharedHeaders(c)
+	token := c.Param("token")
+	view, err := h.Chat.SharedChat(c.Request.Context(), token)
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrShareNotFound) {
+			c.String(http.StatusNotFound, "this link is invalid or has expired")
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to load chat")
+		return
+	}
+	c.HTML(http.StatusOK, "share.html", gin.H{
+		"InstanceName": h.Config.InstanceName,
+		"Chat":         view,
+		"Token":        token,
+	})
+}
+
+func (h *Handler) SharedImage(c *gin.Context) {
+	sharedHeaders(c)
+	data, contentType, err := h.Chat.SharedImage(c.Request.Context(), c.Param("token"), c.Param("imageId"))
+	if err != nil {
+		_ = c.Error(err)
+		if errors.Is(err, chat.ErrShareNotFound) || errors.Is(err, chat.ErrImageNotFound) {
+			c.String(http.StatusNotFound, "image not found")
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to load image")
+		return
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// sharedHeaders keeps shared pages out of search engines and caches, and
+// stops the token leaking through the Referer header.
+func sharedHeaders(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("X-Robots-Tag", "noindex, nofollow")
+}
@@ -0,0 +1,24 @@
+package handler
+
+import "testing"
+
+func TestParseTemperature(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{"0.7", 0.7, false},
+		{"2", 2, false},
+		{"-1", -1, false},
+		{"abc", 0, true},
+		{"NaN", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTemperature(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTemperature(%q) = %v, %v; want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
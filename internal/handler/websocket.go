@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"robertomachorro/smartchat/internal/service/chat"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsMaxFrameSize = 64 * 1024
+)
+
+// The default origin check rejects cross-site pages, which is what keeps the
+// session cookie from being usable by other sites over a websocket.
+var wsUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+type wsInbound struct {
+	Type        string `json:"type"`
+	Content     string `json:"content"`
+	Model       string `json:"model"`
+	Temperature string `json:"temperature"`
+}
+
+type wsOutbound struct {
+	Type      string           `json:"type"`
+	Content   string           `json:"content,omitempty"`
+	Message   string           `json:"message,omitempty"`
+	User      *chat.Message    `json:"user,omitempty"`
+	Assistant *renderedMessage `json:"assistant,omitempty"`
+	Usage     any              `json:"usage,omitempty"`
+}
+
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (w *wsConn) send(frame wsOutbound) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_ = w.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return w.conn.WriteJSON(frame)
+}
+
+func (w *wsConn) ping() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// ChatSocket streams replies over a websocket. Each inbound "message" frame
+// is stored and answered in turn; clients that cannot connect keep using the
+// POST stream endpoint.
+func (h *Handler) ChatSocket(c *gin.Context) {
+	userEmail := h.userEmail(c)
+	chatID := c.Param("id")
+	if err := h.Chat.VerifyChat(c.Request.Context(), userEmail, chatID); err != nil {
+		if errors.Is(err, chat.ErrChatNotFound) {
+			c.String(http.StatusNotFound, "chat not found")
+			return
+		}
+		c.String(http.StatusInternalServerError, "failed to load chat")
+		return
+	}
+	prefs := h.sessionPreferences(c)
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	socket := &wsConn{conn: conn}
+	conn.SetReadLimit(wsMaxFrameSize)
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := socket.ping(); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	if err := socket.send(wsOutbound{Type: "ready"}); err != nil {
+		return
+	}
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		var frame wsInbound
+		if err := conn.ReadJSON(&frame); err != nil {
+			return
+		}
+		if frame.Type != "message" {
+			continue
+		}
+		if err := h.answerSocketMessage(ctx, socket, userEmail, chatID, prefs, frame); err != nil {
+			return
+		}
+	}
+}
+
+// answerSocketMessage only returns an error when the connection is unusable;
+// problems with a single message are reported to the client as error frames.
+func (h *Handler) answerSocketMessage(ctx context.Context, socket *wsConn, userEmail, chatID string, prefs chat.Preferences, frame wsInbound) error {
+	content := trimMessage(frame.Content)
+	if content == "" {
+		return socket.send(wsOutbound{Type: "error", Message: "empty message"})
+	}
+	if allowed, _ := h.Chat.AllowMessage(ctx, userEmail); !allowed {
+		return socket.send(wsOutbound{Type: "error", Message: "too many messages, slow down"})
+	}
+	if !h.isAdmin(userEmail) {
+		if err := h.Chat.CheckQuota(ctx, userEmail); err != nil {
+			return socket.send(wsOutbound{Type: "error", Message: err.Error()})
+		}
+	}
+	if model := strings.TrimSpace(frame.Model); model != "" {
+		if !h.modelAllowed(ctx, userEmail, model) {
+			return socket.send(wsOutbound{Type: "error", Message: "model not allowed"})
+		}
+		prefs.Model = model
+	}
+	if frame.Temperature != "" {
+		temperature, err := parseTemperature(strings.TrimSpace(frame.Temperature))
+		if err != nil {
+			return socket.send(wsOutbound{Type: "error", Message: err.Error()})
+		}
+		prefs.Temperature = temperature
+	}
+	prefs = h.normalizePreferences(ctx, userEmail, prefs)
+	release, err := h.Chat.LockChat(ctx, chatID)
+	if errors.Is(err, chat.ErrCompletionInProgress) {
+		return socket.send(wsOutbound{Type: "error", Message: err.Error()})
+	}
+	defer release()
+	userMessage, err := h.Chat.AppendMessage(ctx, userEmail, chatID, "user", content)
+	if _, known := chatErrorStatus(err); known || errors.Is(err, chat.ErrMessageTooLong) {
+		return socket.send(wsOutbound{Type: "error", Message: err.Error()})
+	}
+	if err != nil {
+		return socket.send(wsOutbound{Type: "error", Message: "failed to save message"})
+	}
+	if err := socket.send(wsOutbound{Type: "user", User: &userMessage}); err != nil {
+		return err
+	}
+	input := messageInput{Content: content, Preferences: prefs}
+	// As with StreamMessage, a dropped socket leaves the reply generating
+	// so the client can resume it.
+	streamCtx, cancel := chat.DetachStream(ctx)
+	defer cancel()
+	var deliveryErr error
+	assistantMessage, usage, err := h.streamCompletion(streamCtx, userEmail, chatID, input, func(delta string) error {
+		if deliveryErr == nil {
+			deliveryErr = socket.send(wsOutbound{Type: "delta", Content: delta})
+		}
+		return nil
+	})
+	if deliveryErr != nil {
+		return deliveryErr
+	}
+	if err != nil {
+		return socket.send(wsOutbound{Type: "error", Message: completionErrorMessage(err)})
+	}
+	rendered := renderMessage(assistantMessage)
+	return socket.send(wsOutbound{Type: "done", Assistant: &rendered, Usage: usage})
+}
@@ -0,0 +1,53 @@
+package markdown
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+var (
+	converter = goldmark.New(
+		goldmark.WithExtensions(
+			extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+			extension.Strikethrough,
+			extension.Linkify,
+		),
+		// Chat replies break lines where they mean to, so single newlines
+		// stay line breaks. Raw HTML in the source is dropped.
+		goldmark.WithRendererOptions(html.WithHardWraps()),
+	)
+	sanitizer = newPolicy()
+)
+
+// Render converts Markdown to HTML and passes the result through an
+// allowlist sanitizer, so only the tags and attributes below, and links to
+// safe schemes, can reach the page whatever the source contains.
+func Render(source string) template.HTML {
+	var out bytes.Buffer
+	if err := converter.Convert([]byte(source), &out); err != nil {
+		return template.HTML(template.HTMLEscapeString(source))
+	}
+	return template.HTML(sanitizer.SanitizeBytes(out.Bytes()))
+}
+
+func newPolicy() *bluemonday.Policy {
+	policy := bluemonday.NewPolicy()
+	policy.AllowElements("p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6",
+		"strong", "em", "del", "code", "pre", "blockquote", "ul", "ol", "li",
+		"table", "thead", "tbody", "tr", "th", "td")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[A-Za-z0-9_+-]+$`)).OnElements("code")
+	policy.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	policy.AllowAttrs("align").Matching(regexp.MustCompile(`^(left|center|right)$`)).OnElements("th", "td")
+	policy.AllowAttrs("href").OnElements("a")
+	policy.AllowURLSchemes("http", "https", "mailto")
+	policy.RequireParseableURLs(true)
+	policy.RequireNoReferrerOnLinks(true)
+	policy.AddTargetBlankToFullyQualifiedLinks(true)
+	return policy
+}
@@ -0,0 +1,63 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"paragraph", "hello **world**", []string{"<p>hello <strong>world</strong></p>"}},
+		{"line break", "one\ntwo", []string{"one<br", "two"}},
+		{"code fence", "```go\nfmt.Println(\"<b>\")\n```", []string{`<code class="language-go">`, "&lt;b&gt;"}},
+		{"list", "- a\n- b", []string{"<ul>", "<li>a</li>"}},
+		{"table", "| a | b |\n|:--|--:|\n| 1 | 2 |", []string{"<table>", `<th align="left">a</th>`, `<td align="right">2</td>`}},
+		{"link", "[docs](https://example.com)", []string{`href="https://example.com"`, `rel="noreferrer noopener"`, `target="_blank"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(Render(tt.source))
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("Render(%q) = %q, want it to contain %q", tt.source, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderHostileInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"script tag", "<script>alert(1)</script>"},
+		{"inline handler", `<img src=x onerror="alert(1)">`},
+		{"javascript link", "[click](javascript:alert(1))"},
+		{"encoded javascript link", "[click](jav&#x61;script:alert(1))"},
+		{"data link", "[click](data:text/html;base64,PHNjcmlwdD4=)"},
+		{"autolink", "<javascript:alert(1)>"},
+		{"fence info", "```\"><script>alert(1)</script>\nx\n```"},
+		{"nul placeholders", "\x0099\x00 [a](https://example.com) \x00/\x00 \x00-1\x00"},
+		{"nested markup", "**[x](https://example.com \"<script>\")**"},
+		{"html block", "<div onclick=\"alert(1)\">\n\n*x*\n\n</div>"},
+		{"iframe", "<iframe src=\"https://example.com\"></iframe>"},
+		{"style", "<style>body{display:none}</style>"},
+		{"unclosed", "**[`<x"},
+	}
+	forbidden := []string{"<script", "<img", "<iframe", "<style", "<div", "onerror", "onclick", `href="javascript`, `href="data`}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.ToLower(string(Render(tt.source)))
+			for _, bad := range forbidden {
+				if strings.Contains(got, bad) {
+					t.Errorf("Render(%q) = %q, contains %q", tt.source, got, bad)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+const (
+	ProviderLocal Provider = "local"
+
+	MinPasswordRunes = 10
+	// bcrypt ignores everything past 72 bytes, so longer passwords are
+	// refused rather than silently truncated.
+	maxPasswordBytes = 72
+
+	loginWindow      = 15 * time.Minute
+	loginMaxAttempts = 10
+	loginMaxFailures = 5
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrAccountExists      = errors.New("account already exists")
+	ErrAccountNotFound    = errors.New("account not found")
+	ErrInvalidPassword    = fmt.Errorf("password must be at least %d characters and at most %d bytes", MinPasswordRunes, maxPasswordBytes)
+	ErrInvalidEmail       = errors.New("invalid email")
+)
+
+// dummyHash is compared against when an account does not exist, so a
+// failed login takes as long whether or not the email is registered.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("smartchat-no-such-account"), bcrypt.DefaultCost)
+
+// LocalAccounts keeps username/password accounts in Redis for deployments
+// that cannot reach an OAuth provider. Accounts are created by admins.
+type LocalAccounts struct {
+	redis *redis.Client
+}
+
+type localAccount struct {
+	Name         string    `json:"name"`
+	PasswordHash []byte    `json:"passwordHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func NewLocalAccounts(redisClient *redis.Client) *LocalAccounts {
+	return &LocalAccounts{redis: redisClient}
+}
+
+func (l *LocalAccounts) Create(ctx context.Context, email, name, password string) error {
+	email = normalizeEmail(email)
+	if !strings.Contains(email, "@") {
+		return ErrInvalidEmail
+	}
+	payload, err := newLocalAccount(name, password)
+	if err != nil {
+		return err
+	}
+	created, err := l.redis.SetNX(ctx, localUserKey(email), payload, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrAccountExists
+	}
+	return nil
+}
+
+func (l *LocalAccounts) SetPassword(ctx context.Context, email, password string) error {
+	email = normalizeEmail(email)
+	account, err := l.load(ctx, email)
+	if err != nil {
+		return err
+	}
+	payload, err := newLocalAccount(account.Name, password)
+	if err != nil {
+		return err
+	}
+	return l.redis.Set(ctx, localUserKey(email), payload, 0).Err()
+}
+
+func (l *LocalAccounts) Delete(ctx context.Context, email string) error {
+	removed, err := l.redis.Del(ctx, localUserKey(normalizeEmail(email))).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+// Verify checks a password and returns the account's profile. Every failure
+// is reported as ErrInvalidCredentials so callers cannot tell a wrong
+// password from an unknown email.
+func (l *LocalAccounts) Verify(ctx context.Context, email, password string) (Profile, error) {
+	email = normalizeEmail(email)
+	account, err := l.load(ctx, email)
+	if errors.Is(err, ErrAccountNotFound) {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return Profile{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	if bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil {
+		return Profile{}, ErrInvalidCredentials
+	}
+	name := account.Name
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+	return Profile{Email: email, Name: name}, nil
+}
+
+// AllowLogin counts a sign-in attempt against key (a client address) in a
+// fixed window. Redis errors refuse the attempt, since failing open would
+// lift the brute-force protection.
+func (l *LocalAccounts) AllowLogin(ctx context.Context, key string) (bool, time.Duration) {
+	now := time.Now()
+	window := now.Truncate(loginWindow)
+	redisKey := store.Key("loginattempts", strings.ToLower(key), strconv.FormatInt(window.Unix(), 10))
+	pipe := l.redis.TxPipeline()
+	count := pipe.Incr(ctx, redisKey)
+	pipe.Expire(ctx, redisKey, loginWindow+time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, time.Minute
+	}
+	if count.Val() > loginMaxAttempts {
+		return false, window.Add(loginWindow).Sub(now)
+	}
+	return true, 0
+}
+
+// LoginLocked reports whether key has used up its failed sign-ins for the
+// current window. Unlike AllowLogin it does not count this attempt, so only
+// wrong passwords, recorded with RecordLoginFailure, lead to a lockout.
+func (l *LocalAccounts) LoginLocked(ctx context.Context, key string) (bool, time.Duration) {
+	now := time.Now()
+	window := now.Truncate(loginWindow)
+	failures, err := l.redis.Get(ctx, loginFailuresKey(key, window)).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return true, time.Minute
+	}
+	if failures >= loginMaxFailures {
+		return true, window.Add(loginWindow).Sub(now)
+	}
+	return false, 0
+}
+
+// RecordLoginFailure counts a wrong password against key.
+func (l *LocalAccounts) RecordLoginFailure(ctx context.Context, key string) error {
+	redisKey := loginFailuresKey(key, time.Now().Truncate(loginWindow))
+	pipe := l.redis.TxPipeline()
+	pipe.Incr(ctx, redisKey)
+	pipe.Expire(ctx, redisKey, loginWindow+time.Second)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func loginFailuresKey(key string, window time.Time) string {
+	return store.Key("loginfailures", strings.ToLower(key), strconv.FormatInt(window.Unix(), 10))
+}
+
+func (l *LocalAccounts) load(ctx context.Context, email string) (localAccount, error) {
+	data, err := l.redis.Get(ctx, localUserKey(email)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return localAccount{}, ErrAccountNotFound
+	}
+	if err != nil {
+		return localAccount{}, err
+	}
+	var account localAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return localAccount{}, fmt.Errorf("decode local account: %w", err)
+	}
+	return account, nil
+}
+
+func newLocalAccount(name, password string) ([]byte, error) {
+	if utf8.RuneCountInString(password) < MinPasswordRunes || len(password) > maxPasswordBytes {
+		return nil, ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(localAccount{
+		Name:         strings.TrimSpace(name),
+		PasswordHash: hash,
+		CreatedAt:    time.Now().UTC(),
+	})
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func localUserKey(email string) string {
+	return store.Key("localuser", email)
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/config"
+	"robertomachorro/smartchat/internal/store"
+)
+
+const (
+	ProviderMagicLink Provider = "magic-link"
+
+	magicWindow      = 15 * time.Minute
+	magicMaxRequests = 5
+)
+
+var ErrInvalidMagicLink = errors.New("sign-in link is invalid or has expired")
+
+// Mailer sends the email carrying a sign-in link.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// MagicLinks signs users in through a single-use link sent to their email.
+// A token is random bytes plus an HMAC of them, so forged tokens are turned
+// away before Redis is asked; Redis holds only a hash of each token, which
+// the first successful callback deletes.
+type MagicLinks struct {
+	redis       *redis.Client
+	mailer      Mailer
+	key         []byte
+	callbackURL string
+	ttl         time.Duration
+	instance    string
+}
+
+func NewMagicLinks(redisClient *redis.Client, mailer Mailer, secret string, settings config.MagicLinkConfig, instanceName string) *MagicLinks {
+	key := sha256.Sum256([]byte("magic-link:" + secret))
+	return &MagicLinks{
+		redis:       redisClient,
+		mailer:      mailer,
+		key:         key[:],
+		callbackURL: settings.CallbackURL,
+		ttl:         settings.TTL,
+		instance:    instanceName,
+	}
+}
+
+// Send emails a fresh sign-in link to email.
+func (m *MagicLinks) Send(ctx context.Context, email string) error {
+	email, err := MagicLinkEmail(email)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random) + "." + base64.RawURLEncoding.EncodeToString(m.sign(random))
+	if err := m.redis.Set(ctx, magicLinkKey(token), email, m.ttl).Err(); err != nil {
+		return err
+	}
+	link, err := url.Parse(m.callbackURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	expires := m.ttl.String()
+	if m.ttl%time.Minute == 0 {
+		expires = fmt.Sprintf("%d minutes", int(m.ttl.Minutes()))
+	}
+	body := fmt.Sprintf("Use this link to sign in to %s:\n\n%s\n\nIt works once and expires in %s. If you did not ask for it, ignore this email.\n",
+		m.instance, link.String(), expires)
+	return m.mailer.Send(ctx, email, "Sign in to "+m.instance, body)
+}
+
+// Consume trades a token for the profile it was issued to. The token is
+// deleted in the same step, so a link works exactly once.
+func (m *MagicLinks) Consume(ctx context.Context, token string) (Profile, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Profile{}, ErrInvalidMagicLink
+	}
+	random, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Profile{}, ErrInvalidMagicLink
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, m.sign(random)) {
+		return Profile{}, ErrInvalidMagicLink
+	}
+	email, err := m.redis.GetDel(ctx, magicLinkKey(token)).Result()
+	if errors.Is(err, redis.Nil) {
+		return Profile{}, ErrInvalidMagicLink
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	return Profile{Email: email}, nil
+}
+
+// AllowRequest counts a link request against key (a client address) in a
+// fixed window, so the form cannot be used to flood inboxes.
+// Redis errors refuse the request.
+func (m *MagicLinks) AllowRequest(ctx context.Context, key string) (bool, time.Duration) {
+	now := time.Now()
+	window := now.Truncate(magicWindow)
+	redisKey := store.Key("magicrequests", strings.ToLower(key), strconv.FormatInt(window.Unix(), 10))
+	pipe := m.redis.TxPipeline()
+	count := pipe.Incr(ctx, redisKey)
+	pipe.Expire(ctx, redisKey, magicWindow+time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, time.Minute
+	}
+	if count.Val() > magicMaxRequests {
+		return false, window.Add(magicWindow).Sub(now)
+	}
+	return true, 0
+}
+
+func (m *MagicLinks) sign(random []byte) []byte {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write(random)
+	return mac.Sum(nil)
+}
+
+// MagicLinkEmail normalizes email and accepts a bare address only, so
+// nothing but the address itself reaches the mail headers.
+func MagicLinkEmail(email string) (string, error) {
+	email = normalizeEmail(email)
+	parsed, err := mail.ParseAddress(email)
+	if err != nil || parsed.Address != email {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+func magicLinkKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return store.Key("magiclink", hex.EncodeToString(sum[:]))
+}
@@ -10,6 +10,7 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/microsoft"
 
 	"robertomachorro/smartchat/internal/config"
 )
@@ -17,120 +18,330 @@ import (
 type Provider string
 
 const (
-	ProviderGoogle Provider = "google"
-	ProviderGitHub Provider = "github"
+	ProviderGoogle    Provider = "google"
+	ProviderGitHub    Provider = "github"
+	ProviderGitLab    Provider = "gitlab"
+	ProviderMicrosoft Provider = "microsoft"
+	ProviderOIDC      Provider = "oidc"
 )
 
 type Service struct {
 	GoogleConfig *oauth2.Config
 	GitHubConfig *oauth2.Config
+	GitLabConfig *oauth2.Config
+	// MicrosoftConfig also asks for User.Read, which Graph's /me requires.
+	MicrosoftConfig *oauth2.Config
+	Tokens          *TokenStore
+	Local           *LocalAccounts
+	MagicLinks      *MagicLinks
+	oidc            *oidcProvider
+	// gitlabURL is the GitLab instance the API calls go to.
+	gitlabURL string
+	// microsoftMultiTenant is set when any Azure directory may sign in.
+	microsoftMultiTenant bool
 }
 
+// NewService registers only the providers whose settings are complete; the
+// others report false from Enabled and refuse to start a login.
 func NewService(cfg config.Config) *Service {
-	googleConfig := &oauth2.Config{
-		ClientID:     cfg.OAuthGoogle.ClientID,
-		ClientSecret: cfg.OAuthGoogle.ClientSecret,
-		RedirectURL:  cfg.OAuthGoogle.RedirectURL,
-		Scopes:       []string{"openid", "email", "profile"},
-		Endpoint:     google.Endpoint,
-	}
-	githubConfig := &oauth2.Config{
-		ClientID:     cfg.OAuthGitHub.ClientID,
-		ClientSecret: cfg.OAuthGitHub.ClientSecret,
-		RedirectURL:  cfg.OAuthGitHub.RedirectURL,
-		Scopes:       []string{"user:email"},
-		Endpoint:     github.Endpoint,
-	}
-	return &Service{GoogleConfig: googleConfig, GitHubConfig: githubConfig}
+	service := &Service{}
+	if cfg.OAuthGoogle.Configured() {
+		service.GoogleConfig = &oauth2.Config{
+			ClientID:     cfg.OAuthGoogle.ClientID,
+			ClientSecret: cfg.OAuthGoogle.ClientSecret,
+			RedirectURL:  cfg.OAuthGoogle.RedirectURL,
+			Scopes:       []string{"openid", "email", "profile"},
+			Endpoint:     google.Endpoint,
+		}
+	}
+	if cfg.OAuthGitHub.Configured() {
+		service.GitHubConfig = &oauth2.Config{
+			ClientID:     cfg.OAuthGitHub.ClientID,
+			ClientSecret: cfg.OAuthGitHub.ClientSecret,
+			RedirectURL:  cfg.OAuthGitHub.RedirectURL,
+			Scopes:       []string{"user:email"},
+			Endpoint:     github.Endpoint,
+		}
+	}
+	if cfg.OAuthGitLab.Configured() {
+		service.GitLabConfig = &oauth2.Config{
+			ClientID:     cfg.OAuthGitLab.ClientID,
+			ClientSecret: cfg.OAuthGitLab.ClientSecret,
+			RedirectURL:  cfg.OAuthGitLab.RedirectURL,
+			Scopes:       []string{"read_user"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.OAuthGitLab.BaseURL + "/oauth/authorize",
+				TokenURL: cfg.OAuthGitLab.BaseURL + "/oauth/token",
+			},
+		}
+		service.gitlabURL = cfg.OAuthGitLab.BaseURL
+	}
+	if cfg.OAuthMicrosoft.Configured() {
+		service.MicrosoftConfig = &oauth2.Config{
+			ClientID:     cfg.OAuthMicrosoft.ClientID,
+			ClientSecret: cfg.OAuthMicrosoft.ClientSecret,
+			RedirectURL:  cfg.OAuthMicrosoft.RedirectURL,
+			Scopes:       []string{"openid", "email", "profile", "User.Read"},
+			Endpoint:     microsoft.AzureADEndpoint(cfg.OAuthMicrosoft.Tenant),
+		}
+		service.microsoftMultiTenant = cfg.OAuthMicrosoft.MultiTenant()
+	}
+	if cfg.OAuthOIDC.Configured() {
+		service.oidc = &oidcProvider{settings: cfg.OAuthOIDC}
+	}
+	return service
 }
 
-func (s *Service) AuthURL(provider Provider, state string) (string, error) {
+func (s *Service) Enabled(provider Provider) bool {
 	switch provider {
 	case ProviderGoogle:
-		return s.GoogleConfig.AuthCodeURL(state, oauth2.AccessTypeOnline), nil
+		return s.GoogleConfig != nil
 	case ProviderGitHub:
-		return s.GitHubConfig.AuthCodeURL(state), nil
+		return s.GitHubConfig != nil
+	case ProviderGitLab:
+		return s.GitLabConfig != nil
+	case ProviderMicrosoft:
+		return s.MicrosoftConfig != nil
+	case ProviderOIDC:
+		return s.oidc != nil
+	case ProviderLocal:
+		return s.Local != nil
+	case ProviderMagicLink:
+		return s.MagicLinks != nil
 	default:
-		return "", fmt.Errorf("unsupported provider")
+		return false
 	}
 }
 
+func (s *Service) AuthURL(ctx context.Context, provider Provider, state string) (string, error) {
+	cfg, err := s.oauthConfig(ctx, provider)
+	if err != nil {
+		return "", err
+	}
+	if provider == ProviderGoogle {
+		return cfg.AuthCodeURL(state, oauth2.AccessTypeOffline), nil
+	}
+	return cfg.AuthCodeURL(state), nil
+}
+
 func (s *Service) Exchange(ctx context.Context, provider Provider, code string) (*oauth2.Token, error) {
-	switch provider {
-	case ProviderGoogle:
-		return s.GoogleConfig.Exchange(ctx, code)
-	case ProviderGitHub:
-		return s.GitHubConfig.Exchange(ctx, code)
-	default:
-		return nil, fmt.Errorf("unsupported provider")
+	cfg, err := s.oauthConfig(ctx, provider)
+	if err != nil {
+		return nil, err
 	}
+	return cfg.Exchange(ctx, code)
+}
+
+type Profile struct {
+	Email     string
+	Name      string
+	AvatarURL string
 }
 
 func (s *Service) FetchEmail(ctx context.Context, provider Provider, token *oauth2.Token) (string, error) {
+	profile, err := s.FetchProfile(ctx, provider, token)
+	if err != nil {
+		return "", err
+	}
+	return profile.Email, nil
+}
+
+// FetchProfile returns the signed-in user's email, display name and avatar.
+// The name falls back to the email's local part when the provider has none.
+func (s *Service) FetchProfile(ctx context.Context, provider Provider, token *oauth2.Token) (Profile, error) {
+	var profile Profile
+	var err error
 	switch provider {
 	case ProviderGoogle:
-		return fetchGoogleEmail(ctx, s.GoogleConfig, token)
+		profile, err = fetchGoogleProfile(ctx, s.GoogleConfig, token)
 	case ProviderGitHub:
-		return fetchGitHubEmail(ctx, s.GitHubConfig, token)
+		profile, err = fetchGitHubProfile(ctx, s.GitHubConfig, token)
+	case ProviderGitLab:
+		profile, err = fetchGitLabProfile(ctx, s.GitLabConfig, s.gitlabURL, token)
+	case ProviderMicrosoft:
+		profile, err = fetchMicrosoftProfile(ctx, s.MicrosoftConfig, token, !s.microsoftMultiTenant)
+	case ProviderOIDC:
+		if s.oidc == nil {
+			return Profile{}, fmt.Errorf("oidc not configured")
+		}
+		cfg, userInfoURL, cfgErr := s.oidc.config(ctx)
+		if cfgErr != nil {
+			return Profile{}, cfgErr
+		}
+		profile, err = fetchOIDCProfile(ctx, cfg, userInfoURL, token)
 	default:
-		return "", fmt.Errorf("unsupported provider")
+		return Profile{}, fmt.Errorf("unsupported provider")
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	profile.Name = strings.TrimSpace(profile.Name)
+	if profile.Name == "" {
+		profile.Name, _, _ = strings.Cut(profile.Email, "@")
+	}
+	if !strings.HasPrefix(profile.AvatarURL, "https://") {
+		profile.AvatarURL = ""
 	}
+	return profile, nil
 }
 
-func fetchGoogleEmail(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token) (string, error) {
+func fetchGoogleProfile(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token) (Profile, error) {
 	client := cfg.Client(ctx, token)
 	response, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
 	if err != nil {
-		return "", fmt.Errorf("google userinfo: %w", err)
+		return Profile{}, fmt.Errorf("google userinfo: %w", err)
 	}
 	defer response.Body.Close()
 	if response.StatusCode < 200 || response.StatusCode > 299 {
-		return "", fmt.Errorf("google userinfo status %d", response.StatusCode)
+		return Profile{}, fmt.Errorf("google userinfo status %d", response.StatusCode)
 	}
 	var data struct {
-		Email string `json:"email"`
+		Email   string `json:"email"`
+		Name    string `json:"name"`
+		Picture string `json:"picture"`
 	}
 	if err := json.NewDecoder(response.Body).Decode(&data); err != nil {
-		return "", fmt.Errorf("decode google userinfo: %w", err)
+		return Profile{}, fmt.Errorf("decode google userinfo: %w", err)
 	}
 	if data.Email == "" {
-		return "", fmt.Errorf("google email missing")
+		return Profile{}, fmt.Errorf("google email missing")
 	}
-	return data.Email, nil
+	return Profile{Email: data.Email, Name: data.Name, AvatarURL: data.Picture}, nil
 }
 
-func fetchGitHubEmail(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token) (string, error) {
+// fetchGitHubProfile prefers the primary email and falls back to any other
+// address, but only ones GitHub has verified, since the domain decides
+// access.
+func fetchGitHubProfile(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token) (Profile, error) {
 	client := cfg.Client(ctx, token)
-	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.github.com/user/emails", nil)
-	if err != nil {
-		return "", fmt.Errorf("github request: %w", err)
-	}
-	request.Header.Set("Accept", "application/vnd.github+json")
-	response, err := client.Do(request)
-	if err != nil {
-		return "", fmt.Errorf("github user emails: %w", err)
+	var user struct {
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
 	}
-	defer response.Body.Close()
-	if response.StatusCode < 200 || response.StatusCode > 299 {
-		return "", fmt.Errorf("github user emails status %d", response.StatusCode)
+	if err := getGitHubJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return Profile{}, fmt.Errorf("github user: %w", err)
 	}
 	var emails []struct {
 		Email    string `json:"email"`
 		Primary  bool   `json:"primary"`
 		Verified bool   `json:"verified"`
 	}
-	if err := json.NewDecoder(response.Body).Decode(&emails); err != nil {
-		return "", fmt.Errorf("decode github user emails: %w", err)
+	if err := getGitHubJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return Profile{}, fmt.Errorf("github user emails: %w", err)
+	}
+	name := user.Name
+	if name == "" {
+		name = user.Login
 	}
+	profile := Profile{Name: name, AvatarURL: user.AvatarURL}
 	for _, entry := range emails {
 		if entry.Primary && entry.Verified && strings.Contains(entry.Email, "@") {
-			return entry.Email, nil
+			profile.Email = entry.Email
+			return profile, nil
 		}
 	}
 	for _, entry := range emails {
-		if strings.Contains(entry.Email, "@") {
-			return entry.Email, nil
+		if entry.Verified && strings.Contains(entry.Email, "@") {
+			profile.Email = entry.Email
+			return profile, nil
 		}
 	}
-	return "", fmt.Errorf("github email missing")
+	return Profile{}, fmt.Errorf("github email missing")
+}
+
+// fetchGitLabProfile only accepts the account's primary email once GitLab
+// has confirmed it.
+func fetchGitLabProfile(ctx context.Context, cfg *oauth2.Config, baseURL string, token *oauth2.Token) (Profile, error) {
+	client := cfg.Client(ctx, token)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/api/v4/user", nil)
+	if err != nil {
+		return Profile{}, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return Profile{}, fmt.Errorf("gitlab user: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return Profile{}, fmt.Errorf("gitlab user status %d", response.StatusCode)
+	}
+	var user struct {
+		Username    string  `json:"username"`
+		Name        string  `json:"name"`
+		Email       string  `json:"email"`
+		AvatarURL   string  `json:"avatar_url"`
+		ConfirmedAt *string `json:"confirmed_at"`
+		State       string  `json:"state"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&user); err != nil {
+		return Profile{}, fmt.Errorf("decode gitlab user: %w", err)
+	}
+	if user.State != "" && user.State != "active" {
+		return Profile{}, fmt.Errorf("gitlab account %s", user.State)
+	}
+	if !strings.Contains(user.Email, "@") {
+		return Profile{}, fmt.Errorf("gitlab email missing")
+	}
+	if user.ConfirmedAt == nil || *user.ConfirmedAt == "" {
+		return Profile{}, fmt.Errorf("gitlab email not verified")
+	}
+	name := user.Name
+	if name == "" {
+		name = user.Username
+	}
+	return Profile{Email: user.Email, Name: name, AvatarURL: user.AvatarURL}, nil
+}
+
+// fetchMicrosoftProfile reads Graph's /me. The mail attribute is whatever a
+// directory admin typed in, unverified, so it is only used when trustMail
+// says the tenant is pinned to the operator's own; otherwise, and for
+// accounts without a mailbox, the user principal name is the email, whose
+// domain Azure requires the tenant to have verified.
+func fetchMicrosoftProfile(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token, trustMail bool) (Profile, error) {
+	client := cfg.Client(ctx, token)
+	response, err := client.Get("https://graph.microsoft.com/v1.0/me")
+	if err != nil {
+		return Profile{}, fmt.Errorf("microsoft graph me: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return Profile{}, fmt.Errorf("microsoft graph me status %d", response.StatusCode)
+	}
+	var data struct {
+		DisplayName       string  `json:"displayName"`
+		Mail              *string `json:"mail"`
+		UserPrincipalName string  `json:"userPrincipalName"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&data); err != nil {
+		return Profile{}, fmt.Errorf("decode microsoft graph me: %w", err)
+	}
+	email := data.UserPrincipalName
+	if trustMail && data.Mail != nil && strings.Contains(*data.Mail, "@") {
+		email = *data.Mail
+	}
+	if !strings.Contains(email, "@") {
+		return Profile{}, fmt.Errorf("microsoft email missing")
+	}
+	return Profile{Email: email, Name: data.DisplayName}, nil
+}
+
+func getGitHubJSON(ctx context.Context, client *http.Client, url string, target any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	if err := json.NewDecoder(response.Body).Decode(target); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	return nil
 }
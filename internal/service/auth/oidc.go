@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"robertomachorro/smartchat/internal/config"
+)
+
+const discoveryTimeout = 10 * time.Second
+
+type oidcProvider struct {
+	settings    config.OIDCConfig
+	mu          sync.Mutex
+	oauth       *oauth2.Config
+	userInfoURL string
+}
+
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// config discovers the provider endpoints on first use and caches them, so an
+// unreachable issuer does not prevent the server from starting.
+func (p *oidcProvider) config(ctx context.Context) (*oauth2.Config, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth != nil {
+		return p.oauth, p.userInfoURL, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.settings.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("oidc discovery request: %w", err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, "", fmt.Errorf("oidc discovery: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, "", fmt.Errorf("oidc discovery status %d", response.StatusCode)
+	}
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(response.Body).Decode(&discovery); err != nil {
+		return nil, "", fmt.Errorf("decode oidc discovery: %w", err)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserInfoEndpoint == "" {
+		return nil, "", fmt.Errorf("oidc discovery missing endpoints")
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.settings.ClientID,
+		ClientSecret: p.settings.ClientSecret,
+		RedirectURL:  p.settings.RedirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+	}
+	p.userInfoURL = discovery.UserInfoEndpoint
+	return p.oauth, p.userInfoURL, nil
+}
+
+func fetchOIDCProfile(ctx context.Context, cfg *oauth2.Config, userInfoURL string, token *oauth2.Token) (Profile, error) {
+	client := cfg.Client(ctx, token)
+	response, err := client.Get(userInfoURL)
+	if err != nil {
+		return Profile{}, fmt.Errorf("oidc userinfo: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return Profile{}, fmt.Errorf("oidc userinfo status %d", response.StatusCode)
+	}
+	var data struct {
+		Email             string `json:"email"`
+		EmailVerified     *bool  `json:"email_verified"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+		Picture           string `json:"picture"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&data); err != nil {
+		return Profile{}, fmt.Errorf("decode oidc userinfo: %w", err)
+	}
+	if data.Email == "" {
+		return Profile{}, fmt.Errorf("oidc email missing")
+	}
+	if data.EmailVerified != nil && !*data.EmailVerified {
+		return Profile{}, fmt.Errorf("oidc email not verified")
+	}
+	name := data.Name
+	if name == "" {
+		name = data.PreferredUsername
+	}
+	return Profile{Email: data.Email, Name: name, AvatarURL: data.Picture}, nil
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+var (
+	ErrNoToken        = errors.New("no oauth token stored for user")
+	ErrNoRefreshToken = errors.New("oauth token expired and provider issued no refresh token; sign in again")
+)
+
+// TokenStore keeps each user's latest OAuth token in Redis, sealed with
+// AES-GCM under a key derived from the session secret.
+type TokenStore struct {
+	redis *redis.Client
+	aead  cipher.AEAD
+}
+
+type storedToken struct {
+	Provider Provider      `json:"provider"`
+	Token    *oauth2.Token `json:"token"`
+}
+
+func NewTokenStore(redisClient *redis.Client, secret string) (*TokenStore, error) {
+	key := sha256.Sum256([]byte("oauth-token:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenStore{redis: redisClient, aead: aead}, nil
+}
+
+// Save stores token for email. Providers such as Google send a refresh token
+// only on first consent, so a token without one keeps the refresh token
+// already stored for the same provider.
+func (t *TokenStore) Save(ctx context.Context, email string, provider Provider, token *oauth2.Token) error {
+	if token.RefreshToken == "" {
+		if previousProvider, previous, err := t.Load(ctx, email); err == nil && previousProvider == provider && previous.RefreshToken != "" {
+			withRefresh := *token
+			withRefresh.RefreshToken = previous.RefreshToken
+			token = &withRefresh
+		}
+	}
+	plain, err := json.Marshal(storedToken{Provider: provider, Token: token})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := t.aead.Seal(nonce, nonce, plain, []byte(email))
+	return t.redis.Set(ctx, tokenKey(email), sealed, 0).Err()
+}
+
+func (t *TokenStore) Load(ctx context.Context, email string) (Provider, *oauth2.Token, error) {
+	sealed, err := t.redis.Get(ctx, tokenKey(email)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return "", nil, ErrNoToken
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	size := t.aead.NonceSize()
+	if len(sealed) < size {
+		return "", nil, fmt.Errorf("stored oauth token is corrupt")
+	}
+	plain, err := t.aead.Open(nil, sealed[:size], sealed[size:], []byte(email))
+	if err != nil {
+		return "", nil, fmt.Errorf("decrypt oauth token: %w", err)
+	}
+	var stored storedToken
+	if err := json.Unmarshal(plain, &stored); err != nil {
+		return "", nil, fmt.Errorf("decode oauth token: %w", err)
+	}
+	if stored.Token == nil {
+		return "", nil, ErrNoToken
+	}
+	return stored.Provider, stored.Token, nil
+}
+
+func (t *TokenStore) Delete(ctx context.Context, email string) error {
+	return t.redis.Del(ctx, tokenKey(email)).Err()
+}
+
+// SaveToken remembers the token a user signed in with. It is a no-op when no
+// token store is configured.
+func (s *Service) SaveToken(ctx context.Context, email string, provider Provider, token *oauth2.Token) error {
+	if s.Tokens == nil || token == nil {
+		return nil
+	}
+	return s.Tokens.Save(ctx, email, provider, token)
+}
+
+// Client returns an HTTP client authorized as the user with the provider they
+// signed in with. Expired tokens are refreshed and the new token persisted.
+func (s *Service) Client(ctx context.Context, email string) (*http.Client, error) {
+	if s.Tokens == nil {
+		return nil, ErrNoToken
+	}
+	provider, token, err := s.Tokens.Load(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid() && token.RefreshToken == "" {
+		return nil, fmt.Errorf("%s: %w", provider, ErrNoRefreshToken)
+	}
+	cfg, err := s.oauthConfig(ctx, provider)
+	if err != nil {
+		return nil, err
+	}
+	source := &persistingTokenSource{
+		base:     oauth2.ReuseTokenSource(token, cfg.TokenSource(ctx, token)),
+		store:    s.Tokens,
+		ctx:      ctx,
+		email:    email,
+		provider: provider,
+		last:     token.AccessToken,
+	}
+	return oauth2.NewClient(ctx, source), nil
+}
+
+func (s *Service) oauthConfig(ctx context.Context, provider Provider) (*oauth2.Config, error) {
+	if !s.Enabled(provider) {
+		return nil, fmt.Errorf("%s not configured", provider)
+	}
+	switch provider {
+	case ProviderGoogle:
+		return s.GoogleConfig, nil
+	case ProviderGitHub:
+		return s.GitHubConfig, nil
+	case ProviderGitLab:
+		return s.GitLabConfig, nil
+	case ProviderMicrosoft:
+		return s.MicrosoftConfig, nil
+	case ProviderOIDC:
+		cfg, _, err := s.oidc.config(ctx)
+		return cfg, err
+	default:
+		return nil, fmt.Errorf("unsupported provider")
+	}
+}
+
+type persistingTokenSource struct {
+	base     oauth2.TokenSource
+	store    *TokenStore
+	ctx      context.Context
+	email    string
+	provider Provider
+	mu       sync.Mutex
+	last     string
+}
+
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := p.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if token.AccessToken != p.last {
+		p.last = token.AccessToken
+		if err := p.store.Save(p.ctx, p.email, p.provider, token); err != nil {
+			return nil, fmt.Errorf("persist refreshed token: %w", err)
+		}
+	}
+	return token, nil
+}
+
+func tokenKey(email string) string {
+	return store.Key("oauthtoken", email)
+}
@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+var ErrInvalidConfirmation = errors.New("invalid or expired confirmation token")
+
+const deleteConfirmationTTL = 5 * time.Minute
+
+// DeleteConfirmation is a single-use token the user must send back to wipe
+// their chats, along with how many chats that would remove.
+type DeleteConfirmation struct {
+	Token     string    `json:"token"`
+	Chats     int64     `json:"chats"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// IssueDeleteConfirmation replaces any earlier token for the user.
+func (s *Service) IssueDeleteConfirmation(ctx context.Context, userEmail string) (DeleteConfirmation, error) {
+	confirmation := DeleteConfirmation{
+		Token:     uuid.NewString(),
+		ExpiresAt: time.Now().UTC().Add(deleteConfirmationTTL),
+	}
+	pipe := s.Redis.TxPipeline()
+	pipe.Set(ctx, deleteConfirmationKey(userEmail), confirmation.Token, deleteConfirmationTTL)
+	count := pipe.LLen(ctx, userChatsKey(userEmail))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return DeleteConfirmation{}, err
+	}
+	confirmation.Chats = count.Val()
+	return confirmation, nil
+}
+
+// ConsumeDeleteConfirmation checks token against the one issued to the user
+// and spends it, whether or not it matched.
+func (s *Service) ConsumeDeleteConfirmation(ctx context.Context, userEmail, token string) error {
+	expected, err := s.Redis.GetDel(ctx, deleteConfirmationKey(userEmail)).Result()
+	if errors.Is(err, redis.Nil) {
+		return ErrInvalidConfirmation
+	}
+	if err != nil {
+		return err
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		return ErrInvalidConfirmation
+	}
+	return nil
+}
+
+// DeleteAllChats deletes every chat on the user's list and resets their
+// lifetime usage counters. Only chats the user owns lose their keys; the
+// monthly quota counters are kept so a wipe cannot reset a quota. Chats
+// created while the wipe runs survive it.
+func (s *Service) DeleteAllChats(ctx context.Context, userEmail string) (int, error) {
+	chatIDs, err := s.Redis.LRange(ctx, userChatsKey(userEmail), 0, -1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+	owners := make([]*redis.StringCmd, len(chatIDs))
+	if len(chatIDs) > 0 {
+		pipe := s.Redis.Pipeline()
+		for i, chatID := range chatIDs {
+			owners[i] = pipe.Get(ctx, chatOwnerKey(chatID))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return 0, err
+		}
+	}
+	deleted := 0
+	pipe := s.Redis.TxPipeline()
+	for i, chatID := range chatIDs {
+		if owners[i].Val() == userEmail {
+			deleteChatKeys(ctx, pipe, chatID)
+			deleted++
+		}
+		pipe.LRem(ctx, userChatsKey(userEmail), 0, chatID)
+	}
+	pipe.Del(ctx, userUsageKey(userEmail), userModelUsageKey(userEmail))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func deleteConfirmationKey(email string) string {
+	return store.Key("deleteconfirm", email)
+}
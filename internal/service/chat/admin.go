@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type UserStats struct {
+	Email       string     `json:"email"`
+	Chats       int64      `json:"chats"`
+	LastUpdated *time.Time `json:"lastUpdated,omitempty"`
+}
+
+type UserPage struct {
+	Users      []UserStats `json:"users"`
+	NextCursor uint64      `json:"nextCursor"`
+}
+
+// ListUsers walks the userchats keys with SCAN so a large keyspace never
+// blocks Redis. A NextCursor of 0 means the walk is complete; limit is a hint
+// and a page may hold slightly more or fewer users.
+func (s *Service) ListUsers(ctx context.Context, cursor uint64, limit int) (UserPage, error) {
+	if limit < MinPageLimit || limit > MaxPageLimit {
+		return UserPage{}, ErrInvalidPage
+	}
+	keys, next, err := s.Redis.Scan(ctx, cursor, userChatsKey("*"), int64(limit)).Result()
+	if err != nil {
+		return UserPage{}, err
+	}
+	page := UserPage{Users: make([]UserStats, 0, len(keys)), NextCursor: next}
+	if len(keys) == 0 {
+		return page, nil
+	}
+	pipe := s.Redis.Pipeline()
+	counts := make([]*redis.IntCmd, len(keys))
+	latest := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		counts[i] = pipe.LLen(ctx, key)
+		latest[i] = pipe.LIndex(ctx, key, 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return UserPage{}, err
+	}
+	for i, key := range keys {
+		stats := UserStats{Email: strings.TrimPrefix(key, userChatsKey("")), Chats: counts[i].Val()}
+		if chatID := latest[i].Val(); chatID != "" {
+			if data, err := s.Redis.Get(ctx, chatMetaKey(chatID)).Result(); err == nil {
+				var summary ChatSummary
+				if json.Unmarshal([]byte(data), &summary) == nil {
+					stats.LastUpdated = &summary.UpdatedAt
+				}
+			}
+		}
+		page.Users = append(page.Users, stats)
+	}
+	return page, nil
+}
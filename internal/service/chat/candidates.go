@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/service/openai"
+	"robertomachorro/smartchat/internal/store"
+)
+
+// MaxCandidates caps how many alternative replies one request may ask for.
+const MaxCandidates = 5
+
+const candidatesTTL = 30 * time.Minute
+
+var (
+	ErrInvalidCandidates = fmt.Errorf("n must be between 1 and %d", MaxCandidates)
+	ErrNoCandidate       = errors.New("candidate not found or no longer current")
+)
+
+// candidateSet holds replies waiting for the user to pick one. Length and
+// Last (a hash of the last message) stamp the chat as it was when they were
+// generated; any change to the chat since then makes them stale. Edits,
+// deletions and clears also drop the set outright.
+type candidateSet struct {
+	Model    string    `json:"model"`
+	Length   int64     `json:"length"`
+	Last     string    `json:"last"`
+	Messages []Message `json:"messages"`
+	// Raw holds each candidate's text before redaction, empty where no
+	// rule changed it.
+	Raw []string `json:"raw,omitempty"`
+}
+
+// RunCandidates asks the model for n alternative replies to the chat as it
+// stands. Nothing is added to the history until ChooseCandidate persists one,
+// but the tokens are billed now since every alternative cost them. Tools are
+// left out, as a candidate that calls one could not be followed up.
+func (s *Service) RunCandidates(ctx context.Context, userEmail, chatID string, prefs Preferences, n int) ([]Message, openai.Usage, error) {
+	if n < 2 || n > MaxCandidates {
+		return nil, openai.Usage{}, ErrInvalidCandidates
+	}
+	prefs.Model = s.backendModel(prefs.Model)
+	aiMessages, options, err := s.completionRequest(ctx, userEmail, chatID, prefs)
+	if err != nil {
+		return nil, openai.Usage{}, err
+	}
+	options.N = n
+	options.Tools = nil
+	completionCtx, cancel := s.completionContext(ctx)
+	defer cancel()
+	choices, usage, err := s.chatCompletions(completionCtx, prefs.Model, aiMessages, options)
+	if err := s.checkModel(ctx, prefs.Model, err); err != nil {
+		return nil, openai.Usage{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, openai.Usage{}, err
+	}
+	length, last, err := s.historyStamp(ctx, chatID)
+	if err != nil {
+		return nil, openai.Usage{}, err
+	}
+	set := candidateSet{Model: prefs.Model, Length: length, Last: last, Messages: make([]Message, 0, len(choices))}
+	now := time.Now().UTC()
+	for _, choice := range choices {
+		content, raw := s.redactReply(choice.Content)
+		if raw != "" && s.KeepRawReplies && set.Raw == nil {
+			set.Raw = make([]string, len(choices))
+		}
+		if set.Raw != nil {
+			set.Raw[len(set.Messages)] = raw
+		}
+		set.Messages = append(set.Messages, Message{
+			Role:              choice.Role,
+			Content:           content,
+			SystemFingerprint: choice.SystemFingerprint,
+			Format:            replyFormat(options),
+			CreatedAt:         now,
+		})
+	}
+	payload, err := json.Marshal(set)
+	if err != nil {
+		return nil, openai.Usage{}, err
+	}
+	pipe := s.Redis.TxPipeline()
+	pipe.Set(ctx, chatCandidatesKey(chatID), payload, candidatesTTL)
+	s.recordUsage(ctx, pipe, userEmail, chatID, prefs.Model, usage)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, openai.Usage{}, err
+	}
+	s.publishCompletion(userEmail, chatID, prefs.Model, usage)
+	return set.Messages, usage, nil
+}
+
+// ChooseCandidate stores the candidate at index as the assistant's reply and
+// discards the others.
+func (s *Service) ChooseCandidate(ctx context.Context, userEmail, chatID string, index int) (Message, error) {
+	if err := s.authorize(ctx, userEmail, chatID); err != nil {
+		return Message{}, err
+	}
+	key := chatCandidatesKey(chatID)
+	payload, err := s.Redis.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return Message{}, ErrNoCandidate
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	var set candidateSet
+	if err := json.Unmarshal([]byte(payload), &set); err != nil {
+		return Message{}, err
+	}
+	length, last, err := s.historyStamp(ctx, chatID)
+	if err != nil {
+		return Message{}, err
+	}
+	if length != set.Length || last != set.Last || index < 0 || index >= len(set.Messages) {
+		return Message{}, ErrNoCandidate
+	}
+	var raw string
+	if index < len(set.Raw) {
+		raw = set.Raw[index]
+	}
+	stored, err := s.storeReply(ctx, userEmail, chatID, set.Model, set.Messages[index], raw, openai.Usage{})
+	if err != nil {
+		return Message{}, err
+	}
+	if err := s.Redis.Del(ctx, key).Err(); err != nil {
+		return Message{}, err
+	}
+	return stored, nil
+}
+
+// historyStamp returns the chat's message count and a hash of its last
+// message, which together tell whether the history has moved on.
+func (s *Service) historyStamp(ctx context.Context, chatID string) (int64, string, error) {
+	pipe := s.Redis.Pipeline()
+	length := pipe.LLen(ctx, chatMessagesKey(chatID))
+	last := pipe.LIndex(ctx, chatMessagesKey(chatID), -1)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return 0, "", err
+	}
+	sum := sha256.Sum256([]byte(last.Val()))
+	return length.Val(), hex.EncodeToString(sum[:]), nil
+}
+
+func chatCandidatesKey(chatID string) string {
+	return store.Key("chatcandidates", chatID)
+}
@@ -5,133 +5,670 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 
 	"robertomachorro/smartchat/internal/service/openai"
+	"robertomachorro/smartchat/internal/store"
 )
 
+const (
+	MaxTitleRunes        = 120
+	MaxSystemPromptRunes = 4000
+	MaxStopSequences     = 4
+	maxStopSequenceRunes = 64
+)
+
+var (
+	ErrChatNotFound        = errors.New("chat not found")
+	ErrNotAuthorized       = errors.New("not authorized for this chat")
+	ErrEmptyTitle          = errors.New("empty title")
+	ErrSystemPromptTooLong = errors.New("system prompt too long")
+	ErrNothingToRegenerate = errors.New("no user message to answer")
+	ErrInvalidStop         = errors.New("invalid stop sequences")
+	ErrJSONModeUnsupported = errors.New("model does not support JSON mode")
+	ErrMessageTooLong      = errors.New("message too long")
+	ErrModelUnavailable    = errors.New("model not available on the backend")
+	ErrInvalidRole         = errors.New("role must be user, assistant or system")
+)
+
+// appendableRoles may be stored through AppendMessage. Tool messages are
+// left out since they only make sense answering a stored tool call.
+var appendableRoles = map[string]bool{"user": true, "assistant": true, "system": true}
+
+// FormatJSON marks assistant replies produced in JSON mode.
+const FormatJSON = "json"
+
 type Service struct {
-	Redis *redis.Client
-	AI    *openai.Client
+	Redis              *redis.Client
+	AI                 *openai.Client
+	MaxContextMessages int
+	MaxContextTokens   int
+	MaxChatsPerUser    int
+	MessagesPerMinute  int
+	MaxMessageChars    int
+	// MaxMessagesPerChat caps a chat's history. Once reached, new messages
+	// are refused, or with TrimOldMessages the oldest ones are dropped.
+	MaxMessagesPerChat int
+	TrimOldMessages    bool
+	// MonthlyTokenQuota and MonthlyCostQuotaMicros cap each user's usage
+	// per calendar month; zero leaves a quota off.
+	MonthlyTokenQuota      int
+	MonthlyCostQuotaMicros int64
+	// DefaultSystemPrompt seeds new chats and stands in for chats whose own
+	// prompt is empty. A chat-level prompt always wins.
+	DefaultSystemPrompt string
+	// SafetyPrompt is sent as the first system message of every completion,
+	// ahead of the chat's prompt. Users never see or edit it.
+	SafetyPrompt string
+	// Redactions rewrite assistant replies, in order, before they are
+	// stored or streamed; KeepRawReplies saves the original of any reply they changed.
+	Redactions     []Redaction
+	KeepRawReplies bool
+	// WelcomeMessage, when set, opens every new or cleared chat as an
+	// assistant message. It is left out of completions unless
+	// WelcomeInContext is set.
+	WelcomeMessage   string
+	WelcomeInContext bool
+	// TitleMaxRunes bounds titles taken from a chat's first message (32
+	// when unset); TitleModel, if set, replaces them with a generated one.
+	TitleMaxRunes     int
+	TitleModel        string
+	CompletionTimeout time.Duration
+	ChatTTL           time.Duration
+	Models            []string
+	DiscoverModels    bool
+	ModelCooldown     time.Duration
+	JSONModeModels    []string
+	VisionModels      []string
+	LegacyModels      []string
+	Pricing           map[string]ModelPrice
+	ModelAliases      map[string]string
+	BlockedModels     []string
+	SearchIndex       SearchIndex
+	Events            EventSink
+	modelClients      map[string]*openai.Client
+	modelCache        modelCache
+	modelFailures     modelFailures
+	backendCheck      backendCheck
+	storeHealth       storeHealth
+	tools             []registeredTool
 }
 
 type ChatSummary struct {
-	ID        string    `json:"id"`
-	Title     string    `json:"title"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	SystemPrompt string    `json:"systemPrompt,omitempty"`
+	Stop         []string  `json:"stop,omitempty"`
+	JSONMode     bool      `json:"jsonMode,omitempty"`
+	Pinned       bool      `json:"pinned,omitempty"`
+	Archived     bool      `json:"archived,omitempty"`
+	UpdatedAt    time.Time `json:"updatedAt"`
 }
 
 type Message struct {
-	Role      string    `json:"role"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"createdAt"`
+	Role       string            `json:"role"`
+	Content    string            `json:"content"`
+	ToolCalls  []openai.ToolCall `json:"toolCalls,omitempty"`
+	ToolCallID string            `json:"toolCallId,omitempty"`
+	Images     []ImageRef        `json:"images,omitempty"`
+	// SystemFingerprint identifies the backend configuration that produced
+	// an assistant reply, for checking seeded runs are reproducible.
+	SystemFingerprint string    `json:"systemFingerprint,omitempty"`
+	Format            string    `json:"format,omitempty"`
+	Greeting          bool      `json:"greeting,omitempty"`
+	CreatedAt         time.Time `json:"createdAt"`
+}
+
+// hiddenRoles are sent to the model but never drawn as chat bubbles.
+var hiddenRoles = map[string]bool{"system": true, "tool": true}
+
+// Displayable reports whether the message belongs in the conversation the
+// user sees. Tool results and assistant turns that only request tools are
+// plumbing for the model.
+func (m Message) Displayable() bool {
+	if hiddenRoles[m.Role] {
+		return false
+	}
+	return len(m.ToolCalls) == 0 || strings.TrimSpace(m.Content) != ""
 }
 
 type ChatView struct {
 	Summary  ChatSummary
 	Messages []Message
+	Start    int
+	Total    int
+}
+
+func (v ChatView) HasEarlier() bool {
+	return v.Start > 0
+}
+
+// Displayable is the subset of Messages to render; completions still use
+// the full history.
+func (v ChatView) Displayable() []Message {
+	shown := make([]Message, 0, len(v.Messages))
+	for _, message := range v.Messages {
+		if message.Displayable() {
+			shown = append(shown, message)
+		}
+	}
+	return shown
 }
 
 func NewService(redisClient *redis.Client, aiClient *openai.Client) *Service {
 	return &Service{Redis: redisClient, AI: aiClient}
 }
 
+// RouteModel sends completions for model to client instead of the default AI client.
+func (s *Service) RouteModel(model string, client *openai.Client) {
+	if s.modelClients == nil {
+		s.modelClients = make(map[string]*openai.Client)
+	}
+	s.modelClients[model] = client
+}
+
+func (s *Service) clientFor(model string) *openai.Client {
+	if client, ok := s.modelClients[model]; ok {
+		return client
+	}
+	return s.AI
+}
+
 func (s *Service) EnsureChat(ctx context.Context, userEmail string) (ChatSummary, error) {
-	summaries, err := s.ListChats(ctx, userEmail)
+	page, err := s.ListChats(ctx, userEmail, false, 0, 1)
 	if err != nil {
 		return ChatSummary{}, err
 	}
-	if len(summaries) > 0 {
-		return summaries[0], nil
+	if len(page.Chats) > 0 {
+		return page.Chats[0], nil
 	}
-	return s.NewChat(ctx, userEmail, "New chat")
+	summary, _, err := s.NewChat(ctx, userEmail, "New chat")
+	return summary, err
 }
 
-func (s *Service) NewChat(ctx context.Context, userEmail, title string) (ChatSummary, error) {
+// NewChat creates a chat and, when MaxChatsPerUser is set, evicts the oldest
+// chats beyond the cap. The evicted chat ids are returned for logging.
+func (s *Service) NewChat(ctx context.Context, userEmail, title string) (ChatSummary, []string, error) {
+	summary, err := s.NewPendingChat(ctx, userEmail, title)
+	if err != nil {
+		return ChatSummary{}, nil, err
+	}
+	evicted, err := s.EvictOldChats(ctx, userEmail)
+	if err != nil {
+		return ChatSummary{}, nil, err
+	}
+	return summary, evicted, nil
+}
+
+// NewPendingChat creates a chat like NewChat but evicts nothing, for callers
+// that may still delete it again; they call EvictOldChats once it is kept.
+func (s *Service) NewPendingChat(ctx context.Context, userEmail, title string) (ChatSummary, error) {
 	chatID := uuid.NewString()
 	if strings.TrimSpace(title) == "" {
 		title = "New chat"
 	}
 	summary := ChatSummary{
-		ID:        chatID,
-		Title:     title,
-		UpdatedAt: time.Now().UTC(),
+		ID:           chatID,
+		Title:        title,
+		SystemPrompt: s.DefaultSystemPrompt,
+		UpdatedAt:    time.Now().UTC(),
 	}
-	if err := s.saveChatMeta(ctx, userEmail, summary); err != nil {
+	pipe := s.Redis.TxPipeline()
+	if err := s.queueGreeting(ctx, pipe, chatID); err != nil {
+		return ChatSummary{}, err
+	}
+	if err := s.queueChatMeta(ctx, pipe, userEmail, summary); err != nil {
+		return ChatSummary{}, err
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
 		return ChatSummary{}, err
 	}
 	return summary, nil
 }
 
-func (s *Service) ListChats(ctx context.Context, userEmail string) ([]ChatSummary, error) {
-	ids, err := s.Redis.LRange(ctx, userChatsKey(userEmail), 0, 19).Result()
+// queueGreeting adds WelcomeMessage to an empty chat's history, marked as a
+// Greeting so it never counts as the chat's first reply. It must be
+// queued before the chat's metadata so the history picks up ChatTTL.
+func (s *Service) queueGreeting(ctx context.Context, pipe redis.Pipeliner, chatID string) error {
+	if s.WelcomeMessage == "" {
+		return nil
+	}
+	payload, err := json.Marshal(Message{
+		Role:      "assistant",
+		Content:   s.WelcomeMessage,
+		Greeting:  true,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	pipe.RPush(ctx, chatMessagesKey(chatID), payload)
+	return nil
+}
+
+// EvictOldChats deletes the user's oldest chats beyond MaxChatsPerUser and
+// returns their ids.
+func (s *Service) EvictOldChats(ctx context.Context, userEmail string) ([]string, error) {
+	if s.MaxChatsPerUser <= 0 {
+		return nil, nil
+	}
+	evicted, err := s.Redis.LRange(ctx, userChatsKey(userEmail), int64(s.MaxChatsPerUser), -1).Result()
 	if err != nil && !errors.Is(err, redis.Nil) {
 		return nil, err
 	}
-	if len(ids) == 0 {
+	if len(evicted) == 0 {
 		return nil, nil
 	}
-	summaries := make([]ChatSummary, 0, len(ids))
+	pipe := s.Redis.TxPipeline()
+	pipe.LTrim(ctx, userChatsKey(userEmail), 0, int64(s.MaxChatsPerUser-1))
+	for _, chatID := range evicted {
+		deleteChatKeys(ctx, pipe, chatID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return evicted, nil
+}
+
+// VerifyChat reports ErrChatNotFound unless the chat exists and belongs to
+// the user.
+func (s *Service) VerifyChat(ctx context.Context, userEmail, chatID string) error {
+	ok, err := s.verifyOwner(ctx, userEmail, chatID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrChatNotFound
+	}
+	return nil
+}
+
+// pruneChatList drops ids whose chat has expired from the user's list in
+// one round trip. It runs inside a read, so a failure is only logged and
+// the ids are tried again on the next listing.
+func (s *Service) pruneChatList(ctx context.Context, userEmail string, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	pipe := s.Redis.Pipeline()
 	for _, id := range ids {
-		data, err := s.Redis.Get(ctx, chatMetaKey(id)).Result()
-		if err != nil {
+		pipe.LRem(ctx, userChatsKey(userEmail), 0, id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.WarnContext(ctx, "prune chat list", "user", userEmail, "count", len(ids), "error", s.writeStore(err))
+	}
+}
+
+// ListChats returns one page of chats, pinned ones first and each group by
+// recency. Archived chats are left out unless includeArchived is set.
+func (s *Service) ListChats(ctx context.Context, userEmail string, includeArchived bool, offset, limit int) (ChatPage, error) {
+	if offset < 0 || limit < MinPageLimit || limit > MaxPageLimit {
+		return ChatPage{}, ErrInvalidPage
+	}
+	page := ChatPage{Chats: []ChatSummary{}, Offset: offset, Limit: limit}
+	var ids []string
+	err := s.readStore(ctx, func() (err error) {
+		ids, err = s.Redis.LRange(ctx, userChatsKey(userEmail), 0, -1).Result()
+		return err
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return ChatPage{}, err
+	}
+	if len(ids) == 0 {
+		return page, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = chatMetaKey(id)
+	}
+	var values []any
+	err = s.readStore(ctx, func() (err error) {
+		values, err = s.Redis.MGet(ctx, keys...).Result()
+		return err
+	})
+	if err != nil {
+		return ChatPage{}, err
+	}
+	summaries := make([]ChatSummary, 0, len(ids))
+	var stale []string
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			stale = append(stale, ids[i])
 			continue
 		}
 		var summary ChatSummary
 		if err := json.Unmarshal([]byte(data), &summary); err != nil {
 			continue
 		}
+		if summary.Archived && !includeArchived {
+			continue
+		}
 		summaries = append(summaries, summary)
 	}
-	return summaries, nil
+	s.pruneChatList(ctx, userEmail, stale)
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Pinned && !summaries[j].Pinned
+	})
+	page.Total = len(summaries)
+	if offset >= page.Total {
+		return page, nil
+	}
+	end := min(offset+limit, page.Total)
+	page.Chats = summaries[offset:end]
+	page.HasMore = end < page.Total
+	return page, nil
 }
 
-func (s *Service) GetChat(ctx context.Context, userEmail, chatID string) (ChatView, error) {
+// SetPinned and SetArchived change how a chat is listed without moving it
+// in the recency order.
+func (s *Service) SetPinned(ctx context.Context, userEmail, chatID string, pinned bool) (ChatSummary, error) {
+	return s.updateListing(ctx, userEmail, chatID, func(summary *ChatSummary) {
+		summary.Pinned = pinned
+	})
+}
+
+func (s *Service) SetArchived(ctx context.Context, userEmail, chatID string, archived bool) (ChatSummary, error) {
+	return s.updateListing(ctx, userEmail, chatID, func(summary *ChatSummary) {
+		summary.Archived = archived
+	})
+}
+
+func (s *Service) updateListing(ctx context.Context, userEmail, chatID string, update func(*ChatSummary)) (ChatSummary, error) {
 	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
-		return ChatView{}, err
+		return ChatSummary{}, err
 	} else if !ok {
-		return ChatView{}, fmt.Errorf("not authorized")
+		return ChatSummary{}, ErrChatNotFound
 	}
-
-	metaData, err := s.Redis.Get(ctx, chatMetaKey(chatID)).Result()
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return ChatSummary{}, err
+	}
+	update(&summary)
+	payload, err := json.Marshal(summary)
 	if err != nil {
+		return ChatSummary{}, err
+	}
+	// The listing change counts as activity, so every key of the chat gets
+	// a fresh TTL together, as queueChatMeta does, without moving it up the
+	// user's list.
+	pipe := s.Redis.TxPipeline()
+	pipe.Set(ctx, chatMetaKey(chatID), payload, s.ChatTTL)
+	if s.ChatTTL > 0 {
+		pipe.Expire(ctx, chatOwnerKey(chatID), s.ChatTTL)
+	}
+	s.queueChatExpiry(ctx, pipe, chatID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return ChatSummary{}, err
+	}
+	return summary, nil
+}
+
+func (s *Service) GetChat(ctx context.Context, userEmail, chatID string, latest int) (ChatView, error) {
+	if err := s.authorize(ctx, userEmail, chatID); err != nil {
 		return ChatView{}, err
 	}
-	var summary ChatSummary
-	if err := json.Unmarshal([]byte(metaData), &summary); err != nil {
+
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
 		return ChatView{}, err
 	}
-	messages, err := s.fetchMessages(ctx, chatID)
+	if latest <= 0 {
+		messages, err := s.fetchMessages(ctx, chatID)
+		if err != nil {
+			return ChatView{}, err
+		}
+		return ChatView{Summary: summary, Messages: messages, Total: len(messages)}, nil
+	}
+	page, err := s.readPage(ctx, chatID, 0, latest)
 	if err != nil {
 		return ChatView{}, err
 	}
-	return ChatView{Summary: summary, Messages: messages}, nil
+	return ChatView{Summary: summary, Messages: page.Messages, Start: page.Start, Total: page.Total}, nil
+}
+
+// GetSummary returns a chat's metadata without touching its messages.
+func (s *Service) GetSummary(ctx context.Context, userEmail, chatID string) (ChatSummary, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return ChatSummary{}, err
+	} else if !ok {
+		return ChatSummary{}, ErrChatNotFound
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if errors.Is(err, redis.Nil) {
+		return ChatSummary{}, ErrChatNotFound
+	}
+	return summary, err
 }
 
 func (s *Service) DeleteChat(ctx context.Context, userEmail, chatID string) error {
 	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
 		return err
 	} else if !ok {
-		return fmt.Errorf("not authorized")
+		return ErrChatNotFound
 	}
 	pipe := s.Redis.TxPipeline()
-	pipe.Del(ctx, chatMetaKey(chatID))
-	pipe.Del(ctx, chatMessagesKey(chatID))
-	pipe.Del(ctx, chatOwnerKey(chatID))
+	deleteChatKeys(ctx, pipe, chatID)
 	pipe.LRem(ctx, userChatsKey(userEmail), 0, chatID)
 	_, err := pipe.Exec(ctx)
 	return err
 }
 
-func (s *Service) AppendMessage(ctx context.Context, userEmail, chatID, role, content string) (Message, error) {
+func deleteChatKeys(ctx context.Context, pipe redis.Pipeliner, chatID string) {
+	pipe.Del(ctx, chatMetaKey(chatID), chatMessagesKey(chatID), chatOwnerKey(chatID), chatUsageKey(chatID), chatImagesKey(chatID), chatCandidatesKey(chatID), chatRawRepliesKey(chatID))
+}
+
+func (s *Service) RenameChat(ctx context.Context, userEmail, chatID, newTitle string) (ChatSummary, error) {
+	title := normalizeTitle(newTitle)
+	if title == "" {
+		return ChatSummary{}, ErrEmptyTitle
+	}
 	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
-		return Message{}, err
+		return ChatSummary{}, err
+	} else if !ok {
+		return ChatSummary{}, ErrChatNotFound
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return ChatSummary{}, err
+	}
+	summary.Title = title
+	summary.UpdatedAt = time.Now().UTC()
+	if err := s.saveChatMeta(ctx, userEmail, summary); err != nil {
+		return ChatSummary{}, err
+	}
+	return summary, nil
+}
+
+func (s *Service) SetSystemPrompt(ctx context.Context, userEmail, chatID, prompt string) (ChatSummary, error) {
+	prompt = strings.TrimSpace(prompt)
+	if utf8.RuneCountInString(prompt) > MaxSystemPromptRunes {
+		return ChatSummary{}, ErrSystemPromptTooLong
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return ChatSummary{}, err
+	} else if !ok {
+		return ChatSummary{}, ErrChatNotFound
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return ChatSummary{}, err
+	}
+	summary.SystemPrompt = prompt
+	summary.UpdatedAt = time.Now().UTC()
+	if err := s.saveChatMeta(ctx, userEmail, summary); err != nil {
+		return ChatSummary{}, err
+	}
+	return summary, nil
+}
+
+// SetStopSequences replaces the strings that end generation in this chat.
+// Empty entries are dropped; an empty list clears them.
+func (s *Service) SetStopSequences(ctx context.Context, userEmail, chatID string, stop []string) (ChatSummary, error) {
+	cleaned := make([]string, 0, len(stop))
+	for _, sequence := range stop {
+		if sequence == "" {
+			continue
+		}
+		if utf8.RuneCountInString(sequence) > maxStopSequenceRunes {
+			return ChatSummary{}, fmt.Errorf("%w: each must be at most %d characters", ErrInvalidStop, maxStopSequenceRunes)
+		}
+		cleaned = append(cleaned, sequence)
+	}
+	if len(cleaned) > MaxStopSequences {
+		return ChatSummary{}, fmt.Errorf("%w: at most %d allowed", ErrInvalidStop, MaxStopSequences)
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return ChatSummary{}, err
+	} else if !ok {
+		return ChatSummary{}, ErrChatNotFound
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return ChatSummary{}, err
+	}
+	summary.Stop = nil
+	if len(cleaned) > 0 {
+		summary.Stop = cleaned
+	}
+	summary.UpdatedAt = time.Now().UTC()
+	if err := s.saveChatMeta(ctx, userEmail, summary); err != nil {
+		return ChatSummary{}, err
+	}
+	return summary, nil
+}
+
+// SetJSONMode toggles response_format json_object for this chat's replies.
+func (s *Service) SetJSONMode(ctx context.Context, userEmail, chatID string, enabled bool) (ChatSummary, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return ChatSummary{}, err
 	} else if !ok {
-		return Message{}, fmt.Errorf("not authorized")
+		return ChatSummary{}, ErrChatNotFound
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return ChatSummary{}, err
+	}
+	summary.JSONMode = enabled
+	summary.UpdatedAt = time.Now().UTC()
+	if err := s.saveChatMeta(ctx, userEmail, summary); err != nil {
+		return ChatSummary{}, err
+	}
+	return summary, nil
+}
+
+// supportsJSONMode reports whether model may be sent response_format. An
+// empty JSONModeModels list trusts every model but the legacy ones, whose
+// endpoint has no response_format.
+func (s *Service) supportsJSONMode(model string) bool {
+	if s.usesLegacyCompletions(model) {
+		return false
+	}
+	if len(s.JSONModeModels) == 0 {
+		return true
+	}
+	for _, allowed := range s.JSONModeModels {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLength enforces MaxMessageChars on user-written content.
+func (s *Service) checkLength(content string) error {
+	if s.MaxMessageChars > 0 && utf8.RuneCountInString(content) > s.MaxMessageChars {
+		return fmt.Errorf("%w: the limit is %d characters", ErrMessageTooLong, s.MaxMessageChars)
+	}
+	return nil
+}
+
+// checkRoom refuses a new message when MaxMessagesPerChat is enforced by
+// rejection and the chat lacks room for it and a reply. Replies and tool
+// results themselves are never refused, so an exchange is not cut in half.
+func (s *Service) checkRoom(ctx context.Context, chatID string) error {
+	if s.MaxMessagesPerChat <= 0 || s.TrimOldMessages {
+		return nil
+	}
+	length, err := s.Redis.LLen(ctx, chatMessagesKey(chatID)).Result()
+	if err != nil {
+		return err
+	}
+	if length+2 > int64(s.MaxMessagesPerChat) {
+		return fmt.Errorf("%w of %d; start a new chat or clear this one", ErrChatFull, s.MaxMessagesPerChat)
+	}
+	return nil
+}
+
+// trimMessages drops the oldest messages until the history is down to
+// ARGV[1], keeping system messages and the welcome greeting, then any tool
+// results left at the front without the assistant message that asked for
+// them, which a backend would reject.
+// Dropped entries are overwritten with a marker no JSON message can equal
+// and removed in one LREM, so the list keeps its TTL.
+var trimMessages = redis.NewScript(`
+local items = redis.call("LRANGE", KEYS[1], 0, -1)
+local excess = #items - tonumber(ARGV[1])
+if excess <= 0 then
+	return 0
+end
+local dropped = 0
+for i, item in ipairs(items) do
+	local ok, message = pcall(cjson.decode, item)
+	if not ok or type(message) ~= "table" then
+		message = {}
+	end
+	if message.role ~= "system" and message.greeting ~= true then
+		if excess <= 0 and message.role ~= "tool" then
+			break
+		end
+		redis.call("LSET", KEYS[1], i - 1, "trimmed")
+		excess = excess - 1
+		dropped = dropped + 1
+	end
+end
+if dropped > 0 then
+	redis.call("LREM", KEYS[1], 0, "trimmed")
+end
+return dropped`)
+
+// queueAppend adds messages to a chat's history and, with TrimOldMessages,
+// drops the oldest beyond MaxMessagesPerChat in the same transaction, as
+// trimMessages describes. The chat's system prompt lives in its metadata and
+// is never trimmed.
+func (s *Service) queueAppend(ctx context.Context, pipe redis.Pipeliner, chatID string, payloads ...any) {
+	key := chatMessagesKey(chatID)
+	pipe.RPush(ctx, key, payloads...)
+	if s.MaxMessagesPerChat > 0 && s.TrimOldMessages {
+		// EVALSHA cannot fall back to EVAL inside MULTI, so send the script.
+		trimMessages.Eval(ctx, pipe, []string{key}, s.MaxMessagesPerChat)
+	}
+}
+
+// AppendMessage stores a message without asking for a completion. Only user
+// messages can give a new chat its title.
+func (s *Service) AppendMessage(ctx context.Context, userEmail, chatID, role, content string) (Message, error) {
+	if !appendableRoles[role] {
+		return Message{}, ErrInvalidRole
+	}
+	if strings.TrimSpace(content) == "" {
+		return Message{}, ErrEmptyContent
+	}
+	if err := s.checkLength(content); err != nil {
+		return Message{}, err
+	}
+	if err := s.authorize(ctx, userEmail, chatID); err != nil {
+		return Message{}, err
+	}
+	if err := s.checkRoom(ctx, chatID); err != nil {
+		return Message{}, err
 	}
 	message := Message{
 		Role:      role,
@@ -142,53 +679,280 @@ func (s *Service) AppendMessage(ctx context.Context, userEmail, chatID, role, co
 	if err != nil {
 		return Message{}, err
 	}
-	if err := s.Redis.RPush(ctx, chatMessagesKey(chatID), payload).Err(); err != nil {
-		return Message{}, err
+	pipe := s.Redis.TxPipeline()
+	s.queueAppend(ctx, pipe, chatID, payload)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Message{}, s.writeStore(err)
+	}
+	titleSource := content
+	if role != "user" {
+		titleSource = ""
 	}
-	if err := s.touchChat(ctx, userEmail, chatID, content); err != nil {
+	if err := s.touchChat(ctx, userEmail, chatID, titleSource); err != nil {
 		return Message{}, err
 	}
 	return message, nil
 }
 
-func (s *Service) RunCompletion(ctx context.Context, userEmail, chatID, model string, temperature float64) (Message, openai.Usage, error) {
+func (s *Service) RunCompletion(ctx context.Context, userEmail, chatID string, prefs Preferences) (Message, openai.Usage, error) {
+	prefs.Model = s.backendModel(prefs.Model)
+	aiMessages, options, err := s.completionRequest(ctx, userEmail, chatID, prefs)
+	if err != nil {
+		return Message{}, openai.Usage{}, err
+	}
+	completionCtx, cancel := s.completionContext(ctx)
+	defer cancel()
+	response, usage, err := s.chatCompletion(completionCtx, prefs.Model, aiMessages, options)
+	if err := s.checkModel(ctx, prefs.Model, err); err != nil {
+		return Message{}, openai.Usage{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Message{}, openai.Usage{}, err
+	}
+	content, raw := s.redactReply(response.Content)
+	stored, err := s.storeReply(ctx, userEmail, chatID, prefs.Model, Message{
+		Role:              response.Role,
+		Content:           content,
+		ToolCalls:         response.ToolCalls,
+		SystemFingerprint: response.SystemFingerprint,
+		Format:            replyFormat(options),
+	}, raw, usage)
+	if err != nil {
+		return Message{}, openai.Usage{}, err
+	}
+	s.publishCompletion(userEmail, chatID, prefs.Model, usage)
+	return stored, usage, nil
+}
+
+// RegenerateLast drops any replies after the most recent user message and
+// runs a fresh completion against the remaining history.
+func (s *Service) RegenerateLast(ctx context.Context, userEmail, chatID string, prefs Preferences) (Message, openai.Usage, error) {
 	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
 		return Message{}, openai.Usage{}, err
 	} else if !ok {
-		return Message{}, openai.Usage{}, fmt.Errorf("not authorized")
+		return Message{}, openai.Usage{}, ErrChatNotFound
 	}
-	messages, err := s.fetchMessages(ctx, chatID)
-	if err != nil {
+	values, err := s.Redis.LRange(ctx, chatMessagesKey(chatID), 0, -1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
 		return Message{}, openai.Usage{}, err
 	}
-	aiMessages := make([]openai.Message, 0, len(messages))
-	for _, message := range messages {
-		aiMessages = append(aiMessages, openai.Message{Role: message.Role, Content: message.Content})
+	lastUser := -1
+	for i := len(values) - 1; i >= 0; i-- {
+		var message Message
+		if err := json.Unmarshal([]byte(values[i]), &message); err == nil && message.Role == "user" {
+			lastUser = i
+			break
+		}
+	}
+	if lastUser == -1 {
+		return Message{}, openai.Usage{}, ErrNothingToRegenerate
+	}
+	if lastUser < len(values)-1 {
+		if err := s.Redis.LTrim(ctx, chatMessagesKey(chatID), 0, int64(lastUser)).Err(); err != nil {
+			return Message{}, openai.Usage{}, err
+		}
+	}
+	return s.RunCompletion(ctx, userEmail, chatID, prefs)
+}
+
+func (s *Service) StreamCompletion(ctx context.Context, userEmail, chatID string, prefs Preferences, onDelta func(string) error) (Message, openai.Usage, error) {
+	prefs.Model = s.backendModel(prefs.Model)
+	if s.usesLegacyCompletions(prefs.Model) {
+		// Legacy completions are not streamed: the stored reply is delivered
+		// as a single delta, and a client that has gone finds it in the chat.
+		stored, usage, err := s.RunCompletion(ctx, userEmail, chatID, prefs)
+		if err != nil {
+			return Message{}, openai.Usage{}, err
+		}
+		_ = onDelta(stored.Content)
+		return stored, usage, nil
 	}
-	response, usage, err := s.AI.ChatCompletion(ctx, model, aiMessages, temperature)
+	aiMessages, options, err := s.completionRequest(ctx, userEmail, chatID, prefs)
 	if err != nil {
 		return Message{}, openai.Usage{}, err
 	}
-	stored := Message{
-		Role:      response.Role,
-		Content:   response.Content,
-		CreatedAt: time.Now().UTC(),
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := s.clientFor(prefs.Model).ChatCompletionStream(streamCtx, prefs.Model, aiMessages, options)
+	if err := s.checkModel(ctx, prefs.Model, err); err != nil {
+		return Message{}, openai.Usage{}, err
 	}
-	payload, err := json.Marshal(stored)
-	if err != nil {
+	buffer := s.startStreamBuffer(ctx, chatID)
+	defer buffer.finish(ctx)
+	redactor := s.newStreamRedactor()
+	var content strings.Builder
+	var deliveryErr error
+	deliver := func(delta string) {
+		if delta == "" {
+			return
+		}
+		buffer.append(ctx, delta)
+		if deliveryErr != nil {
+			return
+		}
+		if err := onDelta(delta); err != nil {
+			deliveryErr = err
+			cancel()
+		}
+	}
+	for delta := range stream.Deltas {
+		content.WriteString(delta)
+		deliver(redactor.next(content.String(), false))
+	}
+	if deliveryErr != nil {
+		return Message{}, openai.Usage{}, deliveryErr
+	}
+	if err := stream.Err(); err != nil {
 		return Message{}, openai.Usage{}, err
 	}
-	if err := s.Redis.RPush(ctx, chatMessagesKey(chatID), payload).Err(); err != nil {
+	if err := ctx.Err(); err != nil {
 		return Message{}, openai.Usage{}, err
 	}
-	if err := s.touchChat(ctx, userEmail, chatID, response.Content); err != nil {
+	// The tail is best effort: the reply is complete, so it is stored even
+	// if the client has gone.
+	deliver(redactor.next(content.String(), true))
+	usage := stream.Usage()
+	if usage == (openai.Usage{}) {
+		usage = estimateUsage(aiMessages, content.String())
+	}
+	reply, raw := s.redactReply(content.String())
+	stored, err := s.storeReply(ctx, userEmail, chatID, prefs.Model, Message{
+		Role:              stream.Role(),
+		Content:           reply,
+		ToolCalls:         stream.ToolCalls(),
+		SystemFingerprint: stream.SystemFingerprint(),
+		Format:            replyFormat(options),
+	}, raw, usage)
+	if err != nil {
 		return Message{}, openai.Usage{}, err
 	}
+	s.publishCompletion(userEmail, chatID, prefs.Model, usage)
 	return stored, usage, nil
 }
 
+// completionContext bounds a non-streamed completion by CompletionTimeout.
+// Streams are left unbounded and end when the backend finishes or the
+// caller's context is cancelled.
+func (s *Service) completionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.CompletionTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.CompletionTimeout)
+}
+
+// completionRequest builds the messages and options for a completion, with
+// the history trimmed to the context limits.
+func (s *Service) completionRequest(ctx context.Context, userEmail, chatID string, prefs Preferences) ([]openai.Message, openai.Options, error) {
+	messages, options, err := s.fullCompletionRequest(ctx, userEmail, chatID, prefs)
+	if err != nil {
+		return nil, openai.Options{}, err
+	}
+	return trimHistory(messages, s.MaxContextMessages, s.MaxContextTokens), options, nil
+}
+
+// fullCompletionRequest is completionRequest before trimming, so callers can
+// tell what the context limits leave out.
+func (s *Service) fullCompletionRequest(ctx context.Context, userEmail, chatID string, prefs Preferences) ([]openai.Message, openai.Options, error) {
+	if err := s.authorize(ctx, userEmail, chatID); err != nil {
+		return nil, openai.Options{}, err
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return nil, openai.Options{}, err
+	}
+	messages, err := s.fetchMessages(ctx, chatID)
+	if err != nil {
+		return nil, openai.Options{}, err
+	}
+	aiMessages := make([]openai.Message, 0, len(messages)+2)
+	if s.SafetyPrompt != "" {
+		aiMessages = append(aiMessages, openai.Message{Role: "system", Content: s.SafetyPrompt})
+	}
+	systemPrompt := summary.SystemPrompt
+	if systemPrompt == "" {
+		systemPrompt = s.DefaultSystemPrompt
+	}
+	if systemPrompt != "" {
+		aiMessages = append(aiMessages, openai.Message{Role: "system", Content: systemPrompt})
+	}
+	vision := s.SupportsVision(prefs.Model)
+	for _, message := range messages {
+		if message.Greeting && !s.WelcomeInContext {
+			continue
+		}
+		aiMessage := openai.Message{
+			Role:       message.Role,
+			Content:    message.Content,
+			ToolCalls:  message.ToolCalls,
+			ToolCallID: message.ToolCallID,
+		}
+		// Models without vision still get the text of messages that carried
+		// images, so switching models mid-chat keeps working.
+		if vision && len(message.Images) > 0 {
+			parts, err := s.imageParts(ctx, chatID, message)
+			if err != nil {
+				return nil, openai.Options{}, err
+			}
+			aiMessage.Parts = parts
+		}
+		aiMessages = append(aiMessages, aiMessage)
+	}
+	options := s.completionOptions(prefs)
+	options.Stop = summary.Stop
+	if summary.JSONMode {
+		if !s.supportsJSONMode(prefs.Model) {
+			return nil, openai.Options{}, fmt.Errorf("%w: %s", ErrJSONModeUnsupported, prefs.Model)
+		}
+		options.ResponseFormat = &openai.ResponseFormat{Type: "json_object"}
+	}
+	return aiMessages, options, nil
+}
+
+func replyFormat(options openai.Options) string {
+	if options.ResponseFormat != nil {
+		return FormatJSON
+	}
+	return ""
+}
+
+// storeReply appends an assistant reply. raw is its text before
+// redaction, or empty when no rule changed it.
+func (s *Service) storeReply(ctx context.Context, userEmail, chatID, model string, stored Message, raw string, usage openai.Usage) (Message, error) {
+	stored.CreatedAt = time.Now().UTC()
+	payload, err := json.Marshal(stored)
+	if err != nil {
+		return Message{}, err
+	}
+	pipe := s.Redis.TxPipeline()
+	s.queueAppend(ctx, pipe, chatID, payload)
+	s.queueRawReply(ctx, pipe, chatID, stored.CreatedAt, raw)
+	s.recordUsage(ctx, pipe, userEmail, chatID, model, usage)
+	if model != "" {
+		pipe.HIncrBy(ctx, userModelUsageKey(userEmail), model, 1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Message{}, s.writeStore(err)
+	}
+	if err := s.touchChat(ctx, userEmail, chatID, stored.Content); err != nil {
+		return Message{}, err
+	}
+	s.maybeGenerateTitle(ctx, userEmail, chatID)
+	return stored, nil
+}
+
+func (s *Service) recordUsage(ctx context.Context, pipe redis.Pipeliner, userEmail, chatID, model string, usage openai.Usage) {
+	cost, priced := s.costMicros(model, usage)
+	incrementUsage(ctx, pipe, chatUsageKey(chatID), usage, cost, priced)
+	incrementUsage(ctx, pipe, userUsageKey(userEmail), usage, cost, priced)
+	incrementMonthlyUsage(ctx, pipe, userEmail, UsageTotals{Usage: usage, CostMicros: cost}, priced)
+}
+
 func (s *Service) fetchMessages(ctx context.Context, chatID string) ([]Message, error) {
-	values, err := s.Redis.LRange(ctx, chatMessagesKey(chatID), 0, -1).Result()
+	var values []string
+	err := s.readStore(ctx, func() (err error) {
+		values, err = s.Redis.LRange(ctx, chatMessagesKey(chatID), 0, -1).Result()
+		return err
+	})
 	if err != nil && !errors.Is(err, redis.Nil) {
 		return nil, err
 	}
@@ -204,37 +968,71 @@ func (s *Service) fetchMessages(ctx context.Context, chatID string) ([]Message,
 }
 
 func (s *Service) touchChat(ctx context.Context, userEmail, chatID, lastContent string) error {
-	metaData, err := s.Redis.Get(ctx, chatMetaKey(chatID)).Result()
+	summary, err := s.loadSummary(ctx, chatID)
 	if err != nil {
 		return err
 	}
-	var summary ChatSummary
-	if err := json.Unmarshal([]byte(metaData), &summary); err != nil {
-		return err
-	}
 	if summary.Title == "New chat" && strings.TrimSpace(lastContent) != "" {
-		summary.Title = summarizeTitle(lastContent)
+		summary.Title = s.summarizeTitle(lastContent)
 	}
 	summary.UpdatedAt = time.Now().UTC()
 	return s.saveChatMeta(ctx, userEmail, summary)
 }
 
+func (s *Service) loadSummary(ctx context.Context, chatID string) (ChatSummary, error) {
+	var metaData string
+	err := s.readStore(ctx, func() (err error) {
+		metaData, err = s.Redis.Get(ctx, chatMetaKey(chatID)).Result()
+		return err
+	})
+	if err != nil {
+		return ChatSummary{}, err
+	}
+	var summary ChatSummary
+	if err := json.Unmarshal([]byte(metaData), &summary); err != nil {
+		return ChatSummary{}, err
+	}
+	return summary, nil
+}
+
 func (s *Service) saveChatMeta(ctx context.Context, userEmail string, summary ChatSummary) error {
+	pipe := s.Redis.TxPipeline()
+	if err := s.queueChatMeta(ctx, pipe, userEmail, summary); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// queueChatMeta adds the writes that save summary to pipe, so callers can
+// create a chat's other keys in the same transaction.
+func (s *Service) queueChatMeta(ctx context.Context, pipe redis.Pipeliner, userEmail string, summary ChatSummary) error {
 	payload, err := json.Marshal(summary)
 	if err != nil {
 		return err
 	}
-	pipe := s.Redis.TxPipeline()
-	pipe.Set(ctx, chatMetaKey(summary.ID), payload, 0)
-	pipe.Set(ctx, chatOwnerKey(summary.ID), userEmail, 0)
+	pipe.Set(ctx, chatMetaKey(summary.ID), payload, s.ChatTTL)
+	pipe.Set(ctx, chatOwnerKey(summary.ID), userEmail, s.ChatTTL)
+	s.queueChatExpiry(ctx, pipe, summary.ID)
 	pipe.LRem(ctx, userChatsKey(userEmail), 0, summary.ID)
 	pipe.LPush(ctx, userChatsKey(userEmail), summary.ID)
-	_, err = pipe.Exec(ctx)
-	return err
+	return nil
+}
+
+// queueChatExpiry renews the TTL of the chat's content keys, so they expire
+// together with its metadata.
+func (s *Service) queueChatExpiry(ctx context.Context, pipe redis.Pipeliner, chatID string) {
+	if s.ChatTTL <= 0 {
+		return
+	}
+	pipe.Expire(ctx, chatMessagesKey(chatID), s.ChatTTL)
+	pipe.Expire(ctx, chatUsageKey(chatID), s.ChatTTL)
+	pipe.Expire(ctx, chatImagesKey(chatID), s.ChatTTL)
+	pipe.Expire(ctx, chatRawRepliesKey(chatID), s.ChatTTL)
 }
 
 func (s *Service) verifyOwner(ctx context.Context, userEmail, chatID string) (bool, error) {
-	owner, err := s.Redis.Get(ctx, chatOwnerKey(chatID)).Result()
+	owner, err := s.chatOwner(ctx, chatID)
 	if errors.Is(err, redis.Nil) {
 		return false, nil
 	}
@@ -244,26 +1042,51 @@ func (s *Service) verifyOwner(ctx context.Context, userEmail, chatID string) (bo
 	return owner == userEmail, nil
 }
 
-func summarizeTitle(content string) string {
-	trimmed := strings.TrimSpace(content)
-	if len(trimmed) > 32 {
-		trimmed = trimmed[:32]
+// authorize is verifyOwner with the reason spelled out: ErrChatNotFound when
+// the chat does not exist, ErrNotAuthorized when it belongs to someone else.
+func (s *Service) authorize(ctx context.Context, userEmail, chatID string) error {
+	owner, err := s.chatOwner(ctx, chatID)
+	if errors.Is(err, redis.Nil) {
+		return ErrChatNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("load chat owner: %w", err)
+	}
+	if owner != userEmail {
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
+func (s *Service) chatOwner(ctx context.Context, chatID string) (owner string, err error) {
+	err = s.readStore(ctx, func() error {
+		owner, err = s.Redis.Get(ctx, chatOwnerKey(chatID)).Result()
+		return err
+	})
+	return owner, err
+}
+
+func normalizeTitle(title string) string {
+	trimmed := strings.TrimSpace(title)
+	runes := []rune(trimmed)
+	if len(runes) > MaxTitleRunes {
+		trimmed = strings.TrimSpace(string(runes[:MaxTitleRunes]))
 	}
 	return trimmed
 }
 
 func userChatsKey(email string) string {
-	return fmt.Sprintf("userchats:%s", email)
+	return store.Key("userchats", email)
 }
 
 func chatMetaKey(chatID string) string {
-	return fmt.Sprintf("chatmeta:%s", chatID)
+	return store.Key("chatmeta", chatID)
 }
 
 func chatMessagesKey(chatID string) string {
-	return fmt.Sprintf("chatmessages:%s", chatID)
+	return store.Key("chatmessages", chatID)
 }
 
 func chatOwnerKey(chatID string) string {
-	return fmt.Sprintf("chatowner:%s", chatID)
+	return store.Key("chatowner", chatID)
 }
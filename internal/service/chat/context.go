@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+const messageTokenOverhead = 4
+
+// EstimateTokens approximates the token count of text using the common
+// heuristic of roughly four characters per token.
+func EstimateTokens(text string) int {
+	runes := utf8.RuneCountInString(text)
+	if runes == 0 {
+		return 0
+	}
+	return (runes + 3) / 4
+}
+
+// TokenEstimate is the approximate size of the prompt a draft would send.
+// Trimmed reports that older history would be left out to fit the context
+// limits.
+type TokenEstimate struct {
+	Model        string `json:"model"`
+	PromptTokens int    `json:"promptTokens"`
+	Messages     int    `json:"messages"`
+	Trimmed      bool   `json:"trimmed"`
+	// CostMicros prices the prompt alone, when the model has a price.
+	CostMicros int64  `json:"costMicros,omitempty"`
+	Cost       string `json:"cost,omitempty"`
+}
+
+// EstimateTokens sizes the prompt that sending draft would produce: the
+// system prompt and trimmed history as RunCompletion would build them, plus
+// the draft itself. Nothing is stored.
+func (s *Service) EstimateTokens(ctx context.Context, userEmail, chatID, draft string, prefs Preferences) (TokenEstimate, error) {
+	if err := s.checkLength(draft); err != nil {
+		return TokenEstimate{}, err
+	}
+	prefs.Model = s.backendModel(prefs.Model)
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return TokenEstimate{}, err
+	} else if !ok {
+		return TokenEstimate{}, ErrChatNotFound
+	}
+	messages, _, err := s.fullCompletionRequest(ctx, userEmail, chatID, prefs)
+	if err != nil {
+		return TokenEstimate{}, err
+	}
+	if draft != "" {
+		messages = append(messages, openai.Message{Role: "user", Content: draft})
+	}
+	// Orphaned tool results are dropped even without limits; they do not
+	// count as trimmed history.
+	total := len(withoutLeadingToolResults(messages))
+	messages = trimHistory(messages, s.MaxContextMessages, s.MaxContextTokens)
+	estimate := TokenEstimate{Model: prefs.Model, Messages: len(messages), Trimmed: len(messages) < total}
+	for _, message := range messages {
+		estimate.PromptTokens += estimateMessageTokens(message)
+	}
+	if cost, ok := s.costMicros(prefs.Model, openai.Usage{PromptTokens: estimate.PromptTokens}); ok {
+		estimate.CostMicros = cost
+		estimate.Cost = formatCost(cost)
+	}
+	return estimate, nil
+}
+
+func estimateMessageTokens(message openai.Message) int {
+	return EstimateTokens(message.Content) + messageTokenOverhead
+}
+
+// estimateUsage stands in for the usage a backend did not report, so
+// streamed replies still count toward usage totals and quotas.
+func estimateUsage(prompt []openai.Message, reply string) openai.Usage {
+	var usage openai.Usage
+	for _, message := range prompt {
+		usage.PromptTokens += estimateMessageTokens(message)
+	}
+	usage.CompletionTokens = EstimateTokens(reply)
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+// withoutLeadingToolResults drops tool results at the start of the history,
+// left there when the assistant message that asked for them was trimmed from
+// the stored chat; a backend rejects them.
+func withoutLeadingToolResults(messages []openai.Message) []openai.Message {
+	kept := make([]openai.Message, 0, len(messages))
+	leading := true
+	for _, message := range messages {
+		if leading && message.Role == "tool" {
+			continue
+		}
+		if message.Role != "system" {
+			leading = false
+		}
+		kept = append(kept, message)
+	}
+	return kept
+}
+
+func trimHistory(messages []openai.Message, maxMessages, maxTokens int) []openai.Message {
+	if maxMessages <= 0 && maxTokens <= 0 {
+		return withoutLeadingToolResults(messages)
+	}
+	var system, history []openai.Message
+	for _, message := range messages {
+		if message.Role == "system" {
+			system = append(system, message)
+			continue
+		}
+		history = append(history, message)
+	}
+	budget := maxTokens
+	for _, message := range system {
+		budget -= estimateMessageTokens(message)
+	}
+	start := len(history)
+	used := 0
+	for start > 0 {
+		candidate := history[start-1]
+		if maxMessages > 0 && len(history)-start >= maxMessages {
+			break
+		}
+		cost := estimateMessageTokens(candidate)
+		if maxTokens > 0 && used+cost > budget && start < len(history) {
+			break
+		}
+		used += cost
+		start--
+	}
+	for start < len(history)-1 && history[start].Role == "tool" {
+		start++
+	}
+	trimmed := make([]openai.Message, 0, len(system)+len(history)-start)
+	trimmed = append(trimmed, system...)
+	return append(trimmed, history[start:]...)
+}
@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"time"
+
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+// CompletionEvent describes a reply the model finished, for EventSink.
+type CompletionEvent struct {
+	ChatID     string
+	UserEmail  string
+	Model      string
+	Usage      openai.Usage
+	FinishedAt time.Time
+}
+
+// EventSink is told about finished completions, e.g. to notify a webhook.
+// Implementations must return quickly and never block the caller.
+type EventSink interface {
+	CompletionFinished(event CompletionEvent)
+}
+
+func (s *Service) publishCompletion(userEmail, chatID, model string, usage openai.Usage) {
+	if s.Events == nil {
+		return
+	}
+	s.Events.CompletionFinished(CompletionEvent{
+		ChatID:     chatID,
+		UserEmail:  userEmail,
+		Model:      model,
+		Usage:      usage,
+		FinishedAt: time.Now().UTC(),
+	})
+}
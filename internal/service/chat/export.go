@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	ExportJSON     = "json"
+	ExportMarkdown = "markdown"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported export format")
+	filenameUnsafe       = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+type Export struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+type chatExport struct {
+	Chat       ChatSummary `json:"chat"`
+	Messages   []Message   `json:"messages"`
+	ExportedAt time.Time   `json:"exportedAt"`
+}
+
+// ExportChat renders a chat the user owns as JSON or Markdown. The format
+// also accepts "md" as an alias for Markdown.
+func (s *Service) ExportChat(ctx context.Context, userEmail, chatID, format string) (Export, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "md" {
+		format = ExportMarkdown
+	}
+	if format != ExportJSON && format != ExportMarkdown {
+		return Export{}, ErrUnsupportedFormat
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return Export{}, err
+	} else if !ok {
+		return Export{}, ErrChatNotFound
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return Export{}, err
+	}
+	messages, err := s.fetchMessages(ctx, chatID)
+	if err != nil {
+		return Export{}, err
+	}
+	base := exportFilename(summary)
+	if format == ExportJSON {
+		data, err := json.MarshalIndent(chatExport{Chat: summary, Messages: messages, ExportedAt: time.Now().UTC()}, "", "  ")
+		if err != nil {
+			return Export{}, err
+		}
+		return Export{Filename: base + ".json", ContentType: "application/json; charset=utf-8", Data: data}, nil
+	}
+	return Export{Filename: base + ".md", ContentType: "text/markdown; charset=utf-8", Data: []byte(renderMarkdownExport(summary, messages))}, nil
+}
+
+func renderMarkdownExport(summary ChatSummary, messages []Message) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "# %s\n\n", summary.Title)
+	fmt.Fprintf(&out, "_Last updated %s_\n\n", summary.UpdatedAt.UTC().Format(time.RFC3339))
+	if summary.SystemPrompt != "" {
+		out.WriteString("## System\n\n")
+		out.WriteString(strings.TrimSpace(summary.SystemPrompt))
+		out.WriteString("\n\n")
+	}
+	for _, message := range messages {
+		if message.Role != "user" && message.Role != "assistant" {
+			continue
+		}
+		if message.Role == "assistant" && strings.TrimSpace(message.Content) == "" {
+			continue
+		}
+		role := "User"
+		if message.Role == "assistant" {
+			role = "Assistant"
+		}
+		fmt.Fprintf(&out, "## %s\n\n", role)
+		if !message.CreatedAt.IsZero() {
+			fmt.Fprintf(&out, "_%s_\n\n", message.CreatedAt.UTC().Format(time.RFC3339))
+		}
+		out.WriteString(strings.TrimSpace(message.Content))
+		out.WriteString("\n\n")
+	}
+	return out.String()
+}
+
+func exportFilename(summary ChatSummary) string {
+	name := strings.Trim(filenameUnsafe.ReplaceAllString(strings.ToLower(summary.Title), "-"), "-.")
+	if len(name) > 60 {
+		name = strings.TrimRight(name[:60], "-.")
+	}
+	if name == "" {
+		name = "chat"
+	}
+	return name + "-" + summary.ID[:min(8, len(summary.ID))]
+}
@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// ForkChat copies a chat into a new one owned by the same user, keeping the
+// messages up to and including index upto (all of them when upto is
+// negative) along with the chat's settings. Usage starts from zero. Like
+// NewChat it returns any chats evicted to respect MaxChatsPerUser.
+func (s *Service) ForkChat(ctx context.Context, userEmail, chatID string, upto int) (ChatSummary, []string, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return ChatSummary{}, nil, err
+	} else if !ok {
+		return ChatSummary{}, nil, ErrChatNotFound
+	}
+	source, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return ChatSummary{}, nil, err
+	}
+	values, err := s.Redis.LRange(ctx, chatMessagesKey(chatID), 0, -1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return ChatSummary{}, nil, err
+	}
+	if upto >= len(values) {
+		return ChatSummary{}, nil, ErrInvalidIndex
+	}
+	if upto >= 0 {
+		values = values[:upto+1]
+	}
+	images, err := s.Redis.HGetAll(ctx, chatImagesKey(chatID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return ChatSummary{}, nil, err
+	}
+
+	summary := ChatSummary{
+		ID:           uuid.NewString(),
+		Title:        normalizeTitle(source.Title + " (fork)"),
+		SystemPrompt: source.SystemPrompt,
+		Stop:         source.Stop,
+		JSONMode:     source.JSONMode,
+		UpdatedAt:    time.Now().UTC(),
+	}
+	pipe := s.Redis.TxPipeline()
+	if len(values) > 0 {
+		payloads := make([]any, len(values))
+		for i, value := range values {
+			payloads[i] = value
+		}
+		pipe.RPush(ctx, chatMessagesKey(summary.ID), payloads...)
+	}
+	if len(images) > 0 {
+		pipe.HSet(ctx, chatImagesKey(summary.ID), images)
+	}
+	if err := s.queueChatMeta(ctx, pipe, userEmail, summary); err != nil {
+		return ChatSummary{}, nil, err
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return ChatSummary{}, nil, err
+	}
+	evicted, err := s.EvictOldChats(ctx, userEmail)
+	if err != nil {
+		return ChatSummary{}, nil, err
+	}
+	return summary, evicted, nil
+}
@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// gcScanCount keeps each SCAN step small so a pass never blocks Redis for
+// long, at the cost of more round trips.
+const gcScanCount = 100
+
+// GCResult summarizes one orphan collection pass.
+type GCResult struct {
+	Scanned   int `json:"scanned"`
+	Reclaimed int `json:"reclaimed"`
+}
+
+// CollectOrphans deletes chat keys that no user's chat list points to: chats
+// whose owner no longer lists them, and message, metadata, usage, image and
+// raw reply keys left without an owner record. Chats are created and deleted
+// in single transactions, so a chat that is mid-creation is never mistaken
+// for one.
+func (s *Service) CollectOrphans(ctx context.Context) (GCResult, error) {
+	var result GCResult
+	err := s.scanKeys(ctx, chatOwnerKey("*"), func(key string) error {
+		result.Scanned++
+		chatID := strings.TrimPrefix(key, chatOwnerKey(""))
+		owner, err := s.Redis.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = s.Redis.LPos(ctx, userChatsKey(owner), chatID, redis.LPosArgs{}).Result()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			return err
+		}
+		pipe := s.Redis.TxPipeline()
+		deleteChatKeys(ctx, pipe, chatID)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		result.Reclaimed++
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	for _, prefix := range []string{chatMetaKey(""), chatMessagesKey(""), chatUsageKey(""), chatImagesKey(""), chatRawRepliesKey("")} {
+		err := s.scanKeys(ctx, prefix+"*", func(key string) error {
+			result.Scanned++
+			chatID := strings.TrimPrefix(key, prefix)
+			owned, err := s.Redis.Exists(ctx, chatOwnerKey(chatID)).Result()
+			if err != nil || owned > 0 {
+				return err
+			}
+			if err := s.Redis.Del(ctx, key).Err(); err != nil {
+				return err
+			}
+			result.Reclaimed++
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// RunOrphanGC collects orphans every interval until ctx is cancelled.
+func (s *Service) RunOrphanGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		result, err := s.CollectOrphans(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "orphan gc failed", "scanned", result.Scanned, "reclaimed", result.Reclaimed, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "orphan gc pass", "scanned", result.Scanned, "reclaimed", result.Reclaimed, "duration", time.Since(start).String())
+	}
+}
+
+func (s *Service) scanKeys(ctx context.Context, pattern string, visit func(key string) error) error {
+	iter := s.Redis.Scan(ctx, 0, pattern, gcScanCount).Iterator()
+	for iter.Next(ctx) {
+		if err := visit(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
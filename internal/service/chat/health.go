@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// backendCheckTTL is how long a successful backend check is reused, so
+// frequent readiness probes do not turn into a stream of model listings.
+const backendCheckTTL = 30 * time.Second
+
+type backendCheck struct {
+	mu     sync.Mutex
+	passed time.Time
+}
+
+// CheckBackend confirms the default model backend answers a model listing.
+// A recent success is returned without asking again.
+func (s *Service) CheckBackend(ctx context.Context) error {
+	s.backendCheck.mu.Lock()
+	defer s.backendCheck.mu.Unlock()
+	if time.Since(s.backendCheck.passed) < backendCheckTTL {
+		return nil
+	}
+	if _, err := s.AI.ListModels(ctx); err != nil {
+		return err
+	}
+	s.backendCheck.passed = time.Now()
+	return nil
+}
+
+// ErrStoreUnavailable means Redis could not be reached; the request is worth
+// retrying once it is back.
+var ErrStoreUnavailable = errors.New("chat store is temporarily unavailable")
+
+const (
+	// readRetries and readBackoff let a read ride out a brief Redis blip.
+	readRetries = 2
+	readBackoff = 50 * time.Millisecond
+	// storeBreakerFailures consecutive failed reads mark the store as down;
+	// reads then fail fast without retrying until one succeeds again.
+	storeBreakerFailures = 3
+)
+
+type storeHealth struct {
+	mu       sync.Mutex
+	failures int
+	since    time.Time
+}
+
+func (h *storeHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.failures, h.since = 0, time.Time{}
+		return
+	}
+	if h.failures == 0 {
+		h.since = time.Now().UTC()
+	}
+	h.failures++
+}
+
+func (h *storeHealth) open() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures >= storeBreakerFailures
+}
+
+// StoreDegraded reports whether recent reads have kept failing to reach
+// Redis, and since when.
+func (s *Service) StoreDegraded() (bool, time.Time) {
+	s.storeHealth.mu.Lock()
+	defer s.storeHealth.mu.Unlock()
+	return s.storeHealth.failures >= storeBreakerFailures, s.storeHealth.since
+}
+
+// readStore runs read, retrying with backoff while Redis cannot be reached.
+// Only reads go through it: a write whose reply was lost may still have been
+// applied, and sending it again could append a message twice.
+func (s *Service) readStore(ctx context.Context, read func() error) error {
+	attempts := readRetries + 1
+	if s.storeHealth.open() {
+		attempts = 1
+	}
+	delay := readBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = read()
+		if !storeUnreachable(err) {
+			s.storeHealth.record(nil)
+			return err
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	s.storeHealth.record(err)
+	return storeError{err}
+}
+
+// writeStore marks a failed write as ErrStoreUnavailable when Redis was
+// unreachable. It never retries.
+func (s *Service) writeStore(err error) error {
+	if !storeUnreachable(err) {
+		return err
+	}
+	s.storeHealth.record(err)
+	return storeError{err}
+}
+
+// storeError keeps connection details out of the message users see while
+// still matching both ErrStoreUnavailable and the underlying error.
+type storeError struct{ err error }
+
+func (e storeError) Error() string   { return ErrStoreUnavailable.Error() }
+func (e storeError) Unwrap() []error { return []error{ErrStoreUnavailable, e.err} }
+
+func storeUnreachable(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, redis.ErrClosed) ||
+		strings.HasPrefix(err.Error(), "LOADING ") ||
+		strings.HasSuffix(err.Error(), "connection pool timeout")
+}
@@ -0,0 +1,185 @@
+package chat
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/service/openai"
+	"robertomachorro/smartchat/internal/store"
+)
+
+const (
+	MaxImageBytes       = 5 << 20
+	MaxImagesPerMessage = 4
+)
+
+var (
+	ErrInvalidImage      = errors.New("invalid image")
+	ErrVisionUnsupported = errors.New("model does not accept images")
+	ErrImageNotFound     = errors.New("image not found")
+)
+
+var allowedImageTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+
+// ImageInput is an image attached to a user message: either uploaded bytes
+// or an https URL the model fetches itself.
+type ImageInput struct {
+	Data []byte
+	URL  string
+}
+
+// ImageRef is what a stored message keeps about an image. Uploads are kept
+// in Redis under ID; linked images only keep their URL.
+type ImageRef struct {
+	ID          string `json:"id,omitempty"`
+	URL         string `json:"url,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// SupportsVision reports whether model is listed in VisionModels. With no
+// list configured, image input is off.
+func (s *Service) SupportsVision(model string) bool {
+	model = s.backendModel(model)
+	for _, allowed := range s.VisionModels {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendUserMessage stores a user message with optional images. Images are
+// refused unless model accepts them, so the user learns before a completion
+// is attempted.
+func (s *Service) AppendUserMessage(ctx context.Context, userEmail, chatID, content, model string, images []ImageInput) (Message, error) {
+	if len(images) == 0 {
+		return s.AppendMessage(ctx, userEmail, chatID, "user", content)
+	}
+	if err := s.checkLength(content); err != nil {
+		return Message{}, err
+	}
+	if !s.SupportsVision(model) {
+		return Message{}, fmt.Errorf("%w: %s", ErrVisionUnsupported, model)
+	}
+	if len(images) > MaxImagesPerMessage {
+		return Message{}, fmt.Errorf("%w: at most %d per message", ErrInvalidImage, MaxImagesPerMessage)
+	}
+	refs := make([]ImageRef, 0, len(images))
+	uploads := make(map[string]any)
+	for _, image := range images {
+		ref, err := imageRef(image)
+		if err != nil {
+			return Message{}, err
+		}
+		if ref.ID != "" {
+			uploads[ref.ID] = image.Data
+		}
+		refs = append(refs, ref)
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return Message{}, err
+	} else if !ok {
+		return Message{}, ErrChatNotFound
+	}
+	if err := s.checkRoom(ctx, chatID); err != nil {
+		return Message{}, err
+	}
+	message := Message{
+		Role:      "user",
+		Content:   content,
+		Images:    refs,
+		CreatedAt: time.Now().UTC(),
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return Message{}, err
+	}
+	pipe := s.Redis.TxPipeline()
+	if len(uploads) > 0 {
+		pipe.HSet(ctx, chatImagesKey(chatID), uploads)
+	}
+	s.queueAppend(ctx, pipe, chatID, payload)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Message{}, s.writeStore(err)
+	}
+	if err := s.touchChat(ctx, userEmail, chatID, content); err != nil {
+		return Message{}, err
+	}
+	return message, nil
+}
+
+// GetImage returns an uploaded image and its content type.
+func (s *Service) GetImage(ctx context.Context, userEmail, chatID, imageID string) ([]byte, string, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return nil, "", err
+	} else if !ok {
+		return nil, "", ErrChatNotFound
+	}
+	data, err := s.Redis.HGet(ctx, chatImagesKey(chatID), imageID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, "", ErrImageNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, http.DetectContentType(data), nil
+}
+
+func imageRef(image ImageInput) (ImageRef, error) {
+	if image.URL != "" {
+		parsed, err := url.Parse(image.URL)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return ImageRef{}, fmt.Errorf("%w: image URLs must be https", ErrInvalidImage)
+		}
+		return ImageRef{URL: parsed.String()}, nil
+	}
+	if len(image.Data) == 0 {
+		return ImageRef{}, fmt.Errorf("%w: empty upload", ErrInvalidImage)
+	}
+	if len(image.Data) > MaxImageBytes {
+		return ImageRef{}, fmt.Errorf("%w: larger than %d MB", ErrInvalidImage, MaxImageBytes>>20)
+	}
+	contentType := http.DetectContentType(image.Data)
+	if !allowedImageTypes[contentType] {
+		return ImageRef{}, fmt.Errorf("%w: only PNG, JPEG, GIF and WebP are accepted", ErrInvalidImage)
+	}
+	return ImageRef{ID: uuid.NewString(), ContentType: contentType}, nil
+}
+
+// imageParts expands a stored message into text and image parts, inlining
+// uploads as data URLs since the backend cannot reach this server.
+func (s *Service) imageParts(ctx context.Context, chatID string, message Message) ([]openai.ContentPart, error) {
+	parts := make([]openai.ContentPart, 0, len(message.Images)+1)
+	if strings.TrimSpace(message.Content) != "" {
+		parts = append(parts, openai.TextPart(message.Content))
+	}
+	for _, ref := range message.Images {
+		if ref.URL != "" {
+			parts = append(parts, openai.ImagePart(ref.URL))
+			continue
+		}
+		data, err := s.Redis.HGet(ctx, chatImagesKey(chatID), ref.ID).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, openai.ImagePart("data:"+ref.ContentType+";base64,"+base64.StdEncoding.EncodeToString(data)))
+	}
+	return parts, nil
+}
+
+func chatImagesKey(chatID string) string {
+	return store.Key("chatimages", chatID)
+}
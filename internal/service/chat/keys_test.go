@@ -0,0 +1,40 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+func TestKeysUsePrefix(t *testing.T) {
+	store.SetKeyPrefix("app1:")
+	t.Cleanup(func() { store.SetKeyPrefix("") })
+	now := time.Now()
+	keys := map[string]string{
+		"userChatsKey":          userChatsKey("a@example.com"),
+		"chatMetaKey":           chatMetaKey("id"),
+		"chatMessagesKey":       chatMessagesKey("id"),
+		"chatOwnerKey":          chatOwnerKey("id"),
+		"chatLockKey":           chatLockKey("id"),
+		"chatPendingKey":        chatPendingKey("id"),
+		"chatStreamKey":         chatStreamKey("id"),
+		"chatShareKey":          chatShareKey("token"),
+		"chatUsageKey":          chatUsageKey("id"),
+		"chatImagesKey":         chatImagesKey("id"),
+		"chatCandidatesKey":     chatCandidatesKey("id"),
+		"chatRawRepliesKey":     chatRawRepliesKey("id"),
+		"userUsageKey":          userUsageKey("a@example.com"),
+		"userModelUsageKey":     userModelUsageKey("a@example.com"),
+		"monthlyUsageKey":       monthlyUsageKey("a@example.com", now),
+		"rateLimitKey":          rateLimitKey("a@example.com", now),
+		"prefsKey":              prefsKey("a@example.com"),
+		"deleteConfirmationKey": deleteConfirmationKey("a@example.com"),
+	}
+	for name, key := range keys {
+		if !strings.HasPrefix(key, "app1:") {
+			t.Errorf("%s = %q, want the app1: prefix", name, key)
+		}
+	}
+}
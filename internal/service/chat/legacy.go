@@ -0,0 +1,37 @@
+package chat
+
+import (
+	"context"
+
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+// usesLegacyCompletions reports whether model is listed in
+// LegacyModels and so only answers on /completions.
+func (s *Service) usesLegacyCompletions(model string) bool {
+	for _, legacy := range s.LegacyModels {
+		if legacy == model {
+			return true
+		}
+	}
+	return false
+}
+
+// chatCompletions sends a chat to model on the endpoint it serves. Legacy
+// models get the history flattened into a single transcript prompt and
+// never call tools.
+func (s *Service) chatCompletions(ctx context.Context, model string, messages []openai.Message, options openai.Options) ([]openai.Message, openai.Usage, error) {
+	client := s.clientFor(model)
+	if s.usesLegacyCompletions(model) {
+		return client.Completions(ctx, model, openai.FlattenMessages(messages), options)
+	}
+	return client.ChatCompletions(ctx, model, messages, options)
+}
+
+func (s *Service) chatCompletion(ctx context.Context, model string, messages []openai.Message, options openai.Options) (openai.Message, openai.Usage, error) {
+	choices, usage, err := s.chatCompletions(ctx, model, messages, options)
+	if err != nil {
+		return openai.Message{}, openai.Usage{}, err
+	}
+	return choices[0], usage, nil
+}
@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+var ErrCompletionInProgress = errors.New("a reply is already being generated for this chat")
+
+const (
+	defaultLockTTL = 2 * time.Minute
+	lockTTLMargin  = 15 * time.Second
+)
+
+// acquireLock takes the lock and records when the completion started in the
+// pending key in one step, so GetStatus never disagrees with the lock.
+var acquireLock = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	redis.call("SET", KEYS[2], ARGV[3], "PX", ARGV[2])
+	return 1
+end
+return 0`)
+
+// releaseLock deletes the lock and pending keys only if the lock still holds
+// our token, so a lock that expired and was taken by another request is left
+// alone.
+var releaseLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1], KEYS[2])
+end
+return 0`)
+
+// renewLock pushes back the expiry of the lock and pending keys while the
+// lock still holds our token.
+var renewLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+	return 1
+end
+return 0`)
+
+// ChatStatus tells other tabs and devices whether a reply is being generated.
+type ChatStatus struct {
+	Pending   bool       `json:"pending"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+}
+
+// LockChat marks a completion as running for chatID so a double-submitted
+// message cannot interleave with it. The lock is renewed until the returned
+// func releases it, so a stream that outlives the lock TTL (one detached
+// from its client, or one with no timeout) keeps it; the TTL only frees
+// the chat after a crash. The func is always safe to call. Redis errors let
+// the request through, like the rate limiter.
+func (s *Service) LockChat(ctx context.Context, chatID string) (func(), error) {
+	keys := []string{chatLockKey(chatID), chatPendingKey(chatID)}
+	token := uuid.NewString()
+	startedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	ttl := s.lockTTL()
+	acquired, err := acquireLock.Run(ctx, s.Redis, keys, token, ttl.Milliseconds(), startedAt).Int()
+	if err != nil {
+		slog.WarnContext(ctx, "chat lock unavailable, continuing without it", "chat", chatID, "error", err)
+		return func() {}, nil
+	}
+	if acquired == 0 {
+		return func() {}, ErrCompletionInProgress
+	}
+	renewCtx, stopRenewing := context.WithCancel(context.WithoutCancel(ctx))
+	go s.renewChatLock(renewCtx, chatID, keys, token, ttl)
+	return func() {
+		stopRenewing()
+		if err := releaseLock.Run(context.WithoutCancel(ctx), s.Redis, keys, token).Err(); err != nil {
+			slog.WarnContext(ctx, "release chat lock", "chat", chatID, "error", err)
+		}
+	}, nil
+}
+
+// renewChatLock extends the lock every third of its TTL until ctx ends or
+// the lock turns out to belong to someone else.
+func (s *Service) renewChatLock(ctx context.Context, chatID string, keys []string, token string, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		renewed, err := renewLock.Run(ctx, s.Redis, keys, token, ttl.Milliseconds()).Int()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "renew chat lock", "chat", chatID, "error", err)
+			continue
+		}
+		if renewed == 0 {
+			slog.WarnContext(ctx, "chat lock lost before the reply finished", "chat", chatID)
+			return
+		}
+	}
+}
+
+// GetStatus reports whether a completion is in flight for the chat. The
+// pending key lives and dies with the chat lock, and shares its TTL, so a
+// crashed request stops showing as pending once the lock expires.
+func (s *Service) GetStatus(ctx context.Context, userEmail, chatID string) (ChatStatus, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return ChatStatus{}, err
+	} else if !ok {
+		return ChatStatus{}, ErrChatNotFound
+	}
+	value, err := s.Redis.Get(ctx, chatPendingKey(chatID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return ChatStatus{}, nil
+	}
+	if err != nil {
+		return ChatStatus{}, err
+	}
+	status := ChatStatus{Pending: true}
+	if startedAt, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		status.StartedAt = &startedAt
+	}
+	return status, nil
+}
+
+// lockTTL outlives the completion timeout so a slow reply is not overtaken
+// even between renewals, while a crashed request cannot block the chat for
+// long.
+func (s *Service) lockTTL() time.Duration {
+	if s.CompletionTimeout <= 0 {
+		return defaultLockTTL
+	}
+	return s.CompletionTimeout + lockTTLMargin
+}
+
+func chatLockKey(chatID string) string {
+	return store.Key("chatlock", chatID)
+}
+
+func chatPendingKey(chatID string) string {
+	return store.Key("chatpending", chatID)
+}
@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrInvalidIndex   = errors.New("message index out of range")
+	ErrNotUserMessage = errors.New("message is not a user message")
+	ErrEmptyContent   = errors.New("empty message")
+	ErrChatFull       = errors.New("chat has reached its message limit")
+)
+
+// GetMessage returns a single stored message as-is.
+func (s *Service) GetMessage(ctx context.Context, userEmail, chatID string, index int) (Message, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return Message{}, err
+	} else if !ok {
+		return Message{}, ErrChatNotFound
+	}
+	return s.messageAt(ctx, chatID, index)
+}
+
+// EditMessage rewrites a user message and drops everything after it so the
+// caller can request a fresh completion for the edited turn.
+func (s *Service) EditMessage(ctx context.Context, userEmail, chatID string, index int, newContent string) (Message, error) {
+	content := strings.TrimRightFunc(newContent, unicode.IsSpace)
+	if strings.TrimSpace(content) == "" {
+		return Message{}, ErrEmptyContent
+	}
+	if err := s.checkLength(content); err != nil {
+		return Message{}, err
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return Message{}, err
+	} else if !ok {
+		return Message{}, ErrChatNotFound
+	}
+	message, err := s.messageAt(ctx, chatID, index)
+	if err != nil {
+		return Message{}, err
+	}
+	if message.Role != "user" {
+		return Message{}, ErrNotUserMessage
+	}
+	message.Content = content
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return Message{}, err
+	}
+	pipe := s.Redis.TxPipeline()
+	pipe.LSet(ctx, chatMessagesKey(chatID), int64(index), payload)
+	pipe.LTrim(ctx, chatMessagesKey(chatID), 0, int64(index))
+	pipe.Del(ctx, chatCandidatesKey(chatID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Message{}, err
+	}
+	if err := s.touchChat(ctx, userEmail, chatID, content); err != nil {
+		return Message{}, err
+	}
+	return message, nil
+}
+
+// DeleteMessage removes the message at index together with the rest of its
+// exchange: deleting a user message also deletes the assistant and tool
+// replies that answered it, and deleting a reply removes the whole reply
+// block up to the surrounding user messages. It returns how many messages
+// were removed.
+func (s *Service) DeleteMessage(ctx context.Context, userEmail, chatID string, index int) (int, error) {
+	if index < 0 {
+		return 0, ErrInvalidIndex
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, ErrChatNotFound
+	}
+	key := chatMessagesKey(chatID)
+	removed := 0
+	err := s.Redis.Watch(ctx, func(tx *redis.Tx) error {
+		values, err := tx.LRange(ctx, key, 0, -1).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if index >= len(values) {
+			return ErrInvalidIndex
+		}
+		roles := make([]string, len(values))
+		for i, value := range values {
+			var message Message
+			if err := json.Unmarshal([]byte(value), &message); err == nil {
+				roles[i] = message.Role
+			}
+		}
+		start, end := index, index+1
+		if roles[index] != "user" {
+			for start > 0 && roles[start-1] != "user" {
+				start--
+			}
+		}
+		for end < len(roles) && roles[end] != "user" {
+			end++
+		}
+		sentinel := "__deleted__:" + uuid.NewString()
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := start; i < end; i++ {
+				pipe.LSet(ctx, key, int64(i), sentinel)
+			}
+			pipe.LRem(ctx, key, 0, sentinel)
+			pipe.Del(ctx, chatCandidatesKey(chatID))
+			return nil
+		})
+		if err == nil {
+			removed = end - start
+		}
+		return err
+	}, key)
+	if err != nil {
+		return 0, err
+	}
+	return removed, s.touchChat(ctx, userEmail, chatID, "")
+}
+
+func (s *Service) messageAt(ctx context.Context, chatID string, index int) (Message, error) {
+	if index < 0 {
+		return Message{}, ErrInvalidIndex
+	}
+	var value string
+	err := s.readStore(ctx, func() (err error) {
+		value, err = s.Redis.LIndex(ctx, chatMessagesKey(chatID), int64(index)).Result()
+		return err
+	})
+	if errors.Is(err, redis.Nil) {
+		return Message{}, ErrInvalidIndex
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	var message Message
+	if err := json.Unmarshal([]byte(value), &message); err != nil {
+		return Message{}, err
+	}
+	return message, nil
+}
+
+// ClearMessages wipes a chat's history and usage but keeps its settings;
+// the chat opens with WelcomeMessage again, as a new one would.
+// A title that was generated from the first message goes back to "New chat"
+// so the next message names it again; a title the user chose stays.
+func (s *Service) ClearMessages(ctx context.Context, userEmail, chatID string) (ChatSummary, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return ChatSummary{}, err
+	} else if !ok {
+		return ChatSummary{}, ErrChatNotFound
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return ChatSummary{}, err
+	}
+	messages, err := s.fetchMessages(ctx, chatID)
+	if err != nil {
+		return ChatSummary{}, err
+	}
+	for _, message := range messages {
+		if message.Role == "user" {
+			if summary.Title == s.summarizeTitle(message.Content) {
+				summary.Title = "New chat"
+			}
+			break
+		}
+	}
+	summary.UpdatedAt = time.Now().UTC()
+	pipe := s.Redis.TxPipeline()
+	pipe.Del(ctx, chatMessagesKey(chatID), chatUsageKey(chatID), chatImagesKey(chatID), chatRawRepliesKey(chatID), chatCandidatesKey(chatID))
+	if err := s.queueGreeting(ctx, pipe, chatID); err != nil {
+		return ChatSummary{}, err
+	}
+	if err := s.queueChatMeta(ctx, pipe, userEmail, summary); err != nil {
+		return ChatSummary{}, err
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return ChatSummary{}, err
+	}
+	return summary, nil
+}
@@ -0,0 +1,216 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+const (
+	modelCacheTTL       = 5 * time.Minute
+	modelFetchTimeout   = 5 * time.Second
+	modelRetryAfterFail = 30 * time.Second
+)
+
+type modelCache struct {
+	mu        sync.Mutex
+	models    []string
+	expiresAt time.Time
+	// refreshing is closed when the running discovery ends; nil when none
+	// is running.
+	refreshing chan struct{}
+}
+
+// AvailableModels returns the models users may pick. With DiscoverModels
+// set, the backends are asked what they serve and the answer is intersected
+// with the configured Models allowlist; otherwise, or when discovery fails,
+// the configured list is returned as is. Discovery runs in the background,
+// one at a time, and never under the cache lock: once a list is cached,
+// callers get it straight away while an expired one is refreshed, and only
+// the first callers wait, at most until their ctx ends.
+func (s *Service) AvailableModels(ctx context.Context) []string {
+	if !s.DiscoverModels {
+		return s.Models
+	}
+	cache := &s.modelCache
+	cache.mu.Lock()
+	models, cached := cache.models, !cache.expiresAt.IsZero()
+	fresh := time.Now().Before(cache.expiresAt)
+	done := cache.refreshing
+	if !fresh && done == nil {
+		done = make(chan struct{})
+		cache.refreshing = done
+		go s.refreshModels(context.WithoutCancel(ctx), done)
+	}
+	cache.mu.Unlock()
+	if cached {
+		return models
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return s.Models
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.models
+}
+
+// refreshModels runs one discovery for AvailableModels and closes done
+// once the cache holds its result.
+func (s *Service) refreshModels(ctx context.Context, done chan struct{}) {
+	models, err := s.discoverModels(ctx)
+	cache := &s.modelCache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	defer close(done)
+	cache.refreshing = nil
+	if err != nil || len(models) == 0 {
+		slog.WarnContext(ctx, "model discovery failed, using configured models", "error", err)
+		cache.models = s.Models
+		cache.expiresAt = time.Now().Add(modelRetryAfterFail)
+		return
+	}
+	cache.models = models
+	cache.expiresAt = time.Now().Add(modelCacheTTL)
+}
+
+type modelFailures struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// checkModel turns a backend's "unknown model" answer into
+// ErrModelUnavailable and, with ModelCooldown set, flags the model in
+// UnavailableModels until the cooldown passes. A completion that gets
+// through clears the flag early.
+func (s *Service) checkModel(ctx context.Context, model string, err error) error {
+	s.modelFailures.mu.Lock()
+	defer s.modelFailures.mu.Unlock()
+	if err == nil {
+		delete(s.modelFailures.until, model)
+		return nil
+	}
+	if !openai.IsModelNotFound(err) {
+		return err
+	}
+	slog.WarnContext(ctx, "backend rejected model", "model", model, "error", err)
+	if s.ModelCooldown > 0 {
+		if s.modelFailures.until == nil {
+			s.modelFailures.until = make(map[string]time.Time)
+		}
+		s.modelFailures.until[model] = time.Now().Add(s.ModelCooldown)
+	}
+	return fmt.Errorf("%w: %s", ErrModelUnavailable, model)
+}
+
+// UnavailableModels maps each model the backend recently rejected to when
+// it is offered normally again, keyed by the name the selector shows.
+// Failures are tracked per instance.
+func (s *Service) UnavailableModels() map[string]time.Time {
+	s.modelFailures.mu.Lock()
+	defer s.modelFailures.mu.Unlock()
+	now := time.Now()
+	unavailable := make(map[string]time.Time, len(s.modelFailures.until))
+	for model, until := range s.modelFailures.until {
+		if now.After(until) {
+			delete(s.modelFailures.until, model)
+			continue
+		}
+		unavailable[s.DisplayModel(model)] = until
+	}
+	return unavailable
+}
+
+func (s *Service) discoverModels(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, modelFetchTimeout)
+	defer cancel()
+	clients := []*openai.Client{s.AI}
+	for _, client := range s.modelClients {
+		clients = append(clients, client)
+	}
+	seen := make(map[*openai.Client]bool)
+	offered := make(map[string]bool)
+	var ordered []string
+	var lastErr error
+	for _, client := range clients {
+		if client == nil || seen[client] {
+			continue
+		}
+		seen[client] = true
+		ids, err := client.ListModels(ctx)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, id := range ids {
+			if !offered[id] {
+				offered[id] = true
+				ordered = append(ordered, id)
+			}
+		}
+	}
+	if len(offered) == 0 {
+		return nil, lastErr
+	}
+	if len(s.Models) == 0 {
+		return ordered, nil
+	}
+	var allowed []string
+	for _, model := range s.Models {
+		if offered[model] {
+			allowed = append(allowed, model)
+		}
+	}
+	return allowed, nil
+}
+
+// ModelChoices returns the models offered in the selector: AvailableModels
+// under their aliases, without BlockedModels unless includeBlocked is set.
+func (s *Service) ModelChoices(ctx context.Context, includeBlocked bool) []string {
+	available := s.AvailableModels(ctx)
+	choices := make([]string, 0, len(available))
+	for _, model := range available {
+		if !includeBlocked && s.modelBlocked(model) {
+			continue
+		}
+		choices = append(choices, s.DisplayModel(model))
+	}
+	return choices
+}
+
+// DisplayModel returns the alias a model is shown under, or the model
+// itself when it has none.
+func (s *Service) DisplayModel(model string) string {
+	for alias, id := range s.ModelAliases {
+		if id == model {
+			return alias
+		}
+	}
+	return model
+}
+
+// backendModel resolves an alias to the model id sent to the backend.
+func (s *Service) backendModel(model string) string {
+	if id, ok := s.ModelAliases[model]; ok {
+		return id
+	}
+	return model
+}
+
+// modelBlocked matches BlockedModels against both a model's id and its
+// alias.
+func (s *Service) modelBlocked(model string) bool {
+	id := s.backendModel(model)
+	alias := s.DisplayModel(id)
+	for _, blocked := range s.BlockedModels {
+		if blocked == id || blocked == alias {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+func TestAvailableModelsFetchesOutsideLock(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":[{"id":"gpt-a"},{"id":"gpt-b"}]}`))
+	}))
+	defer backend.Close()
+	defer close(release)
+	s := &Service{AI: openai.NewClient(backend.URL, "key", time.Minute), DiscoverModels: true}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := strings.Join(s.AvailableModels(ctx), ","); got != "gpt-a,gpt-b" {
+				t.Errorf("first AvailableModels = %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("concurrent first calls fetched %d times, want 1", n)
+	}
+
+	// Expire the cache; the refresh now blocks until release is closed, and
+	// callers meanwhile get the stale list without waiting.
+	s.modelCache.mu.Lock()
+	s.modelCache.expiresAt = time.Now().Add(-time.Second)
+	s.modelCache.mu.Unlock()
+	deadline, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	for range 3 {
+		if got := strings.Join(s.AvailableModels(deadline), ","); got != "gpt-a,gpt-b" {
+			t.Errorf("stale AvailableModels = %q", got)
+		}
+	}
+	if deadline.Err() != nil {
+		t.Fatal("AvailableModels waited on a refresh with a list cached")
+	}
+}
@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	MinPageLimit         = 1
+	MaxPageLimit         = 100
+	DefaultChatPageLimit = 20
+)
+
+var ErrInvalidPage = errors.New("invalid page bounds")
+
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	Offset   int       `json:"offset"`
+	Limit    int       `json:"limit"`
+	Start    int       `json:"start"`
+	Total    int       `json:"total"`
+	HasMore  bool      `json:"hasMore"`
+}
+
+type ChatPage struct {
+	Chats   []ChatSummary `json:"chats"`
+	Offset  int           `json:"offset"`
+	Limit   int           `json:"limit"`
+	Total   int           `json:"total"`
+	HasMore bool          `json:"hasMore"`
+}
+
+// GetMessagesPage returns up to limit messages in chronological order,
+// skipping the offset most recent ones so offset 0 is the latest page.
+func (s *Service) GetMessagesPage(ctx context.Context, userEmail, chatID string, offset, limit int) (MessagePage, error) {
+	if offset < 0 || limit < MinPageLimit || limit > MaxPageLimit {
+		return MessagePage{}, ErrInvalidPage
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return MessagePage{}, err
+	} else if !ok {
+		return MessagePage{}, ErrChatNotFound
+	}
+	return s.readPage(ctx, chatID, offset, limit)
+}
+
+// MessagesVersion identifies the current state of a chat's messages. Every
+// append, edit and delete bumps the chat's UpdatedAt, and the count catches
+// any change that lands within the same clock tick.
+func (s *Service) MessagesVersion(ctx context.Context, userEmail, chatID string) (string, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return "", err
+	} else if !ok {
+		return "", ErrChatNotFound
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if err != nil {
+		return "", err
+	}
+	total, err := s.messageCount(ctx, chatID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%d", summary.UpdatedAt.UnixNano(), total), nil
+}
+
+func (s *Service) readPage(ctx context.Context, chatID string, offset, limit int) (MessagePage, error) {
+	total, err := s.messageCount(ctx, chatID)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	page := MessagePage{Offset: offset, Limit: limit, Total: int(total), Messages: []Message{}}
+	if offset >= page.Total {
+		return page, nil
+	}
+	stop := page.Total - offset - 1
+	start := max(stop-limit+1, 0)
+	var values []string
+	err = s.readStore(ctx, func() (err error) {
+		values, err = s.Redis.LRange(ctx, chatMessagesKey(chatID), int64(start), int64(stop)).Result()
+		return err
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return MessagePage{}, err
+	}
+	for _, value := range values {
+		var message Message
+		if err := json.Unmarshal([]byte(value), &message); err != nil {
+			continue
+		}
+		page.Messages = append(page.Messages, message)
+	}
+	page.Start = start
+	page.HasMore = start > 0
+	return page, nil
+}
+
+func (s *Service) messageCount(ctx context.Context, chatID string) (total int64, err error) {
+	err = s.readStore(ctx, func() error {
+		total, err = s.Redis.LLen(ctx, chatMessagesKey(chatID)).Result()
+		return err
+	})
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return total, err
+}
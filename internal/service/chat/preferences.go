@@ -0,0 +1,168 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/service/openai"
+	"robertomachorro/smartchat/internal/store"
+)
+
+const (
+	MinMaxTokens = 1
+	MaxMaxTokens = 32000
+	MinPenalty   = -2.0
+	MaxPenalty   = 2.0
+)
+
+var ErrInvalidPreference = errors.New("invalid preference")
+
+type Preferences struct {
+	Model            string   `json:"model"`
+	Temperature      float64  `json:"temperature"`
+	MaxTokens        *int     `json:"maxTokens,omitempty"`
+	TopP             *float64 `json:"topP,omitempty"`
+	PresencePenalty  *float64 `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequencyPenalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	// Timezone is an IANA zone name for showing timestamps; empty means UTC.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+func (p Preferences) Validate() error {
+	if p.MaxTokens != nil && (*p.MaxTokens < MinMaxTokens || *p.MaxTokens > MaxMaxTokens) {
+		return fmt.Errorf("%w: max_tokens must be between %d and %d", ErrInvalidPreference, MinMaxTokens, MaxMaxTokens)
+	}
+	if p.TopP != nil && (*p.TopP < 0 || *p.TopP > 1) {
+		return fmt.Errorf("%w: top_p must be between 0 and 1", ErrInvalidPreference)
+	}
+	if p.PresencePenalty != nil && (*p.PresencePenalty < MinPenalty || *p.PresencePenalty > MaxPenalty) {
+		return fmt.Errorf("%w: presence_penalty must be between %.1f and %.1f", ErrInvalidPreference, MinPenalty, MaxPenalty)
+	}
+	if p.FrequencyPenalty != nil && (*p.FrequencyPenalty < MinPenalty || *p.FrequencyPenalty > MaxPenalty) {
+		return fmt.Errorf("%w: frequency_penalty must be between %.1f and %.1f", ErrInvalidPreference, MinPenalty, MaxPenalty)
+	}
+	if p.Timezone != "" {
+		// "Local" would be the server's zone, not the user's.
+		if _, err := time.LoadLocation(p.Timezone); err != nil || p.Timezone == "Local" {
+			return fmt.Errorf("%w: timezone must be an IANA zone name such as Europe/Paris", ErrInvalidPreference)
+		}
+	}
+	return nil
+}
+
+func (p Preferences) options() openai.Options {
+	return openai.Options{
+		Temperature:      p.Temperature,
+		MaxTokens:        p.MaxTokens,
+		TopP:             p.TopP,
+		PresencePenalty:  p.PresencePenalty,
+		FrequencyPenalty: p.FrequencyPenalty,
+		Seed:             p.Seed,
+	}
+}
+
+func (s *Service) GetPreferences(ctx context.Context, userEmail string) (Preferences, bool, error) {
+	values, err := s.Redis.HGetAll(ctx, prefsKey(userEmail)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return Preferences{}, false, err
+	}
+	if len(values) == 0 {
+		return Preferences{}, false, nil
+	}
+	prefs := Preferences{Model: values["model"], Timezone: values["timezone"]}
+	if value, ok := values["temperature"]; ok {
+		temperature, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return Preferences{}, false, fmt.Errorf("parse temperature: %w", err)
+		}
+		prefs.Temperature = temperature
+	}
+	if value, ok := values["max_tokens"]; ok {
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil {
+			return Preferences{}, false, fmt.Errorf("parse max_tokens: %w", err)
+		}
+		prefs.MaxTokens = &maxTokens
+	}
+	if value, ok := values["seed"]; ok {
+		seed, err := strconv.Atoi(value)
+		if err != nil {
+			return Preferences{}, false, fmt.Errorf("parse seed: %w", err)
+		}
+		prefs.Seed = &seed
+	}
+	for field, target := range map[string]**float64{
+		"top_p":             &prefs.TopP,
+		"presence_penalty":  &prefs.PresencePenalty,
+		"frequency_penalty": &prefs.FrequencyPenalty,
+	} {
+		value, ok := values[field]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return Preferences{}, false, fmt.Errorf("parse %s: %w", field, err)
+		}
+		*target = &parsed
+	}
+	return prefs, true, nil
+}
+
+func (s *Service) SavePreferences(ctx context.Context, userEmail string, prefs Preferences) error {
+	if err := prefs.Validate(); err != nil {
+		return err
+	}
+	key := prefsKey(userEmail)
+	fields := []any{
+		"model", prefs.Model,
+		"temperature", strconv.FormatFloat(prefs.Temperature, 'f', -1, 64),
+	}
+	var cleared []string
+	if prefs.MaxTokens != nil {
+		fields = append(fields, "max_tokens", strconv.Itoa(*prefs.MaxTokens))
+	} else {
+		cleared = append(cleared, "max_tokens")
+	}
+	if prefs.Seed != nil {
+		fields = append(fields, "seed", strconv.Itoa(*prefs.Seed))
+	} else {
+		cleared = append(cleared, "seed")
+	}
+	if prefs.Timezone != "" {
+		fields = append(fields, "timezone", prefs.Timezone)
+	} else {
+		cleared = append(cleared, "timezone")
+	}
+	for _, entry := range []struct {
+		field string
+		value *float64
+	}{
+		{"top_p", prefs.TopP},
+		{"presence_penalty", prefs.PresencePenalty},
+		{"frequency_penalty", prefs.FrequencyPenalty},
+	} {
+		if entry.value != nil {
+			fields = append(fields, entry.field, strconv.FormatFloat(*entry.value, 'f', -1, 64))
+		} else {
+			cleared = append(cleared, entry.field)
+		}
+	}
+	pipe := s.Redis.TxPipeline()
+	pipe.HSet(ctx, key, fields...)
+	if len(cleared) > 0 {
+		pipe.HDel(ctx, key, cleared...)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func prefsKey(email string) string {
+	return store.Key("prefs", email)
+}
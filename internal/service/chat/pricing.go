@@ -0,0 +1,33 @@
+package chat
+
+import (
+	"fmt"
+	"math"
+
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+// ModelPrice is what a model costs in dollars per 1K prompt and completion
+// tokens.
+type ModelPrice struct {
+	InputPer1K  float64
+	OutputPer1K float64
+}
+
+// costMicros converts usage on model to micro-dollars. Costs are kept as
+// integers so totals accumulated in Redis do not drift. Models without a
+// price report ok=false and are counted in tokens only.
+func (s *Service) costMicros(model string, usage openai.Usage) (int64, bool) {
+	price, ok := s.Pricing[model]
+	if !ok {
+		return 0, false
+	}
+	dollars := float64(usage.PromptTokens)*price.InputPer1K/1000 + float64(usage.CompletionTokens)*price.OutputPer1K/1000
+	return int64(math.Round(dollars * 1e6)), true
+}
+
+// formatCost renders micro-dollars as dollars to the micro-dollar, so a
+// single cheap reply does not show as $0.00.
+func formatCost(micros int64) string {
+	return fmt.Sprintf("$%.6f", float64(micros)/1e6)
+}
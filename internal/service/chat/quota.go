@@ -0,0 +1,93 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+// monthlyUsageTTL keeps last month's counter around for a while after the
+// month rolls over, then lets Redis drop it.
+const monthlyUsageTTL = 62 * 24 * time.Hour
+
+var ErrQuotaExceeded = errors.New("monthly usage quota exceeded")
+
+// QuotaStatus is a user's standing against the monthly quotas. Limits of
+// zero are not enforced and their remaining amounts are omitted.
+type QuotaStatus struct {
+	TokenLimit          int       `json:"tokenLimit,omitempty"`
+	TokensUsed          int       `json:"tokensUsed"`
+	TokensRemaining     *int      `json:"tokensRemaining,omitempty"`
+	CostLimitMicros     int64     `json:"costLimitMicros,omitempty"`
+	CostUsedMicros      int64     `json:"costUsedMicros"`
+	CostRemainingMicros *int64    `json:"costRemainingMicros,omitempty"`
+	ResetsAt            time.Time `json:"resetsAt"`
+	Exceeded            bool      `json:"exceeded"`
+}
+
+func (s *Service) quotasEnabled() bool {
+	return s.MonthlyTokenQuota > 0 || s.MonthlyCostQuotaMicros > 0
+}
+
+// Quota reports the user's usage this calendar month (UTC) against the
+// configured quotas.
+func (s *Service) Quota(ctx context.Context, userEmail string) (QuotaStatus, error) {
+	now := time.Now().UTC()
+	used, err := s.readUsage(ctx, monthlyUsageKey(userEmail, now))
+	if err != nil {
+		return QuotaStatus{}, err
+	}
+	status := QuotaStatus{
+		TokenLimit:      s.MonthlyTokenQuota,
+		TokensUsed:      used.TotalTokens,
+		CostLimitMicros: s.MonthlyCostQuotaMicros,
+		CostUsedMicros:  used.CostMicros,
+		ResetsAt:        time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if s.MonthlyTokenQuota > 0 {
+		remaining := max(s.MonthlyTokenQuota-used.TotalTokens, 0)
+		status.TokensRemaining = &remaining
+		status.Exceeded = remaining == 0
+	}
+	if s.MonthlyCostQuotaMicros > 0 {
+		remaining := max(s.MonthlyCostQuotaMicros-used.CostMicros, 0)
+		status.CostRemainingMicros = &remaining
+		status.Exceeded = status.Exceeded || remaining == 0
+	}
+	return status, nil
+}
+
+// CheckQuota returns ErrQuotaExceeded once the user has used up a monthly
+// quota. A reply already under way is allowed to finish, so usage can end
+// slightly above the limit. Redis errors let the request through, like the
+// rate limiter.
+func (s *Service) CheckQuota(ctx context.Context, userEmail string) error {
+	if !s.quotasEnabled() {
+		return nil
+	}
+	status, err := s.Quota(ctx, userEmail)
+	if err != nil {
+		slog.WarnContext(ctx, "quota check unavailable, allowing message", "user", userEmail, "error", err)
+		return nil
+	}
+	if status.Exceeded {
+		return fmt.Errorf("%w; it resets on %s", ErrQuotaExceeded, status.ResetsAt.Format("January 2"))
+	}
+	return nil
+}
+
+func incrementMonthlyUsage(ctx context.Context, pipe redis.Pipeliner, userEmail string, usage UsageTotals, priced bool) {
+	key := monthlyUsageKey(userEmail, time.Now().UTC())
+	incrementUsage(ctx, pipe, key, usage.Usage, usage.CostMicros, priced)
+	pipe.Expire(ctx, key, monthlyUsageTTL)
+}
+
+func monthlyUsageKey(email string, now time.Time) string {
+	return store.Key("userusage", email, now.Format("200601"))
+}
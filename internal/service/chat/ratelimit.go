@@ -0,0 +1,39 @@
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+const rateLimitWindow = time.Minute
+
+// AllowMessage counts a message against the user's per-minute budget using a
+// fixed window in Redis. When the budget is spent it returns false and how
+// long until the window resets. Redis errors let the message through.
+func (s *Service) AllowMessage(ctx context.Context, userEmail string) (bool, time.Duration) {
+	if s.MessagesPerMinute <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	window := now.Truncate(rateLimitWindow)
+	key := rateLimitKey(userEmail, window)
+	pipe := s.Redis.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, rateLimitWindow+time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.WarnContext(ctx, "rate limiter unavailable, allowing message", "user", userEmail, "error", err)
+		return true, 0
+	}
+	if count.Val() > int64(s.MessagesPerMinute) {
+		return false, window.Add(rateLimitWindow).Sub(now)
+	}
+	return true, 0
+}
+
+func rateLimitKey(email string, window time.Time) string {
+	return store.Key("ratelimit", email, strconv.FormatInt(window.Unix(), 10))
+}
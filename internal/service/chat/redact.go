@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+// Redaction rewrites every match of Pattern in an assistant reply with
+// Replace, which may refer to capture groups as in regexp.Expand.
+type Redaction struct {
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+// redactReply applies Redactions in order and returns the cleaned reply. raw
+// is the original when a rule changed it and empty otherwise, so callers
+// keep a raw copy only for replies that had something removed.
+func (s *Service) redactReply(content string) (cleaned, raw string) {
+	cleaned = content
+	for _, redaction := range s.Redactions {
+		cleaned = redaction.Pattern.ReplaceAllString(cleaned, redaction.Replace)
+	}
+	if cleaned == content {
+		return content, ""
+	}
+	return cleaned, content
+}
+
+// streamRedactor applies Redactions to a reply while it streams, so text a
+// rule removes is never shown or buffered for resuming. Text is held back
+// from the first spot where a rule could still match: where its literal
+// prefix (such as "<think>") starts with no complete match yet, or where the
+// text ends in part of that prefix. A rule with no literal prefix could
+// match anywhere, so it holds back the whole reply until the stream ends.
+type streamRedactor struct {
+	redactions []Redaction
+	sent       int
+}
+
+func (s *Service) newStreamRedactor() *streamRedactor {
+	return &streamRedactor{redactions: s.Redactions}
+}
+
+// next takes the reply streamed so far and returns the redacted text that
+// may now be shown. With done set it returns everything not yet shown.
+func (r *streamRedactor) next(content string, done bool) string {
+	if len(r.redactions) == 0 {
+		shown := content[r.sent:]
+		r.sent = len(content)
+		return shown
+	}
+	cleaned := content
+	for _, redaction := range r.redactions {
+		cleaned = redaction.Pattern.ReplaceAllString(cleaned, redaction.Replace)
+	}
+	end := len(cleaned)
+	if !done {
+		end = r.safeEnd(cleaned)
+	}
+	if end <= r.sent {
+		return ""
+	}
+	shown := cleaned[r.sent:end]
+	r.sent = end
+	return shown
+}
+
+// safeEnd is how much of cleaned no rule can still change.
+func (r *streamRedactor) safeEnd(cleaned string) int {
+	end := len(cleaned)
+	for _, redaction := range r.redactions {
+		prefix, _ := redaction.Pattern.LiteralPrefix()
+		if prefix == "" {
+			return 0
+		}
+		if i := strings.Index(cleaned, prefix); i >= 0 && i < end {
+			end = i
+		}
+		for n := min(len(prefix)-1, len(cleaned)); n > 0; n-- {
+			if strings.HasSuffix(cleaned, prefix[:n]) {
+				end = min(end, len(cleaned)-n)
+				break
+			}
+		}
+	}
+	return end
+}
+
+// queueRawReply keeps the unredacted text of the reply created at createdAt
+// when KeepRawReplies is on. Raw replies are for debugging only: they live
+// as long as the chat but are never shown or sent back to the model.
+func (s *Service) queueRawReply(ctx context.Context, pipe redis.Pipeliner, chatID string, createdAt time.Time, raw string) {
+	if !s.KeepRawReplies || raw == "" {
+		return
+	}
+	pipe.HSet(ctx, chatRawRepliesKey(chatID), createdAt.Format(time.RFC3339Nano), raw)
+	if s.ChatTTL > 0 {
+		pipe.Expire(ctx, chatRawRepliesKey(chatID), s.ChatTTL)
+	}
+}
+
+func chatRawRepliesKey(chatID string) string {
+	return store.Key("chatrawreplies", chatID)
+}
@@ -0,0 +1,45 @@
+package chat
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestStreamRedactor(t *testing.T) {
+	think := Redaction{Pattern: regexp.MustCompile(`(?s)<think>.*?</think>`)}
+	digits := Redaction{Pattern: regexp.MustCompile(`\d{4}`), Replace: "####"}
+	tests := []struct {
+		name       string
+		redactions []Redaction
+		deltas     []string
+		want       []string
+	}{
+		{"no rules", nil, []string{"a", "b"}, []string{"a", "b", ""}},
+		{"whole match held", []Redaction{think}, []string{"<think>", "plan", "</think>", "Hi"}, []string{"", "", "", "Hi", ""}},
+		{"split prefix", []Redaction{think}, []string{"Hi <th", "ink>x</think> there"}, []string{"Hi ", " there", ""}},
+		{"prefix lookalike", []Redaction{think}, []string{"a <t", "able>"}, []string{"a ", "<table>", ""}},
+		{"unclosed match", []Redaction{think}, []string{"ok <think>", "never closed"}, []string{"ok ", "", "<think>never closed"}},
+		{"no literal prefix", []Redaction{digits}, []string{"pin 12", "34 ok"}, []string{"", "", "pin #### ok"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{Redactions: tt.redactions}
+			redactor := s.newStreamRedactor()
+			var content strings.Builder
+			var got []string
+			for _, delta := range tt.deltas {
+				content.WriteString(delta)
+				got = append(got, redactor.next(content.String(), false))
+			}
+			got = append(got, redactor.next(content.String(), true))
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("shown %q, want %q", got, tt.want)
+			}
+			want, _ := s.redactReply(content.String())
+			if shown := strings.Join(got, ""); shown != want {
+				t.Errorf("shown %q in all, want the stored reply %q", shown, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+var ErrNoStream = errors.New("no reply is being generated for this chat")
+
+const (
+	// streamBufferTTL bounds how long a buffer outlives a crashed request.
+	streamBufferTTL = 10 * time.Minute
+	// detachedStreamLimit is how long a stream keeps generating after its
+	// client goes away, giving the client time to resume it.
+	detachedStreamLimit = 5 * time.Minute
+	resumePollInterval  = 250 * time.Millisecond
+)
+
+// streamBuffer mirrors a streamed reply into Redis so a client that lost its
+// connection can pick it up with ResumeStream. The first list element is a
+// generation marker; the rest are the deltas in order. Buffering is best
+// effort: Redis errors are logged and never fail the stream.
+type streamBuffer struct {
+	redis  *redis.Client
+	key    string
+	failed bool
+}
+
+func (s *Service) startStreamBuffer(ctx context.Context, chatID string) *streamBuffer {
+	buffer := &streamBuffer{redis: s.Redis, key: chatStreamKey(chatID)}
+	pipe := s.Redis.TxPipeline()
+	pipe.Del(ctx, buffer.key)
+	pipe.RPush(ctx, buffer.key, uuid.NewString())
+	pipe.Expire(ctx, buffer.key, streamBufferTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		buffer.fail(ctx, err)
+	}
+	return buffer
+}
+
+func (b *streamBuffer) append(ctx context.Context, delta string) {
+	if b.failed {
+		return
+	}
+	pipe := b.redis.Pipeline()
+	pipe.RPush(ctx, b.key, delta)
+	pipe.Expire(ctx, b.key, streamBufferTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		b.fail(ctx, err)
+	}
+}
+
+// finish drops the buffer once the reply is stored (or abandoned), which
+// tells resuming clients to read the final message instead.
+func (b *streamBuffer) finish(ctx context.Context) {
+	if err := b.redis.Del(context.WithoutCancel(ctx), b.key).Err(); err != nil {
+		slog.WarnContext(ctx, "clear stream buffer", "error", err)
+	}
+}
+
+func (b *streamBuffer) fail(ctx context.Context, err error) {
+	b.failed = true
+	slog.WarnContext(ctx, "stream buffer unavailable, resume disabled for this reply", "error", err)
+}
+
+// DetachStream returns a context for generating a streamed reply that
+// survives ctx being cancelled by up to detachedStreamLimit, so a reply whose
+// client disconnected still finishes and can be resumed.
+func DetachStream(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(detachedStreamLimit, cancel)
+	})
+	return detached, func() {
+		stop()
+		cancel()
+	}
+}
+
+// ResumeStream replays the reply being generated for chatID through onDelta,
+// starting with everything produced so far, and follows it until it is
+// stored. It returns the final assistant message, which is also what a
+// client gets straight away when generation finished while it was gone.
+func (s *Service) ResumeStream(ctx context.Context, userEmail, chatID string, onDelta func(string) error) (Message, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return Message{}, err
+	} else if !ok {
+		return Message{}, ErrChatNotFound
+	}
+	key := chatStreamKey(chatID)
+	marker, next := "", int64(1)
+	ticker := time.NewTicker(resumePollInterval)
+	defer ticker.Stop()
+	for {
+		values, err := s.Redis.LRange(ctx, key, 0, 0).Result()
+		if err != nil {
+			return Message{}, err
+		}
+		if len(values) == 0 {
+			// Between tool rounds the buffer is briefly gone while the chat
+			// lock is still held; only an unlocked chat is really finished.
+			running, err := s.Redis.Exists(ctx, chatLockKey(chatID)).Result()
+			if err != nil {
+				return Message{}, err
+			}
+			if running == 0 {
+				return s.finishedReply(ctx, chatID)
+			}
+		} else {
+			if values[0] != marker {
+				marker, next = values[0], 1
+			}
+			deltas, err := s.Redis.LRange(ctx, key, next, -1).Result()
+			if err != nil {
+				return Message{}, err
+			}
+			for _, delta := range deltas {
+				if err := onDelta(delta); err != nil {
+					return Message{}, err
+				}
+			}
+			next += int64(len(deltas))
+		}
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) finishedReply(ctx context.Context, chatID string) (Message, error) {
+	value, err := s.Redis.LIndex(ctx, chatMessagesKey(chatID), -1).Result()
+	if errors.Is(err, redis.Nil) {
+		return Message{}, ErrNoStream
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	var message Message
+	if err := json.Unmarshal([]byte(value), &message); err != nil {
+		return Message{}, err
+	}
+	if message.Role != "assistant" {
+		return Message{}, ErrNoStream
+	}
+	return message, nil
+}
+
+func chatStreamKey(chatID string) string {
+	return store.Key("chatstream", chatID)
+}
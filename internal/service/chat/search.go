@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	MaxSearchQueryRunes = 200
+	MaxSearchResults    = 20
+	maxSnippetsPerChat  = 3
+	snippetContextRunes = 40
+)
+
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// SearchIndex narrows a search down to the chats that may match. The default
+// scans every chat the user owns; an inverted index can replace it without
+// changing how matches and snippets are produced.
+type SearchIndex interface {
+	Candidates(ctx context.Context, userEmail, query string) ([]string, error)
+}
+
+type SearchSnippet struct {
+	Index int    `json:"index"`
+	Role  string `json:"role"`
+	Text  string `json:"text"`
+}
+
+type SearchResult struct {
+	Chat         ChatSummary     `json:"chat"`
+	TitleMatched bool            `json:"titleMatched"`
+	Snippets     []SearchSnippet `json:"snippets"`
+}
+
+type scanIndex struct {
+	redis *redis.Client
+}
+
+func (i scanIndex) Candidates(ctx context.Context, userEmail, _ string) ([]string, error) {
+	ids, err := i.redis.LRange(ctx, userChatsKey(userEmail), 0, -1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// SearchChats returns the user's chats, most recent first, whose title or
+// messages contain query case-insensitively, with snippets around each match.
+func (s *Service) SearchChats(ctx context.Context, userEmail, query string) ([]SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" || utf8.RuneCountInString(query) > MaxSearchQueryRunes {
+		return nil, ErrInvalidQuery
+	}
+	index := s.SearchIndex
+	if index == nil {
+		index = scanIndex{redis: s.Redis}
+	}
+	ids, err := index.Candidates(ctx, userEmail, query)
+	if err != nil {
+		return nil, err
+	}
+	needle := foldCase(query)
+	results := []SearchResult{}
+	for _, id := range ids {
+		if len(results) >= MaxSearchResults {
+			break
+		}
+		if ok, err := s.verifyOwner(ctx, userEmail, id); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		summary, err := s.loadSummary(ctx, id)
+		if err != nil {
+			continue
+		}
+		messages, err := s.fetchMessages(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		result := SearchResult{
+			Chat:         summary,
+			TitleMatched: strings.Contains(foldCase(summary.Title), needle),
+			Snippets:     []SearchSnippet{},
+		}
+		for i, message := range messages {
+			if len(result.Snippets) >= maxSnippetsPerChat {
+				break
+			}
+			if message.Role != "user" && message.Role != "assistant" {
+				continue
+			}
+			if text, ok := matchSnippet(message.Content, needle); ok {
+				result.Snippets = append(result.Snippets, SearchSnippet{Index: i, Role: message.Role, Text: text})
+			}
+		}
+		if result.TitleMatched || len(result.Snippets) > 0 {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// foldCase lowercases rune by rune so rune offsets in the result line up
+// with the original text.
+func foldCase(text string) string {
+	return strings.Map(unicode.ToLower, text)
+}
+
+func matchSnippet(content, needle string) (string, bool) {
+	folded := foldCase(content)
+	at := strings.Index(folded, needle)
+	if at < 0 {
+		return "", false
+	}
+	runes := []rune(content)
+	start := utf8.RuneCountInString(folded[:at])
+	end := start + utf8.RuneCountInString(needle)
+	from := max(start-snippetContextRunes, 0)
+	to := min(end+snippetContextRunes, len(runes))
+	snippet := strings.Join(strings.Fields(string(runes[from:to])), " ")
+	if from > 0 {
+		snippet = "…" + snippet
+	}
+	if to < len(runes) {
+		snippet += "…"
+	}
+	return snippet, true
+}
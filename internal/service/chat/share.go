@@ -0,0 +1,124 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+// MaxShareTTL bounds how long a share link may be asked to last; zero
+// still means it lasts until revoked.
+const MaxShareTTL = 365 * 24 * time.Hour
+
+var (
+	ErrShareNotFound   = errors.New("share link not found")
+	ErrInvalidShareTTL = errors.New("share link expiry must be between 0 and 365 days")
+)
+
+type ShareLink struct {
+	Token     string     `json:"token"`
+	ChatID    string     `json:"chatId"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// CreateShareLink lets anyone holding the returned token read the chat as it
+// stands at the time they open it. A ttl of zero keeps the link until it is
+// revoked or the chat is deleted.
+func (s *Service) CreateShareLink(ctx context.Context, userEmail, chatID string, ttl time.Duration) (ShareLink, error) {
+	if ttl < 0 || ttl > MaxShareTTL {
+		return ShareLink{}, ErrInvalidShareTTL
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return ShareLink{}, err
+	} else if !ok {
+		return ShareLink{}, ErrChatNotFound
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return ShareLink{}, err
+	}
+	link := ShareLink{Token: base64.RawURLEncoding.EncodeToString(secret), ChatID: chatID}
+	if ttl > 0 {
+		expiresAt := time.Now().UTC().Add(ttl)
+		link.ExpiresAt = &expiresAt
+	}
+	if err := s.Redis.Set(ctx, chatShareKey(link.Token), chatID, ttl).Err(); err != nil {
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+// RevokeShareLink deletes a link to one of the user's chats. Links to other
+// users' chats are reported as not found.
+func (s *Service) RevokeShareLink(ctx context.Context, userEmail, token string) error {
+	chatID, err := s.sharedChatID(ctx, token)
+	if err != nil {
+		return err
+	}
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return err
+	} else if !ok {
+		return ErrShareNotFound
+	}
+	return s.Redis.Del(ctx, chatShareKey(token)).Err()
+}
+
+// SharedChat is the read-only view behind a share link. The chat's own
+// system prompt is left out; the owner is never part of a ChatView.
+func (s *Service) SharedChat(ctx context.Context, token string) (ChatView, error) {
+	chatID, err := s.sharedChatID(ctx, token)
+	if err != nil {
+		return ChatView{}, err
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if errors.Is(err, redis.Nil) {
+		return ChatView{}, ErrShareNotFound
+	}
+	if err != nil {
+		return ChatView{}, err
+	}
+	summary.SystemPrompt = ""
+	messages, err := s.fetchMessages(ctx, chatID)
+	if err != nil {
+		return ChatView{}, err
+	}
+	return ChatView{Summary: summary, Messages: messages, Total: len(messages)}, nil
+}
+
+// SharedImage serves an image attached to a shared chat.
+func (s *Service) SharedImage(ctx context.Context, token, imageID string) ([]byte, string, error) {
+	chatID, err := s.sharedChatID(ctx, token)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := s.Redis.HGet(ctx, chatImagesKey(chatID), imageID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, "", ErrImageNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, http.DetectContentType(data), nil
+}
+
+func (s *Service) sharedChatID(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", ErrShareNotFound
+	}
+	chatID, err := s.Redis.Get(ctx, chatShareKey(token)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrShareNotFound
+	}
+	return chatID, err
+}
+
+func chatShareKey(token string) string {
+	return store.Key("chatshare", token)
+}
@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/store"
+)
+
+// StatsReport totals a user's activity. Chats and Messages describe what
+// the user has now; Usage and the model counts are lifetime figures that
+// survive deleted chats.
+type StatsReport struct {
+	Chats      int64          `json:"chats"`
+	Messages   int64          `json:"messages"`
+	Usage      UsageTotals    `json:"usage"`
+	TopModel   string         `json:"topModel,omitempty"`
+	ModelUsage map[string]int `json:"modelUsage"`
+}
+
+// UserStats reads the user's chat list, then counts every chat's messages in
+// one pipelined round trip. The cost is O(chats) in Redis commands and reply
+// size, bounded by MAX_CHATS_PER_USER when it is set; message bodies are
+// never loaded.
+func (s *Service) UserStats(ctx context.Context, userEmail string) (StatsReport, error) {
+	chatIDs, err := s.Redis.LRange(ctx, userChatsKey(userEmail), 0, -1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return StatsReport{}, err
+	}
+	report := StatsReport{Chats: int64(len(chatIDs)), ModelUsage: map[string]int{}}
+	if len(chatIDs) > 0 {
+		pipe := s.Redis.Pipeline()
+		counts := make([]*redis.IntCmd, len(chatIDs))
+		for i, chatID := range chatIDs {
+			counts[i] = pipe.LLen(ctx, chatMessagesKey(chatID))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return StatsReport{}, err
+		}
+		for _, count := range counts {
+			report.Messages += count.Val()
+		}
+	}
+	report.Usage, err = s.readUsage(ctx, userUsageKey(userEmail))
+	if err != nil {
+		return StatsReport{}, err
+	}
+	replies, err := s.Redis.HGetAll(ctx, userModelUsageKey(userEmail)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return StatsReport{}, err
+	}
+	top := 0
+	for model, value := range replies {
+		count, err := strconv.Atoi(value)
+		if err != nil || count <= 0 {
+			continue
+		}
+		report.ModelUsage[model] = count
+		if count > top || (count == top && model < report.TopModel) {
+			report.TopModel, top = model, count
+		}
+	}
+	return report, nil
+}
+
+// userModelUsageKey counts assistant replies per model.
+func userModelUsageKey(email string) string {
+	return store.Key("usermodelusage", email)
+}
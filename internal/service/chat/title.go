@@ -0,0 +1,128 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+const (
+	defaultTitleRunes = 32
+	// titleExchangeWindow is how far into a chat the first reply is looked
+	// for; replies past it never trigger a generated title.
+	titleExchangeWindow = 8
+	titleTimeout        = 30 * time.Second
+	titlePromptRunes    = 2000
+)
+
+const titleInstructions = "Write a short title, at most six words, for the conversation below. " +
+	"Reply with the title only: no quotes and no trailing punctuation."
+
+// summarizeTitle turns a chat's first message into its title: whitespace is
+// collapsed, and text longer than TitleMaxRunes is cut on a word boundary
+// when one falls in the second half of the limit, or else on a rune
+// boundary, and marked with an ellipsis.
+func (s *Service) summarizeTitle(content string) string {
+	limit := s.TitleMaxRunes
+	if limit <= 0 {
+		limit = defaultTitleRunes
+	}
+	return truncateTitle(strings.Join(strings.Fields(content), " "), limit)
+}
+
+func truncateTitle(title string, limit int) string {
+	runes := []rune(title)
+	if len(runes) <= limit {
+		return title
+	}
+	// One rune is left for the ellipsis.
+	cut := runes[:limit-1]
+	for i := len(cut) - 1; i > 0 && i >= len(cut)/2; i-- {
+		if unicode.IsSpace(cut[i]) {
+			cut = cut[:i]
+			break
+		}
+	}
+	trimmed := strings.TrimRightFunc(string(cut), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	})
+	if trimmed == "" {
+		trimmed = string(cut)
+	}
+	return trimmed + "…"
+}
+
+// maybeGenerateTitle asks TitleModel for a title once a chat's first reply is
+// stored, as long as the title is still the one cut from the first message.
+// It runs in the background and only logs failures; its tokens are not
+// charged to the user.
+func (s *Service) maybeGenerateTitle(ctx context.Context, userEmail, chatID string) {
+	if s.TitleModel == "" {
+		return
+	}
+	values, err := s.Redis.LRange(ctx, chatMessagesKey(chatID), 0, titleExchangeWindow-1).Result()
+	if err != nil {
+		return
+	}
+	var question, answer string
+	replies := 0
+	for _, value := range values {
+		var message Message
+		if json.Unmarshal([]byte(value), &message) != nil || message.Greeting {
+			continue
+		}
+		switch {
+		case message.Role == "user" && question == "":
+			question = message.Content
+		case message.Role == "assistant" && message.Content != "":
+			replies++
+			answer = message.Content
+		}
+	}
+	if question == "" || replies != 1 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), titleTimeout)
+	go func() {
+		defer cancel()
+		if err := s.generateTitle(ctx, userEmail, chatID, question, answer); err != nil {
+			slog.WarnContext(ctx, "generate chat title", "chat", chatID, "error", err)
+		}
+	}()
+}
+
+func (s *Service) generateTitle(ctx context.Context, userEmail, chatID, question, answer string) error {
+	prompt := "User: " + truncateTitle(question, titlePromptRunes) + "\n\nAssistant: " + truncateTitle(answer, titlePromptRunes)
+	reply, _, err := s.chatCompletion(ctx, s.backendModel(s.TitleModel), []openai.Message{
+		{Role: "system", Content: titleInstructions},
+		{Role: "user", Content: prompt},
+	}, openai.Options{Temperature: 0.2})
+	if err != nil {
+		return err
+	}
+	title := normalizeTitle(strings.Trim(strings.Join(strings.Fields(reply.Content), " "), "\"'`*#."))
+	if title == "" {
+		return nil
+	}
+	summary, err := s.loadSummary(ctx, chatID)
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The user may have renamed, cleared or deleted the chat meanwhile.
+	if summary.Title != s.summarizeTitle(question) {
+		return nil
+	}
+	summary.Title = title
+	return s.saveChatMeta(ctx, userEmail, summary)
+}
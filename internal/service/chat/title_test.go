@@ -0,0 +1,52 @@
+package chat
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateTitle(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		limit int
+		want  string
+	}{
+		{"short", "hi", 5, "hi"},
+		{"exact limit", "abcde", 5, "abcde"},
+		{"exact limit emoji", "😀😀😀😀😀", 5, "😀😀😀😀😀"},
+		{"no spaces", "abcdefghij", 5, "abcd…"},
+		{"emoji", "😀😀😀😀😀😀", 4, "😀😀😀…"},
+		{"cjk", "你好世界你好世界", 5, "你好世界…"},
+		{"cjk with spaces", "日本語 の タイトル です", 9, "日本語 の…"},
+		{"word boundary", "hello wonderful world", 12, "hello…"},
+		{"boundary too early", "ab cdefghijkl", 8, "ab cdef…"},
+		{"trailing punctuation", "hello, world and more", 8, "hello…"},
+		{"accents", "héllo wörld ñandú", 10, "héllo…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateTitle(tt.title, tt.limit)
+			if got != tt.want {
+				t.Errorf("truncateTitle(%q, %d) = %q, want %q", tt.title, tt.limit, got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateTitle(%q, %d) = %q, not valid UTF-8", tt.title, tt.limit, got)
+			}
+			if n := utf8.RuneCountInString(got); n > tt.limit {
+				t.Errorf("truncateTitle(%q, %d) has %d runes", tt.title, tt.limit, n)
+			}
+		})
+	}
+}
+
+func TestSummarizeTitle(t *testing.T) {
+	s := &Service{TitleMaxRunes: 10}
+	if got := s.summarizeTitle("  what\n\tis   this  "); got != "what is…" {
+		t.Errorf("summarizeTitle = %q, want %q", got, "what is…")
+	}
+	s.TitleMaxRunes = 0
+	if got := s.summarizeTitle("short question"); got != "short question" {
+		t.Errorf("summarizeTitle = %q, want %q", got, "short question")
+	}
+}
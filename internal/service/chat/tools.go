@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+const MaxToolSteps = 4
+
+type ToolFunc func(ctx context.Context, arguments string) (string, error)
+
+type registeredTool struct {
+	definition openai.Tool
+	run        ToolFunc
+}
+
+func (s *Service) RegisterTool(definition openai.Tool, run ToolFunc) {
+	for i, tool := range s.tools {
+		if tool.definition.Function.Name == definition.Function.Name {
+			s.tools[i] = registeredTool{definition: definition, run: run}
+			return
+		}
+	}
+	s.tools = append(s.tools, registeredTool{definition: definition, run: run})
+}
+
+func (s *Service) RegisterBuiltinTools() {
+	s.RegisterTool(openai.NewFunctionTool(
+		"current_time",
+		"Returns the current date and time, optionally in a given IANA time zone.",
+		json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string","description":"IANA time zone name, e.g. America/New_York"}}}`),
+	), currentTimeTool)
+}
+
+// RunToolCalls executes the tool calls requested by an assistant message and
+// stores each result as a tool message so the next completion can use it.
+func (s *Service) RunToolCalls(ctx context.Context, userEmail, chatID string, calls []openai.ToolCall) error {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return err
+	} else if !ok {
+		return ErrChatNotFound
+	}
+	for _, call := range calls {
+		result := s.runTool(ctx, call)
+		message := Message{
+			Role:       "tool",
+			Content:    result,
+			ToolCallID: call.ID,
+			CreatedAt:  time.Now().UTC(),
+		}
+		payload, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		pipe := s.Redis.TxPipeline()
+		s.queueAppend(ctx, pipe, chatID, payload)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return s.writeStore(err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) runTool(ctx context.Context, call openai.ToolCall) string {
+	var run ToolFunc
+	for _, tool := range s.tools {
+		if tool.definition.Function.Name == call.Function.Name {
+			run = tool.run
+			break
+		}
+	}
+	if run == nil {
+		payload, _ := json.Marshal(map[string]string{"error": "unknown tool " + call.Function.Name})
+		return string(payload)
+	}
+	result, err := run(ctx, call.Function.Arguments)
+	if err != nil {
+		payload, _ := json.Marshal(map[string]string{"error": err.Error()})
+		return string(payload)
+	}
+	return result
+}
+
+func (s *Service) completionOptions(prefs Preferences) openai.Options {
+	options := prefs.options()
+	for _, tool := range s.tools {
+		options.Tools = append(options.Tools, tool.definition)
+	}
+	return options
+}
+
+func currentTimeTool(_ context.Context, arguments string) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+	}
+	location := time.UTC
+	if args.Timezone != "" {
+		loaded, err := time.LoadLocation(args.Timezone)
+		if err != nil {
+			return "", fmt.Errorf("unknown timezone %q", args.Timezone)
+		}
+		location = loaded
+	}
+	payload, err := json.Marshal(map[string]string{
+		"time":     time.Now().In(location).Format(time.RFC3339),
+		"timezone": location.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"robertomachorro/smartchat/internal/service/openai"
+	"robertomachorro/smartchat/internal/store"
+)
+
+type UsageReport struct {
+	Chat  UsageTotals  `json:"chat"`
+	User  UsageTotals  `json:"user"`
+	Quota *QuotaStatus `json:"quota,omitempty"`
+}
+
+// UsageTotals is accumulated token usage. Cost only covers replies from
+// models with a configured price and is omitted when there were none.
+type UsageTotals struct {
+	openai.Usage
+	CostMicros int64  `json:"costMicros,omitempty"`
+	Cost       string `json:"cost,omitempty"`
+}
+
+func (s *Service) GetUsage(ctx context.Context, userEmail, chatID string) (UsageReport, error) {
+	if ok, err := s.verifyOwner(ctx, userEmail, chatID); err != nil {
+		return UsageReport{}, err
+	} else if !ok {
+		return UsageReport{}, ErrChatNotFound
+	}
+	chatUsage, err := s.readUsage(ctx, chatUsageKey(chatID))
+	if err != nil {
+		return UsageReport{}, err
+	}
+	userUsage, err := s.readUsage(ctx, userUsageKey(userEmail))
+	if err != nil {
+		return UsageReport{}, err
+	}
+	report := UsageReport{Chat: chatUsage, User: userUsage}
+	if s.quotasEnabled() {
+		quota, err := s.Quota(ctx, userEmail)
+		if err != nil {
+			return UsageReport{}, err
+		}
+		report.Quota = &quota
+	}
+	return report, nil
+}
+
+func (s *Service) readUsage(ctx context.Context, key string) (UsageTotals, error) {
+	values, err := s.Redis.HGetAll(ctx, key).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return UsageTotals{}, err
+	}
+	var usage UsageTotals
+	usage.PromptTokens, _ = strconv.Atoi(values["prompt_tokens"])
+	usage.CompletionTokens, _ = strconv.Atoi(values["completion_tokens"])
+	usage.TotalTokens, _ = strconv.Atoi(values["total_tokens"])
+	if micros, ok := values["cost_micros"]; ok {
+		usage.CostMicros, _ = strconv.ParseInt(micros, 10, 64)
+		usage.Cost = formatCost(usage.CostMicros)
+	}
+	return usage, nil
+}
+
+func incrementUsage(ctx context.Context, pipe redis.Pipeliner, key string, usage openai.Usage, costMicros int64, priced bool) {
+	pipe.HIncrBy(ctx, key, "prompt_tokens", int64(usage.PromptTokens))
+	pipe.HIncrBy(ctx, key, "completion_tokens", int64(usage.CompletionTokens))
+	pipe.HIncrBy(ctx, key, "total_tokens", int64(usage.TotalTokens))
+	if priced {
+		pipe.HIncrBy(ctx, key, "cost_micros", costMicros)
+	}
+}
+
+func chatUsageKey(chatID string) string {
+	return store.Key("chatusage", chatID)
+}
+
+func userUsageKey(email string) string {
+	return store.Key("userusage", email)
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"time"
@@ -13,6 +14,63 @@ import (
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Parts, when set, replaces Content on the wire with an array of content
+	// parts so images can travel alongside text. Text-only messages leave it
+	// empty and keep the plain string form.
+	Parts      []ContentPart `json:"-"`
+	ToolCalls  []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID string        `json:"tool_call_id,omitempty"`
+	// SystemFingerprint is copied from the response envelope and never sent.
+	SystemFingerprint string `json:"-"`
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+func TextPart(text string) ContentPart {
+	return ContentPart{Type: "text", Text: text}
+}
+
+func ImagePart(url string) ContentPart {
+	return ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}}
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), m.Parts})
+}
+
+type Options struct {
+	Temperature      float64
+	MaxTokens        *int
+	TopP             *float64
+	PresencePenalty  *float64
+	FrequencyPenalty *float64
+	Stop             []string
+	Seed             *int
+	ResponseFormat   *ResponseFormat
+	Tools            []Tool
+	// N asks for that many alternative replies; zero or one asks for one.
+	N int
+}
+
+// ResponseFormat constrains the shape of the reply; Type "json_object"
+// asks the model for a single valid JSON object.
+type ResponseFormat struct {
+	Type string `json:"type"`
 }
 
 type Usage struct {
@@ -21,70 +79,167 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		PromptTokens:     u.PromptTokens + other.PromptTokens,
+		CompletionTokens: u.CompletionTokens + other.CompletionTokens,
+		TotalTokens:      u.TotalTokens + other.TotalTokens,
+	}
+}
+
 type Client struct {
 	BaseURL string
 	APIKey  string
-	HTTP    *http.Client
+	// Organization and Project are sent as OpenAI-Organization and
+	// OpenAI-Project when set; other gateways never see the headers.
+	Organization string
+	Project      string
+	HTTP         *http.Client
+	MaxRetries   int
+	// StreamUsage asks streams for a final usage chunk through
+	// stream_options, which some gateways reject as an unknown field.
+	StreamUsage bool
 }
 
-func NewClient(baseURL, apiKey string) *Client {
+func NewClient(baseURL, apiKey string, timeout time.Duration) *Client {
 	return &Client{
-		BaseURL: baseURL,
-		APIKey:  apiKey,
-		HTTP:    &http.Client{Timeout: 45 * time.Second},
+		BaseURL:    baseURL,
+		APIKey:     apiKey,
+		HTTP:       &http.Client{Timeout: timeout},
+		MaxRetries: defaultMaxRetries,
 	}
 }
 
 type chatRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Temperature float64   `json:"temperature"`
+	Model            string          `json:"model"`
+	Messages         []Message       `json:"messages"`
+	Temperature      float64         `json:"temperature"`
+	MaxTokens        *int            `json:"max_tokens,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	PresencePenalty  *float64        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty,omitempty"`
+	Stop             []string        `json:"stop,omitempty"`
+	Seed             *int            `json:"seed,omitempty"`
+	ResponseFormat   *ResponseFormat `json:"response_format,omitempty"`
+	Tools            []Tool          `json:"tools,omitempty"`
+	N                int             `json:"n,omitempty"`
+}
+
+func newChatRequest(model string, messages []Message, options Options) chatRequest {
+	request := chatRequest{
+		Model:            model,
+		Messages:         messages,
+		Temperature:      options.Temperature,
+		MaxTokens:        options.MaxTokens,
+		TopP:             options.TopP,
+		PresencePenalty:  options.PresencePenalty,
+		FrequencyPenalty: options.FrequencyPenalty,
+		Stop:             options.Stop,
+		Seed:             options.Seed,
+		ResponseFormat:   options.ResponseFormat,
+		Tools:            options.Tools,
+	}
+	if options.N > 1 {
+		request.N = options.N
+	}
+	return request
 }
 
 type chatResponse struct {
 	Choices []struct {
 		Message Message `json:"message"`
 	} `json:"choices"`
-	Usage Usage `json:"usage"`
+	Usage             Usage  `json:"usage"`
+	SystemFingerprint string `json:"system_fingerprint"`
 }
 
-func (c *Client) ChatCompletion(ctx context.Context, model string, messages []Message, temperature float64) (Message, Usage, error) {
-	if c.BaseURL == "" {
-		return Message{}, Usage{}, fmt.Errorf("missing base url")
-	}
-	endpoint, err := url.JoinPath(c.BaseURL, "chat/completions")
+// ChatCompletions returns every choice in the response, in order; options.N
+// above one asks for alternatives. Usage covers all of them.
+func (c *Client) ChatCompletions(ctx context.Context, model string, messages []Message, options Options) (choices []Message, usage Usage, err error) {
+	ctx, span := startSpan(ctx, "openai.chat_completion", model)
+	defer func() { endSpan(span, usage, err) }()
+	response, err := c.post(ctx, c.HTTP, "chat/completions", newChatRequest(model, messages, options), "application/json")
 	if err != nil {
-		return Message{}, Usage{}, fmt.Errorf("build endpoint: %w", err)
+		return nil, Usage{}, err
 	}
-	payload, err := json.Marshal(chatRequest{
-		Model:       model,
-		Messages:    messages,
-		Temperature: temperature,
-	})
-	if err != nil {
-		return Message{}, Usage{}, fmt.Errorf("marshal request: %w", err)
+	defer response.Body.Close()
+	var parsed chatResponse
+	if err := json.NewDecoder(response.Body).Decode(&parsed); err != nil {
+		return nil, Usage{}, fmt.Errorf("decode response: %w", err)
 	}
-	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
-	if err != nil {
-		return Message{}, Usage{}, fmt.Errorf("create request: %w", err)
+	if len(parsed.Choices) == 0 {
+		return nil, Usage{}, fmt.Errorf("no choices returned")
 	}
-	request.Header.Set("Authorization", "Bearer "+c.APIKey)
-	request.Header.Set("Content-Type", "application/json")
+	choices = make([]Message, 0, len(parsed.Choices))
+	for _, choice := range parsed.Choices {
+		message := choice.Message
+		message.SystemFingerprint = parsed.SystemFingerprint
+		choices = append(choices, message)
+	}
+	return choices, parsed.Usage, nil
+}
 
-	response, err := c.HTTP.Do(request)
-	if err != nil {
-		return Message{}, Usage{}, fmt.Errorf("execute request: %w", err)
+func (c *Client) post(ctx context.Context, client *http.Client, path string, body any, accept string) (*http.Response, error) {
+	return c.send(ctx, client, http.MethodPost, path, body, accept)
+}
+
+func (c *Client) send(ctx context.Context, client *http.Client, method, path string, body any, accept string) (*http.Response, error) {
+	if c.BaseURL == "" {
+		return nil, fmt.Errorf("missing base url")
 	}
-	defer response.Body.Close()
-	if response.StatusCode < 200 || response.StatusCode > 299 {
-		return Message{}, Usage{}, fmt.Errorf("openai request failed: status %d", response.StatusCode)
+	endpoint, err := url.JoinPath(c.BaseURL, path)
+	if err != nil {
+		return nil, fmt.Errorf("build endpoint: %w", err)
 	}
-	var parsed chatResponse
-	if err := json.NewDecoder(response.Body).Decode(&parsed); err != nil {
-		return Message{}, Usage{}, fmt.Errorf("decode response: %w", err)
+	var payload []byte
+	if body != nil {
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("marshal request: %w", err)
+		}
 	}
-	if len(parsed.Choices) == 0 {
-		return Message{}, Usage{}, fmt.Errorf("no choices returned")
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if payload != nil {
+			reader = bytes.NewReader(payload)
+		}
+		request, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+		if err != nil {
+			return nil, fmt.Errorf("create request: %w", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+c.APIKey)
+		if payload != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		request.Header.Set("Accept", accept)
+		if c.Organization != "" {
+			request.Header.Set("OpenAI-Organization", c.Organization)
+		}
+		if c.Project != "" {
+			request.Header.Set("OpenAI-Project", c.Project)
+		}
+
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, fmt.Errorf("execute request: %w", err)
+		}
+		if response.StatusCode >= 200 && response.StatusCode <= 299 {
+			return response, nil
+		}
+		if !retryableStatus(response.StatusCode) || attempt >= c.MaxRetries {
+			apiErr := newAPIError(response, c.APIKey)
+			response.Body.Close()
+			return nil, apiErr
+		}
+		delay := retryDelay(attempt, response.Header.Get("Retry-After"))
+		_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+		response.Body.Close()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("retry aborted after status %d: %w", response.StatusCode, ctx.Err())
+		case <-timer.C:
+		}
 	}
-	return parsed.Choices[0].Message, parsed.Usage, nil
 }
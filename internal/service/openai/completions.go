@@ -0,0 +1,110 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxStopSequences is the most stop sequences the API accepts.
+const maxStopSequences = 4
+
+// turnStop keeps a legacy model from writing the user's next turn itself.
+const turnStop = "\nUser:"
+
+type completionRequest struct {
+	Model            string   `json:"model"`
+	Prompt           string   `json:"prompt"`
+	Temperature      float64  `json:"temperature"`
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	N                int      `json:"n,omitempty"`
+}
+
+type completionResponse struct {
+	Choices []struct {
+		Text string `json:"text"`
+	} `json:"choices"`
+	Usage             Usage  `json:"usage"`
+	SystemFingerprint string `json:"system_fingerprint"`
+}
+
+// Completions is the legacy counterpart of ChatCompletions. Tools and
+// response formats have no equivalent there and are left out.
+func (c *Client) Completions(ctx context.Context, model, prompt string, options Options) (choices []Message, usage Usage, err error) {
+	ctx, span := startSpan(ctx, "openai.completion", model)
+	defer func() { endSpan(span, usage, err) }()
+	request := completionRequest{
+		Model:            model,
+		Prompt:           prompt,
+		Temperature:      options.Temperature,
+		MaxTokens:        options.MaxTokens,
+		TopP:             options.TopP,
+		PresencePenalty:  options.PresencePenalty,
+		FrequencyPenalty: options.FrequencyPenalty,
+		Stop:             options.Stop,
+		Seed:             options.Seed,
+	}
+	if len(request.Stop) < maxStopSequences {
+		request.Stop = append(append([]string(nil), request.Stop...), turnStop)
+	}
+	if options.N > 1 {
+		request.N = options.N
+	}
+	response, err := c.post(ctx, c.HTTP, "completions", request, "application/json")
+	if err != nil {
+		return nil, Usage{}, err
+	}
+	defer response.Body.Close()
+	var parsed completionResponse
+	if err := json.NewDecoder(response.Body).Decode(&parsed); err != nil {
+		return nil, Usage{}, fmt.Errorf("decode response: %w", err)
+	}
+	if len(parsed.Choices) == 0 {
+		return nil, Usage{}, fmt.Errorf("no choices returned")
+	}
+	choices = make([]Message, 0, len(parsed.Choices))
+	for _, choice := range parsed.Choices {
+		choices = append(choices, Message{
+			Role:              "assistant",
+			Content:           strings.TrimSpace(choice.Text),
+			SystemFingerprint: parsed.SystemFingerprint,
+		})
+	}
+	return choices, parsed.Usage, nil
+}
+
+// FlattenMessages writes a chat history as one transcript prompt, ending
+// with an open assistant turn for the model to complete. Tool traffic and
+// image parts have no place in it and are dropped.
+func FlattenMessages(messages []Message) string {
+	var prompt strings.Builder
+	for _, message := range messages {
+		var speaker string
+		switch message.Role {
+		case "system":
+			speaker = "System"
+		case "user":
+			speaker = "User"
+		case "assistant":
+			speaker = "Assistant"
+		default:
+			continue
+		}
+		content := strings.TrimSpace(message.Content)
+		if content == "" {
+			continue
+		}
+		prompt.WriteString(speaker)
+		prompt.WriteString(": ")
+		prompt.WriteString(content)
+		prompt.WriteString("\n\n")
+	}
+	prompt.WriteString("Assistant:")
+	return prompt.String()
+}
@@ -0,0 +1,34 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type modelList struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// ListModels returns the ids of the models the backend serves.
+func (c *Client) ListModels(ctx context.Context) ([]string, error) {
+	response, err := c.send(ctx, c.HTTP, http.MethodGet, "models", nil, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var parsed modelList
+	if err := json.NewDecoder(response.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("decode models: %w", err)
+	}
+	ids := make([]string, 0, len(parsed.Data))
+	for _, model := range parsed.Data {
+		if model.ID != "" {
+			ids = append(ids, model.ID)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,157 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	retryBaseDelay    = 500 * time.Millisecond
+	retryMaxDelay     = 8 * time.Second
+	retryAfterLimit   = 30 * time.Second
+	maxErrorBodyBytes = 16 * 1024
+	maxErrorBodyChars = 512
+)
+
+type APIError struct {
+	StatusCode int
+	Message    string
+	Code       string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("openai request failed: status %d: %s", e.StatusCode, e.Message)
+	}
+	if e.Body != "" {
+		return fmt.Sprintf("openai request failed: status %d: %s", e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("openai request failed: status %d", e.StatusCode)
+}
+
+func newAPIError(response *http.Response, apiKey string) *APIError {
+	apiErr := &APIError{StatusCode: response.StatusCode}
+	raw, err := io.ReadAll(io.LimitReader(response.Body, maxErrorBodyBytes))
+	if err != nil || len(raw) == 0 {
+		return apiErr
+	}
+	body := strings.TrimSpace(string(raw))
+	if apiKey != "" {
+		body = strings.ReplaceAll(body, apiKey, "[redacted]")
+	}
+	var parsed struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &parsed); err == nil && len(parsed.Error) > 0 {
+		var detail struct {
+			Message string `json:"message"`
+			Code    any    `json:"code"`
+		}
+		var plain string
+		if err := json.Unmarshal(parsed.Error, &detail); err == nil && detail.Message != "" {
+			apiErr.Message = detail.Message
+			apiErr.Code, _ = detail.Code.(string)
+		} else if err := json.Unmarshal(parsed.Error, &plain); err == nil {
+			apiErr.Message = plain
+		}
+		if apiKey != "" {
+			apiErr.Message = strings.ReplaceAll(apiErr.Message, apiKey, "[redacted]")
+		}
+	}
+	apiErr.Body = truncate(body, maxErrorBodyChars)
+	return apiErr
+}
+
+// IsModelNotFound reports whether err is the backend rejecting the requested
+// model as unknown. OpenAI says so with a model_not_found code; other
+// gateways only word it in the message of a 400 or 404.
+func IsModelNotFound(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == "model_not_found" {
+		return true
+	}
+	if apiErr.StatusCode != http.StatusBadRequest && apiErr.StatusCode != http.StatusNotFound {
+		return false
+	}
+	text := apiErr.Message
+	if text == "" {
+		text = apiErr.Body
+	}
+	text = strings.ToLower(text)
+	if !strings.Contains(text, "model") {
+		return false
+	}
+	for _, phrase := range []string{"not found", "not exist", "unknown model", "no such model", "not available"} {
+		if strings.Contains(text, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(value string, limit int) string {
+	runes := []rune(value)
+	if len(runes) <= limit {
+		return value
+	}
+	return string(runes[:limit]) + "..."
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func retryDelay(attempt int, retryAfter string) time.Duration {
+	if delay, ok := parseRetryAfter(retryAfter); ok {
+		return delay
+	}
+	backoff := retryBaseDelay << attempt
+	if backoff <= 0 || backoff > retryMaxDelay {
+		backoff = retryMaxDelay
+	}
+	half := backoff / 2
+	return half + rand.N(half+1)
+}
+
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if when, err := http.ParseTime(value); err == nil {
+		delay = time.Until(when)
+	} else {
+		return 0, false
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > retryAfterLimit {
+		delay = retryAfterLimit
+	}
+	return delay, true
+}
@@ -0,0 +1,199 @@
+package openai
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const streamDone = "[DONE]"
+
+type Stream struct {
+	Deltas      <-chan string
+	done        chan struct{}
+	usage       Usage
+	role        string
+	toolCalls   []ToolCall
+	fingerprint string
+	err         error
+}
+
+// Usage and Err are only meaningful once Deltas has been closed. Usage is
+// zero when the backend reported none.
+func (s *Stream) Usage() Usage {
+	<-s.done
+	return s.usage
+}
+
+func (s *Stream) Role() string {
+	<-s.done
+	return s.role
+}
+
+func (s *Stream) ToolCalls() []ToolCall {
+	<-s.done
+	return s.toolCalls
+}
+
+func (s *Stream) SystemFingerprint() string {
+	<-s.done
+	return s.fingerprint
+}
+
+func (s *Stream) Err() error {
+	<-s.done
+	return s.err
+}
+
+type streamRequest struct {
+	chatRequest
+	Stream        bool           `json:"stream"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type streamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Role      string          `json:"role"`
+			Content   string          `json:"content"`
+			ToolCalls []toolCallDelta `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage             *Usage `json:"usage"`
+	SystemFingerprint string `json:"system_fingerprint"`
+}
+
+type toolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+func (c *Client) ChatCompletionStream(ctx context.Context, model string, messages []Message, options Options) (*Stream, error) {
+	ctx, span := startSpan(ctx, "openai.chat_completion_stream", model)
+	request := streamRequest{chatRequest: newChatRequest(model, messages, options), Stream: true}
+	if c.StreamUsage {
+		request.StreamOptions = &streamOptions{IncludeUsage: true}
+	}
+	response, err := c.post(ctx, c.streamHTTP(), "chat/completions", request, "text/event-stream")
+	if err != nil {
+		endSpan(span, Usage{}, err)
+		return nil, err
+	}
+
+	deltas := make(chan string)
+	stream := &Stream{Deltas: deltas, done: make(chan struct{}), role: "assistant"}
+	go func() {
+		defer close(stream.done)
+		defer close(deltas)
+		defer response.Body.Close()
+		stream.err = stream.read(ctx, response, deltas)
+		endSpan(span, stream.usage, stream.err)
+	}()
+	return stream, nil
+}
+
+// The overall client timeout would cut long generations short, so streams
+// share the transport but rely on the request context for cancellation.
+func (c *Client) streamHTTP() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{
+		Transport:     c.HTTP.Transport,
+		CheckRedirect: c.HTTP.CheckRedirect,
+		Jar:           c.HTTP.Jar,
+	}
+}
+
+func (s *Stream) read(ctx context.Context, response *http.Response, deltas chan<- string) error {
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			if value, ok := strings.CutPrefix(line, "data:"); ok {
+				data = append(data, strings.TrimPrefix(value, " "))
+			}
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+		frame := strings.Join(data, "\n")
+		data = data[:0]
+		done, err := s.handleFrame(ctx, frame, deltas)
+		if err != nil || done {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read stream: %w", err)
+	}
+	if len(data) > 0 {
+		if _, err := s.handleFrame(ctx, strings.Join(data, "\n"), deltas); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (s *Stream) handleFrame(ctx context.Context, frame string, deltas chan<- string) (bool, error) {
+	if strings.TrimSpace(frame) == streamDone {
+		return true, nil
+	}
+	var chunk streamChunk
+	if err := json.Unmarshal([]byte(frame), &chunk); err != nil {
+		return false, fmt.Errorf("decode stream chunk: %w", err)
+	}
+	if chunk.Usage != nil {
+		s.usage = *chunk.Usage
+	}
+	if chunk.SystemFingerprint != "" {
+		s.fingerprint = chunk.SystemFingerprint
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Role != "" {
+			s.role = choice.Delta.Role
+		}
+		for _, delta := range choice.Delta.ToolCalls {
+			s.mergeToolCall(delta)
+		}
+		if choice.Delta.Content == "" {
+			continue
+		}
+		select {
+		case deltas <- choice.Delta.Content:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	return false, nil
+}
+
+func (s *Stream) mergeToolCall(delta toolCallDelta) {
+	for len(s.toolCalls) <= delta.Index {
+		s.toolCalls = append(s.toolCalls, ToolCall{Type: "function"})
+	}
+	call := &s.toolCalls[delta.Index]
+	if delta.ID != "" {
+		call.ID = delta.ID
+	}
+	if delta.Type != "" {
+		call.Type = delta.Type
+	}
+	call.Function.Name += delta.Function.Name
+	call.Function.Arguments += delta.Function.Arguments
+}
@@ -0,0 +1,95 @@
+package openai
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// TransportOptions adjusts outbound connections for locked-down networks.
+// ProxyURL replaces HTTPS_PROXY/HTTP_PROXY while NO_PROXY still applies;
+// CACertFile adds a PEM bundle, such as an intercepting proxy's root, to the
+// system roots.
+//
+// The remaining fields tune connection reuse and bound how long connecting
+// may take, separately from the client's overall request timeout; zero keeps
+// http.DefaultTransport's value.
+type TransportOptions struct {
+	ProxyURL   string
+	CACertFile string
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+}
+
+// NewTransport returns nil when opts is empty, which leaves clients on
+// http.DefaultTransport and its environment-based proxy settings.
+func NewTransport(opts TransportOptions) (*http.Transport, error) {
+	if opts == (TransportOptions{}) {
+		return nil, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.MaxIdleConns > 0 {
+		transport.MaxIdleConns = opts.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if opts.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   opts.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if opts.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	}
+	if opts.ProxyURL != "" {
+		if _, err := url.Parse(opts.ProxyURL); err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		proxy := (&httpproxy.Config{
+			HTTPProxy:  opts.ProxyURL,
+			HTTPSProxy: opts.ProxyURL,
+			NoProxy:    noProxyFromEnv(),
+		}).ProxyFunc()
+		transport.Proxy = func(request *http.Request) (*url.URL, error) {
+			return proxy(request.URL)
+		}
+	}
+	if opts.CACertFile != "" {
+		pem, err := os.ReadFile(opts.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca bundle: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca bundle %s holds no PEM certificates", opts.CACertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: roots}
+	}
+	return transport, nil
+}
+
+func noProxyFromEnv() string {
+	if value := os.Getenv("NO_PROXY"); value != "" {
+		return value
+	}
+	return os.Getenv("no_proxy")
+}
@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"robertomachorro/smartchat/internal/service/chat"
+	"robertomachorro/smartchat/internal/service/openai"
+)
+
+// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the request
+// body, keyed with the webhook secret.
+const SignatureHeader = "X-SmartChat-Signature"
+
+const (
+	queueSize       = 256
+	maxAttempts     = 3
+	retryBaseDelay  = time.Second
+	deliveryTimeout = 10 * time.Second
+)
+
+// Payload is the JSON body of every webhook request. User is an HMAC of the
+// email under the webhook secret: stable for one user, but not reversible by
+// the receiver.
+type Payload struct {
+	Event  string       `json:"event"`
+	ChatID string       `json:"chatId"`
+	User   string       `json:"user"`
+	Model  string       `json:"model"`
+	Usage  openai.Usage `json:"usage"`
+	Time   time.Time    `json:"time"`
+}
+
+// Notifier POSTs chat events to a URL from a single background worker.
+// Events wait in a bounded queue and are dropped, with a warning, when it is
+// full, so a slow receiver never holds up a reply.
+type Notifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+func New(url, secret string) *Notifier {
+	n := &Notifier{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: deliveryTimeout},
+		queue:  make(chan []byte, queueSize),
+		done:   make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// CompletionFinished implements chat.EventSink.
+func (n *Notifier) CompletionFinished(event chat.CompletionEvent) {
+	body, err := json.Marshal(Payload{
+		Event:  "completion.finished",
+		ChatID: event.ChatID,
+		User:   n.sign([]byte(event.UserEmail)),
+		Model:  event.Model,
+		Usage:  event.Usage,
+		Time:   event.FinishedAt,
+	})
+	if err != nil {
+		slog.Warn("encode webhook event", "error", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- body:
+	default:
+		slog.Warn("webhook queue full, dropping event", "chat", event.ChatID)
+	}
+}
+
+// Close stops accepting events and waits, until ctx ends, for the queued
+// ones to be delivered.
+func (n *Notifier) Close(ctx context.Context) error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	select {
+	case <-n.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for body := range n.queue {
+		n.deliver(body)
+	}
+}
+
+func (n *Notifier) deliver(body []byte) {
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBaseDelay << (attempt - 1))
+		}
+		if err = n.post(body); err == nil {
+			return
+		}
+	}
+	slog.Warn("webhook delivery failed", "attempts", maxAttempts, "error", err)
+}
+
+func (n *Notifier) post(body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SignatureHeader, "sha256="+n.sign(body))
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (n *Notifier) sign(data []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,18 @@
+package store
+
+import "strings"
+
+// keyPrefix namespaces every key this app writes so several apps can share
+// one Redis. It is set once at startup, before any key is built.
+var keyPrefix string
+
+// SetKeyPrefix installs REDIS_KEY_PREFIX. Call it before serving requests.
+func SetKeyPrefix(prefix string) {
+	keyPrefix = prefix
+}
+
+// Key joins parts with ":" under the configured prefix. Every Redis key the
+// app reads or writes, including SCAN patterns, must be built here.
+func Key(parts ...string) string {
+	return keyPrefix + strings.Join(parts, ":")
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	t.Cleanup(func() { SetKeyPrefix("") })
+	tests := []struct {
+		prefix string
+		parts  []string
+		want   string
+	}{
+		{"", []string{"chatmeta", "abc"}, "chatmeta:abc"},
+		{"app1:", []string{"chatmeta", "abc"}, "app1:chatmeta:abc"},
+		{"app1:", []string{"chatowner", "*"}, "app1:chatowner:*"},
+	}
+	for _, tt := range tests {
+		SetKeyPrefix(tt.prefix)
+		if got := Key(tt.parts...); got != tt.want {
+			t.Errorf("Key(%q) with prefix %q = %q, want %q", tt.parts, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestStoreKeysUsePrefix(t *testing.T) {
+	SetKeyPrefix("app1:")
+	t.Cleanup(func() { SetKeyPrefix("") })
+	for name, key := range map[string]string{
+		"sessionKey":        sessionKey("id"),
+		"userSessionsKey":   userSessionsKey("a@example.com"),
+		"sessionVersionKey": sessionVersionKey("a@example.com"),
+	} {
+		if !strings.HasPrefix(key, "app1:") {
+			t.Errorf("%s = %q, want the app1: prefix", name, key)
+		}
+	}
+}
+
+// TestKeyBuildersCallKey checks every function in the module named like a
+// key builder (ending in "Key" and returning a string) goes through Key, so
+// none can write outside REDIS_KEY_PREFIX.
+func TestKeyBuildersCallKey(t *testing.T) {
+	root := filepath.Join("..", "..")
+	builders := 0
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if name := entry.Name(); path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "web") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+		if err != nil {
+			return err
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil || !strings.HasSuffix(fn.Name.Name, "Key") || !returnsString(fn) {
+				continue
+			}
+			if fn.Name.Name == "Key" && file.Name.Name == "store" {
+				continue
+			}
+			builders++
+			if !callsKey(fn.Body, file.Name.Name == "store") {
+				t.Errorf("%s: %s builds a key without store.Key", path, fn.Name.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builders == 0 {
+		t.Fatal("found no key builders; is the module root right?")
+	}
+}
+
+func returnsString(fn *ast.FuncDecl) bool {
+	results := fn.Type.Results
+	if results == nil || len(results.List) != 1 {
+		return false
+	}
+	ident, ok := results.List[0].Type.(*ast.Ident)
+	return ok && ident.Name == "string"
+}
+
+func callsKey(body *ast.BlockStmt, inStore bool) bool {
+	found := false
+	ast.Inspect(body, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok {
+			return !found
+		}
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			found = found || inStore && fun.Name == "Key"
+		case *ast.SelectorExpr:
+			if pkg, ok := fun.X.(*ast.Ident); ok && pkg.Name == "store" && fun.Sel.Name == "Key" {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
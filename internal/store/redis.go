@@ -2,22 +2,118 @@ package store
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+const (
+	connectAttempts = 5
+	connectTimeout  = 3 * time.Second
+	connectBackoff  = 500 * time.Millisecond
+)
+
 type RedisStore struct {
 	Client *redis.Client
 }
 
-func NewRedisStore(redisURL string) (*RedisStore, error) {
+type Options struct {
+	PoolSize           int
+	MinIdleConns       int
+	InsecureSkipVerify bool
+	// Tracing adds a span per command; leave it off when no exporter is
+	// configured so the default path skips the hook entirely.
+	Tracing bool
+}
+
+func NewRedisStore(redisURL string, opts Options) (*RedisStore, error) {
+	parsed, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	if parsed.Scheme != "redis" && parsed.Scheme != "rediss" && parsed.Scheme != "unix" {
+		return nil, fmt.Errorf("invalid REDIS_URL: unsupported scheme %q (use redis://, rediss:// or unix://)", parsed.Scheme)
+	}
 	options, err := redis.ParseURL(redisURL)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	if parsed.Scheme == "rediss" {
+		if options.TLSConfig == nil {
+			options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: parsed.Hostname()}
+		}
+		options.TLSConfig.InsecureSkipVerify = opts.InsecureSkipVerify
+	}
+	if opts.PoolSize > 0 {
+		options.PoolSize = opts.PoolSize
 	}
+	if opts.MinIdleConns > 0 {
+		options.MinIdleConns = opts.MinIdleConns
+	}
+	// go-redis would resend any command after a network error, including an
+	// RPUSH that already landed. Reads are retried by the chat service.
+	options.MaxRetries = -1
 	client := redis.NewClient(options)
-	if err := client.Ping(context.Background()).Err(); err != nil {
+	if opts.Tracing {
+		client.AddHook(tracingHook{})
+	}
+	if err := pingWithRetry(client); err != nil {
+		_ = client.Close()
 		return nil, err
 	}
 	return &RedisStore{Client: client}, nil
 }
+
+// pingWithRetry gives Redis a few seconds to come up when it starts
+// alongside the app.
+func pingWithRetry(client *redis.Client) error {
+	delay := connectBackoff
+	var err error
+	for attempt := 1; attempt <= connectAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		err = client.Ping(ctx).Err()
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt < connectAttempts {
+			slog.Warn("redis not ready, retrying", "attempt", attempt, "error", err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return fmt.Errorf("redis ping failed after %d attempts: %w", connectAttempts, err)
+}
+
+func (s *RedisStore) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	err := s.Client.Ping(ctx).Err()
+	return time.Since(start), err
+}
+
+func (s *RedisStore) Close() error {
+	return s.Client.Close()
+}
+
+// SessionVersion returns the user's current session generation. Sessions
+// minted with an older generation are treated as revoked.
+func (s *RedisStore) SessionVersion(ctx context.Context, email string) (int64, error) {
+	version, err := s.Client.Get(ctx, sessionVersionKey(email)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return version, err
+}
+
+func (s *RedisStore) BumpSessionVersion(ctx context.Context, email string) (int64, error) {
+	return s.Client.Incr(ctx, sessionVersionKey(email)).Result()
+}
+
+func sessionVersionKey(email string) string {
+	return Key("sessionver", email)
+}
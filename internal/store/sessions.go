@@ -0,0 +1,151 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/redis/go-redis/v9"
+)
+
+// browserSessionTTL is how long Redis keeps a session whose cookie lasts
+// until the browser closes, since the server cannot tell when that is.
+const browserSessionTTL = 30 * 24 * time.Hour
+
+// SessionStore keeps session values in Redis and only a signed random id in
+// the cookie, so cookies stay small and sessions can be ended server-side.
+type SessionStore struct {
+	Client  *redis.Client
+	Options *sessions.Options
+	// UserKey names the session value holding the signed-in user's email.
+	// Sessions that have one are indexed so RevokeUser can find them.
+	UserKey string
+	codecs  []securecookie.Codec
+}
+
+func NewSessionStore(client *redis.Client, keyPairs ...[]byte) *SessionStore {
+	return &SessionStore{
+		Client:  client,
+		Options: &sessions.Options{Path: "/"},
+		codecs:  securecookie.CodecsFromPairs(keyPairs...),
+	}
+}
+
+// MaxAge sets the cookie lifetime in seconds, and how old a signed id the
+// store accepts; 0 keeps the cookie until the browser closes.
+func (s *SessionStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.codecs {
+		if cookie, ok := codec.(*securecookie.SecureCookie); ok {
+			cookie.MaxAge(age)
+		}
+	}
+}
+
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie. A missing cookie,
+// or one whose session has expired or been revoked, gives a fresh session.
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...); err != nil {
+		return session, err
+	}
+	data, err := s.Client.Get(r.Context(), sessionKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session to Redis and sets its cookie. A negative MaxAge
+// deletes the session and expires the cookie.
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx := r.Context()
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.Client.Del(ctx, sessionKey(session.ID)).Err(); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		id := make([]byte, 32)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		session.ID = base64.RawURLEncoding.EncodeToString(id)
+	}
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if ttl == 0 {
+		ttl = browserSessionTTL
+	}
+	pipe := s.Client.TxPipeline()
+	pipe.Set(ctx, sessionKey(session.ID), data.Bytes(), ttl)
+	if email, _ := session.Values[s.UserKey].(string); s.UserKey != "" && email != "" {
+		pipe.SAdd(ctx, userSessionsKey(email), session.ID)
+		pipe.Expire(ctx, userSessionsKey(email), ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// RevokeUser deletes every session email holds.
+func (s *SessionStore) RevokeUser(ctx context.Context, email string) error {
+	ids, err := s.Client.SMembers(ctx, userSessionsKey(email)).Result()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, sessionKey(id))
+	}
+	keys = append(keys, userSessionsKey(email))
+	return s.Client.Del(ctx, keys...).Err()
+}
+
+func sessionKey(id string) string {
+	return Key("session", id)
+}
+
+func userSessionsKey(email string) string {
+	return Key("usersessions", email)
+}